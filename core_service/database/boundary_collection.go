@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"time"
 	"errors"
+	"math"
+	"sort"
+	"strings"
 
 	geoTrans "core_service/geoTransformations"
 
@@ -59,7 +62,7 @@ func SaveBoundary(ctx context.Context, client *mongo.Client, boundary *Boundary)
 	if err != nil {
 		return err
 	}
-	return nil
+	return AddBoundaryMgrsSquares(ctx, client, boundary.MgrsCodes)
 }
 
 func DeleteBoundary(ctx context.Context, dbClient *mongo.Client, filters bson.D) error {
@@ -68,22 +71,26 @@ func DeleteBoundary(ctx context.Context, dbClient *mongo.Client, filters bson.D)
 	defer mongoCancel()
 
 	// delete rasters for this boundary
-	findBoundaryOpts := options.FindOne().SetProjection(bson.D{{"_id", 1}})
-	var result bson.M
-	if err := coll.FindOne(ctx, filters, findBoundaryOpts).Decode(&result); err != nil {
+	findBoundaryOpts := options.FindOne().SetProjection(bson.D{{"_id", 1}, {"mgrs_codes", 1}})
+	var boundary Boundary
+	if err := coll.FindOne(ctx, filters, findBoundaryOpts).Decode(&boundary); err != nil {
 		return err
 	}
 
-	boundaryId := result["_id"].(primitive.ObjectID)
-	if err := DeleteExistingBoundaryRastersByType(ctx, dbClient, boundaryId, ""); err != nil {
+	if err := DeleteExistingBoundaryRastersByType(ctx, dbClient, boundary.ID, ""); err != nil {
+		return err
+	}
+	if err := DeleteBoundarySceneStats(ctx, dbClient, boundary.ID); err != nil {
 		return err
 	}
 
-	_, err := coll.DeleteOne(mongoCtx, filters)
+	result, err := coll.DeleteOne(mongoCtx, bson.D{{"_id", boundary.ID}})
 	if err != nil {
 		return err
+	} else if result.DeletedCount == 0 {
+		return nil
 	}
-	return nil
+	return RemoveBoundaryMgrsSquares(ctx, dbClient, boundary.MgrsCodes)
 }
 
 
@@ -154,6 +161,84 @@ func ComputeMgrsCodesFromGeometry(geometry *Geometry) []string {
 	return mgrsCodes
 }
 
+// the spacing of the points sampled over an area of interest, well below
+// the 100km size of an mgrs square
+const MGRS_SQUARE_SAMPLE_DEGREES = 0.05
+
+// ComputeMgrsSquaresFromGeometry returns the sorted mgrs 100km squares,
+// like 15TUL, which the polygon touches. Unlike the corners used by
+// ComputeMgrsCodesFromGeometry the polygon is sampled along its edges
+// and over its interior, so large areas get every square inside them.
+// Zones are written without a leading zero, the way the satellite data
+// object paths write them.
+func ComputeMgrsSquaresFromGeometry(geometry *Geometry) ([]string, error) {
+	if geometry.Type != "Polygon" {
+		return nil, errors.New("Geometry must be of type Polygon")
+	} else if len(geometry.Coordinates) == 0 || len(geometry.Coordinates[0]) < 3 {
+		return nil, errors.New("Polygon must have an outer boundary with at least 3 points")
+	}
+
+	squareIndex := make(map[string]bool)
+	addPoint := func(lng, lat float64) {
+		mgrsCode, err := geoTrans.DefaultMGRSConverter.ConvertFromGeodetic(s2.LatLngFromDegrees(lat, lng), 0)
+		// polar squares have no zone and no satellite data
+		if err != nil || len(mgrsCode) < 5 || mgrsCode[0] < '0' || mgrsCode[0] > '9' {
+			return
+		}
+		squareIndex[strings.TrimPrefix(mgrsCode[:5], "0")] = true
+	}
+
+	// the edges catch the squares the polygon only clips
+	for _, ring := range geometry.Coordinates {
+		for i, point := range ring {
+			nextPoint := ring[(i+1)%len(ring)]
+			steps := int(math.Ceil(math.Max(math.Abs(nextPoint[0]-point[0]), math.Abs(nextPoint[1]-point[1])) / MGRS_SQUARE_SAMPLE_DEGREES))
+			for step := 0; step <= steps; step++ {
+				fraction := 0.0
+				if steps > 0 {
+					fraction = float64(step) / float64(steps)
+				}
+				addPoint(point[0]+fraction*(nextPoint[0]-point[0]), point[1]+fraction*(nextPoint[1]-point[1]))
+			}
+		}
+	}
+
+	minLng, minLat := math.Inf(1), math.Inf(1)
+	maxLng, maxLat := math.Inf(-1), math.Inf(-1)
+	for _, point := range geometry.Coordinates[0] {
+		minLng, maxLng = math.Min(minLng, point[0]), math.Max(maxLng, point[0])
+		minLat, maxLat = math.Min(minLat, point[1]), math.Max(maxLat, point[1])
+	}
+	for lat := minLat; lat <= maxLat; lat += MGRS_SQUARE_SAMPLE_DEGREES {
+		for lng := minLng; lng <= maxLng; lng += MGRS_SQUARE_SAMPLE_DEGREES {
+			if pointInPolygon(geometry.Coordinates, lng, lat) {
+				addPoint(lng, lat)
+			}
+		}
+	}
+
+	squares := make([]string, 0, len(squareIndex))
+	for square := range squareIndex {
+		squares = append(squares, square)
+	}
+	sort.Strings(squares)
+	return squares, nil
+}
+
+// pointInPolygon casts a ray from the point across every ring, so points
+// inside a hole are outside of the polygon.
+func pointInPolygon(rings [][][]float64, lng, lat float64) bool {
+	inside := false
+	for _, ring := range rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			if (ring[i][1] > lat) != (ring[j][1] > lat) &&
+				lng < (ring[j][0]-ring[i][0])*(lat-ring[i][1])/(ring[j][1]-ring[i][1])+ring[i][0] {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
 
 func ComputeBoundaryArea(geometry *Geometry) (float64, error) {
 	if geometry.Type != "Polygon" {
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestComputeMgrsSquaresFromGeometry(t *testing.T) {
+	testCases := []struct {
+		name     string
+		geometry Geometry
+		squares  []string
+	}{
+		{
+			name: "small polygon",
+			geometry: Geometry{Type: "Polygon", Coordinates: [][][]float64{
+				{{49.5, 9.5}, {49.55, 9.5}, {49.55, 9.55}, {49.5, 9.55}, {49.5, 9.5}},
+			}},
+			squares: []string{"39PUL"},
+		},
+		{
+			name: "polygon with a hole",
+			geometry: Geometry{Type: "Polygon", Coordinates: [][][]float64{
+				{{-93.3, 44.9}, {-93.1, 44.9}, {-93.1, 45.0}, {-93.3, 45.0}, {-93.3, 44.9}},
+				{{-93.25, 44.92}, {-93.15, 44.92}, {-93.15, 44.98}, {-93.25, 44.98}, {-93.25, 44.92}},
+			}},
+			squares: []string{"15TVK"},
+		},
+		{
+			name: "large polygon",
+			geometry: Geometry{Type: "Polygon", Coordinates: [][][]float64{
+				{{-94, 44}, {-92, 44}, {-92, 46}, {-94, 46}, {-94, 44}},
+			}},
+			squares: []string{"15TVJ", "15TVK", "15TVL", "15TWJ", "15TWK", "15TWL"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		squares, err := ComputeMgrsSquaresFromGeometry(&testCase.geometry)
+		if err != nil {
+			t.Fatalf("%s: %s", testCase.name, err)
+		}
+		if !reflect.DeepEqual(squares, testCase.squares) {
+			t.Errorf("%s: expected squares %v but found %v", testCase.name, testCase.squares, squares)
+		}
+	}
+
+	if _, err := ComputeMgrsSquaresFromGeometry(&Geometry{Type: "Point"}); err == nil {
+		t.Error("expected an error for a point geometry")
+	}
+}
+
+func TestBoundaryMgrsSquares(t *testing.T) {
+	CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boundaries := []Boundary{
+		{Name: "field 1", MgrsCodes: []string{"15TUL"}},
+		{Name: "field 2", MgrsCodes: []string{"15TUL"}},
+		{Name: "field 3", MgrsCodes: []string{"04QFJ"}},
+	}
+	for i := range boundaries {
+		if err := SaveBoundary(ctx, dbClient, &boundaries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	squares, err := FindBoundaryMgrsSquares(ctx, dbClient)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(squares, []string{"15TUL", "4QFJ"}) {
+		t.Fatalf("expected squares 15TUL and 4QFJ but found %v", squares)
+	}
+
+	// a square stays until its last boundary is deleted
+	for _, boundary := range boundaries[1:] {
+		if err := DeleteBoundary(ctx, dbClient, bson.D{{"_id", boundary.ID}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	squares, err = FindBoundaryMgrsSquares(ctx, dbClient)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(squares, []string{"15TUL"}) {
+		t.Fatalf("expected square 15TUL but found %v", squares)
+	}
+
+	// the rebuild recounts boundaries saved without the squares
+	if _, err := BoundaryMgrsSquareCollection(dbClient).DeleteMany(ctx, bson.D{}); err != nil {
+		t.Fatal(err)
+	}
+	squares, err = RebuildBoundaryMgrsSquares(ctx, dbClient)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(squares, []string{"15TUL"}) {
+		t.Fatalf("expected the rebuild to find square 15TUL but found %v", squares)
+	}
+}
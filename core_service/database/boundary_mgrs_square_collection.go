@@ -0,0 +1,152 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BoundaryMgrsSquare is an mgrs 100km square with at least one user
+// boundary in it. The id is the square written the way the satellite
+// data object paths write it, like 15TUL or 4QFJ.
+type BoundaryMgrsSquare struct {
+	Square      string             `bson:"_id" json:"square"`
+	Boundaries  int                `bson:"boundaries" json:"boundaries"`
+	UpdatedDate primitive.DateTime `bson:"updated_date" json:"updatedDate"`
+}
+
+func BoundaryMgrsSquareCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("boundary_mgrs_square")
+}
+
+// boundaryMgrsSquare drops the leading zero the mgrs converter puts on
+// zones below 10.
+func boundaryMgrsSquare(mgrsCode string) string {
+	return strings.TrimPrefix(mgrsCode, "0")
+}
+
+func incrementBoundaryMgrsSquares(ctx context.Context, client *mongo.Client, mgrsCodes []string, increment int) error {
+	if len(mgrsCodes) == 0 {
+		return nil
+	}
+	coll := BoundaryMgrsSquareCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	squares := make([]string, 0, len(mgrsCodes))
+	models := make([]mongo.WriteModel, 0, len(mgrsCodes))
+	for _, mgrsCode := range mgrsCodes {
+		square := boundaryMgrsSquare(mgrsCode)
+		squares = append(squares, square)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{"_id", square}}).
+			SetUpdate(bson.D{
+				{"$inc", bson.D{{"boundaries", increment}}},
+				{"$set", bson.D{{"updated_date", now}}},
+			}).
+			SetUpsert(increment > 0))
+	}
+	if _, err := coll.BulkWrite(mongoCtx, models); err != nil {
+		return err
+	}
+	if increment > 0 {
+		return nil
+	}
+
+	_, err := coll.DeleteMany(mongoCtx, bson.D{
+		{"_id", bson.D{{"$in", squares}}},
+		{"boundaries", bson.D{{"$lte", 0}}},
+	})
+	return err
+}
+
+// AddBoundaryMgrsSquares counts a new boundary in each of its squares.
+func AddBoundaryMgrsSquares(ctx context.Context, client *mongo.Client, mgrsCodes []string) error {
+	return incrementBoundaryMgrsSquares(ctx, client, mgrsCodes, 1)
+}
+
+// RemoveBoundaryMgrsSquares uncounts a deleted boundary from each of its
+// squares and removes the squares left without boundaries.
+func RemoveBoundaryMgrsSquares(ctx context.Context, client *mongo.Client, mgrsCodes []string) error {
+	return incrementBoundaryMgrsSquares(ctx, client, mgrsCodes, -1)
+}
+
+// FindBoundaryMgrsSquares returns the sorted squares with boundaries.
+func FindBoundaryMgrsSquares(ctx context.Context, client *mongo.Client) ([]string, error) {
+	coll := BoundaryMgrsSquareCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	opts := options.Find().SetSort(bson.D{{"_id", 1}})
+	cursor, err := coll.Find(mongoCtx, bson.D{{"boundaries", bson.D{{"$gt", 0}}}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var boundaryMgrsSquares []BoundaryMgrsSquare
+	if err := cursor.All(mongoCtx, &boundaryMgrsSquares); err != nil {
+		return nil, err
+	}
+
+	squares := make([]string, 0, len(boundaryMgrsSquares))
+	for _, boundaryMgrsSquare := range boundaryMgrsSquares {
+		squares = append(squares, boundaryMgrsSquare.Square)
+	}
+	return squares, nil
+}
+
+// RebuildBoundaryMgrsSquares recounts the squares from the boundary
+// collection, picking up boundaries saved before the squares were tracked
+// and fixing counts left behind by failed updates. It returns the sorted
+// squares with boundaries.
+func RebuildBoundaryMgrsSquares(ctx context.Context, client *mongo.Client) ([]string, error) {
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	pipeline := mongo.Pipeline{
+		{{"$unwind", "$mgrs_codes"}},
+		{{"$group", bson.D{{"_id", "$mgrs_codes"}, {"boundaries", bson.D{{"$sum", 1}}}}}},
+	}
+	cursor, err := BoundaryCollection(client).Aggregate(mongoCtx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var mgrsCodeCounts []BoundaryMgrsSquare
+	if err := cursor.All(mongoCtx, &mgrsCodeCounts); err != nil {
+		return nil, err
+	}
+
+	boundaryCounts := make(map[string]int)
+	for _, mgrsCodeCount := range mgrsCodeCounts {
+		boundaryCounts[boundaryMgrsSquare(mgrsCodeCount.Square)] += mgrsCodeCount.Boundaries
+	}
+
+	coll := BoundaryMgrsSquareCollection(client)
+	now := primitive.NewDateTimeFromTime(time.Now())
+	squares := make([]string, 0, len(boundaryCounts))
+	models := make([]mongo.WriteModel, 0, len(boundaryCounts))
+	for square, boundaries := range boundaryCounts {
+		squares = append(squares, square)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{"_id", square}}).
+			SetUpdate(bson.D{{"$set", bson.D{{"boundaries", boundaries}, {"updated_date", now}}}}).
+			SetUpsert(true))
+	}
+	if len(models) > 0 {
+		if _, err := coll.BulkWrite(mongoCtx, models); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := coll.DeleteMany(mongoCtx, bson.D{{"_id", bson.D{{"$nin", squares}}}}); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(squares)
+	return squares, nil
+}
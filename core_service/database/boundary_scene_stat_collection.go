@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BoundarySceneStat is how much of a boundary a tile's scene
+// classification layer marks as cloud and as valid pixels. The stats are
+// computed once per boundary and layer object, boundaries never change
+// their geometry, so the scene selection of later map builds reuses them.
+type BoundarySceneStat struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	BoundaryId primitive.ObjectID `bson:"boundary_id" json:"boundaryId"`
+	TileId     primitive.ObjectID `bson:"tile_id" json:"tileId"`
+	// the scl object the stats were computed from
+	ObjectPath   string             `bson:"object_path" json:"objectPath"`
+	CloudPercent float64            `bson:"cloud_percent" json:"cloudPercent"`
+	ValidPercent float64            `bson:"valid_percent" json:"validPercent"`
+	CreatedDate  primitive.DateTime `bson:"created_date" json:"createdDate"`
+}
+
+func BoundarySceneStatCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("boundary_scene_stat")
+}
+
+func CreateBoundarySceneStatIndexes(ctx context.Context, client *mongo.Client) error {
+	coll := BoundarySceneStatCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	statIndex := mongo.IndexModel{
+		Keys:    bson.D{{"boundary_id", 1}, {"object_path", 1}},
+		Options: options.Index().SetName("boundary_id_object_path").SetUnique(true),
+	}
+	tileIndex := mongo.IndexModel{
+		Keys:    bson.D{{"tile_id", 1}},
+		Options: options.Index().SetName("tile_id"),
+	}
+	_, err := coll.Indexes().CreateMany(mongoCtx, []mongo.IndexModel{statIndex, tileIndex})
+	return err
+}
+
+// SaveBoundarySceneStats upserts the stats by boundary and scl object.
+func SaveBoundarySceneStats(ctx context.Context, client *mongo.Client, stats []BoundarySceneStat) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	coll := BoundarySceneStatCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	models := make([]mongo.WriteModel, 0, len(stats))
+	for _, stat := range stats {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{"boundary_id", stat.BoundaryId}, {"object_path", stat.ObjectPath}}).
+			SetUpdate(bson.D{
+				{"$set", bson.D{
+					{"tile_id", stat.TileId},
+					{"cloud_percent", stat.CloudPercent},
+					{"valid_percent", stat.ValidPercent},
+					{"created_date", now},
+				}},
+				{"$setOnInsert", bson.D{{"_id", primitive.NewObjectID()}}},
+			}).
+			SetUpsert(true))
+	}
+	_, err := coll.BulkWrite(mongoCtx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// FindBoundarySceneStats returns the stats of the boundaries in the tiles.
+func FindBoundarySceneStats(ctx context.Context, client *mongo.Client, boundaryIds, tileIds []primitive.ObjectID) ([]BoundarySceneStat, error) {
+	coll := BoundarySceneStatCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	filter := bson.D{
+		{"boundary_id", bson.D{{"$in", boundaryIds}}},
+		{"tile_id", bson.D{{"$in", tileIds}}},
+	}
+	cursor, err := coll.Find(mongoCtx, filter)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]BoundarySceneStat, 0)
+	if err := cursor.All(mongoCtx, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func DeleteBoundarySceneStats(ctx context.Context, client *mongo.Client, boundaryId primitive.ObjectID) error {
+	coll := BoundarySceneStatCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	_, err := coll.DeleteMany(mongoCtx, bson.D{{"boundary_id", boundaryId}})
+	return err
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// the number of documents sent to the database in a single bulk write
+// when the caller doesn't choose a batch size
+const DEFAULT_BULK_WRITE_BATCH_SIZE = 500
+
+// duplicate key error code returned by mongod
+const DUPLICATE_KEY_CODE = 11000
+
+var ERROR_BULK_WRITE_FAILED = errors.New("Some documents of the bulk write failed")
+
+// BulkWriteReport is the outcome of a bulk write split into batches. A
+// failed batch doesn't stop the batches after it, the documents which
+// failed are listed by their index in the written slice.
+type BulkWriteReport struct {
+	Written    int                `json:"written"`
+	Duplicates int                `json:"duplicates"`
+	Failures   []BulkWriteFailure `json:"failures"`
+}
+
+type BulkWriteFailure struct {
+	Index   int    `json:"index"`
+	Message string `json:"message"`
+}
+
+// Err is nil unless some documents failed, in which case it wraps
+// ERROR_BULK_WRITE_FAILED.
+func (obj *BulkWriteReport) Err() error {
+	if len(obj.Failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %d failed, first at index %d: %s", ERROR_BULK_WRITE_FAILED, len(obj.Failures), obj.Failures[0].Index, obj.Failures[0].Message)
+}
+
+// FailedIndexes returns the indexes of the documents which failed.
+func (obj *BulkWriteReport) FailedIndexes() map[int]bool {
+	failedIndexes := make(map[int]bool)
+	for _, failure := range obj.Failures {
+		failedIndexes[failure.Index] = true
+	}
+	return failedIndexes
+}
+
+// addBatch records the outcome of writing the documents from start up
+// to end and returns the indexes of the documents which weren't
+// written. Duplicate key errors are counted as duplicates when they are
+// expected, any other error fails the whole batch unless the database
+// reported which documents failed.
+func (obj *BulkWriteReport) addBatch(start, end int, err error, duplicatesExpected bool) []int {
+	if err == nil {
+		obj.Written += end - start
+		return nil
+	}
+
+	unwritten := make([]int, 0)
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		for i := start; i < end; i++ {
+			obj.Failures = append(obj.Failures, BulkWriteFailure{Index: i, Message: err.Error()})
+			unwritten = append(unwritten, i)
+		}
+		return unwritten
+	}
+
+	for _, writeErr := range bulkErr.WriteErrors {
+		if duplicatesExpected && writeErr.Code == DUPLICATE_KEY_CODE {
+			obj.Duplicates += 1
+		} else {
+			obj.Failures = append(obj.Failures, BulkWriteFailure{Index: start + writeErr.Index, Message: writeErr.Message})
+		}
+		unwritten = append(unwritten, start+writeErr.Index)
+	}
+	obj.Written += end - start - len(bulkErr.WriteErrors)
+	return unwritten
+}
+
+func bulkWriteBatchSize(batchSize int) int {
+	if batchSize < 1 {
+		return DEFAULT_BULK_WRITE_BATCH_SIZE
+	}
+	return batchSize
+}
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestBulkWriteReportAddBatch(t *testing.T) {
+	report := BulkWriteReport{}
+
+	if unwritten := report.addBatch(0, 3, nil, true); len(unwritten) != 0 {
+		t.Fatalf("expected every document to be written but found %v", unwritten)
+	}
+
+	bulkErr := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: 0, Code: DUPLICATE_KEY_CODE, Message: "duplicate key"}},
+		{WriteError: mongo.WriteError{Index: 2, Code: 121, Message: "document failed validation"}},
+	}}
+	if unwritten := report.addBatch(3, 6, bulkErr, true); !reflect.DeepEqual(unwritten, []int{3, 5}) {
+		t.Fatalf("expected documents 3 and 5 to be unwritten but found %v", unwritten)
+	}
+
+	// without the documents which failed the whole batch is lost
+	if unwritten := report.addBatch(6, 8, errors.New("connection reset"), true); !reflect.DeepEqual(unwritten, []int{6, 7}) {
+		t.Fatalf("expected documents 6 and 7 to be unwritten but found %v", unwritten)
+	}
+
+	if report.Written != 4 || report.Duplicates != 1 {
+		t.Fatalf("expected 4 written and 1 duplicate but found %d and %d", report.Written, report.Duplicates)
+	}
+	if failedIndexes := report.FailedIndexes(); !reflect.DeepEqual(failedIndexes, map[int]bool{5: true, 6: true, 7: true}) {
+		t.Fatalf("unexpected failed documents %v", failedIndexes)
+	}
+	if err := report.Err(); !errors.Is(err, ERROR_BULK_WRITE_FAILED) {
+		t.Fatalf("expected a bulk write error but found %v", err)
+	}
+}
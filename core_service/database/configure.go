@@ -43,6 +43,12 @@ func Configure(ctx context.Context) error {
 	}
 	databaseClient = newClient
 
+	log.Println("- creating database indexes")
+	if err := CreateIndexes(ctx, newClient); err != nil {
+		log.Println("failed to create database indexes")
+		return err
+	}
+
 	log.Println("- configuring the s3/object store client")
 	newObjectStoreClient, err := ConfigureObjectStoreSession(ctx)
 	if err != nil {
@@ -55,3 +61,36 @@ func Configure(ctx context.Context) error {
 
 	return nil
 }
+
+// Shutdown disconnects the database client set up by Configure.
+func Shutdown(ctx context.Context) error {
+	if databaseClient == nil {
+		return ERROR_DATABASE_NOT_CONFIGURED
+	}
+	log.Println("- disconnecting the database client")
+	err := DisconnectSafe(ctx, databaseClient)
+	databaseClient = nil
+	return err
+}
+
+func CreateIndexes(ctx context.Context, client *mongo.Client) error {
+	if err := CreateEventIndexes(ctx, client); err != nil {
+		return err
+	}
+	if err := CreateDeadEventIndexes(ctx, client); err != nil {
+		return err
+	}
+	if err := CreateJobIndexes(ctx, client); err != nil {
+		return err
+	}
+	if err := CreateWorkflowIndexes(ctx, client); err != nil {
+		return err
+	}
+	if err := CreateSettingIndexes(ctx, client); err != nil {
+		return err
+	}
+	if err := CreateBoundarySceneStatIndexes(ctx, client); err != nil {
+		return err
+	}
+	return nil
+}
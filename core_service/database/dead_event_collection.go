@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DeadEvent is an event which used up all of its attempts. It is moved
+// out of the event collection so the queue only holds work that can
+// still run, and can be inspected, requeued or discarded from here.
+type DeadEvent struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	DeadDate primitive.DateTime `bson:"dead_date" json:"deadDate"`
+	Reason   string             `bson:"reason" json:"reason"`
+	Event    Event              `bson:"event" json:"event"`
+}
+
+func DeadEventCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("dead_event")
+}
+
+func CreateDeadEventIndexes(ctx context.Context, client *mongo.Client) error {
+	coll := DeadEventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	workflowIndex := mongo.IndexModel{
+		Keys:    bson.D{{"event.workflow_id", 1}},
+		Options: options.Index().SetName("event_workflow_id"),
+	}
+	_, err := coll.Indexes().CreateMany(mongoCtx, []mongo.IndexModel{workflowIndex})
+	return err
+}
+
+// DeadLetterEvent moves the event into the dead event collection. The
+// dead event keeps the id of the event so running this twice for the
+// same event only stores it once.
+func DeadLetterEvent(ctx context.Context, client *mongo.Client, event *Event, reason string) error {
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	deadEvent := DeadEvent{
+		ID:       event.ID,
+		DeadDate: primitive.NewDateTimeFromTime(time.Now()),
+		Reason:   reason,
+		Event:    *event,
+	}
+	_, err := DeadEventCollection(client).InsertOne(mongoCtx, deadEvent)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	_, err = EventCollection(client).DeleteOne(mongoCtx, bson.D{{"_id", event.ID}})
+	return err
+}
+
+// DeadLetterFailedEvents moves every failed event still in the event
+// collection into the dead event collection.
+func DeadLetterFailedEvents(ctx context.Context, client *mongo.Client) (int64, error) {
+	events, err := FindEvents(ctx, client, bson.D{{"failed", true}}, options.Find())
+	if err != nil {
+		return 0, err
+	}
+
+	var movedCount int64
+	for _, event := range *events {
+		reason := event.LastError()
+		if reason == "" {
+			reason = "failed"
+		}
+		if err := DeadLetterEvent(ctx, client, &event, reason); err != nil {
+			return movedCount, err
+		}
+		movedCount += 1
+	}
+	return movedCount, nil
+}
+
+func FindDeadEvents(ctx context.Context, client *mongo.Client, filter bson.D, opts *options.FindOptions) (*[]DeadEvent, error) {
+	coll := DeadEventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	deadEvents := make([]DeadEvent, 0, 100)
+	cursor, err := coll.Find(mongoCtx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(mongoCtx, &deadEvents); err != nil {
+		return nil, err
+	}
+
+	return &deadEvents, nil
+}
+
+func FindDeadEvent(ctx context.Context, client *mongo.Client, filter bson.D) (*DeadEvent, error) {
+	coll := DeadEventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	var deadEvent DeadEvent
+	err := coll.FindOne(mongoCtx, filter).Decode(&deadEvent)
+	if err != nil {
+		return nil, err
+	}
+	return &deadEvent, nil
+}
+
+func CountDeadEvents(ctx context.Context, client *mongo.Client, filter bson.D) (int64, error) {
+	coll := DeadEventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	return coll.CountDocuments(mongoCtx, filter)
+}
+
+// RequeueDeadEvent puts a dead event back into the event collection
+// with its attempts reset so it runs again as soon as possible. The
+// error history is kept.
+func RequeueDeadEvent(ctx context.Context, client *mongo.Client, deadEventId primitive.ObjectID) (*Event, error) {
+	deadEvent, err := FindDeadEvent(ctx, client, bson.D{{"_id", deadEventId}})
+	if err != nil {
+		return nil, err
+	}
+
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	event := deadEvent.Event
+	event.UpdatedDate = primitive.NewDateTimeFromTime(time.Now())
+	event.StartAfterDate = primitive.NewDateTimeFromTime(time.Now())
+	event.Started = false
+	event.Passed = false
+	event.Failed = false
+	event.Cancelled = false
+	event.Attempts = 0
+	event.LeaseOwner = ""
+	event.LeaseExpiresDate = 0
+	// a newer pending event may hold the key by now
+	event.DedupKey = ""
+	if _, err := EventCollection(client).InsertOne(mongoCtx, event); err != nil {
+		return nil, err
+	}
+
+	if _, err := DeadEventCollection(client).DeleteOne(mongoCtx, bson.D{{"_id", deadEventId}}); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func DiscardDeadEvent(ctx context.Context, client *mongo.Client, deadEventId primitive.ObjectID) error {
+	coll := DeadEventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	result, err := coll.DeleteOne(mongoCtx, bson.D{{"_id", deadEventId}})
+	if err != nil {
+		return err
+	} else if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
@@ -1,30 +1,255 @@
 package database
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"sort"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var (
+	ERROR_EVENT_LEASE_LOST    = errors.New("Event lease is no longer held by this worker")
+	ERROR_DUPLICATE_EVENT     = errors.New("A pending event with the same dedup key already exists")
+	ERROR_EVENT_CANCELLED     = errors.New("Event was cancelled")
+	ERROR_EMPTY_EVENT_QUERY   = errors.New("Event query needs an event id, event type, mgrs code, workflow id or state")
+	ERROR_UNKNOWN_EVENT_STATE = errors.New("Unknown event state")
+	ERROR_EVENT_RUNNING       = errors.New("Event is running")
+
+	ERROR_CHANGE_STREAMS_UNSUPPORTED = errors.New("Change streams are only supported on replica sets")
+)
+
+// returned by mongod when a change stream is opened on a standalone server
+const CHANGE_STREAM_UNSUPPORTED_CODE = 40573
+
+// the number of best events FindNextEvent tries to claim before giving
+// up to other workers
+const EVENT_CLAIM_CANDIDATES = 5
+
+// events of the same priority age in the order they were published, so
+// FindNextEvent only scores the longest waiting ones of each priority
+const EVENT_CLAIM_PRIORITY_CANDIDATES = 50
+
+const (
+	DEFAULT_EVENT_LEASE_DURATION = 2 * time.Minute
+
+	// a waiting event gains one priority for every aging interval it has
+	// been runnable, up to the max aging
+	EVENT_PRIORITY_AGING_INTERVAL = 10 * time.Minute
+	EVENT_PRIORITY_MAX_AGING      = 5
+	// priority taken off a user's event for each of their events already
+	// running
+	EVENT_USER_RUNNING_PENALTY = 1
+
+	// classes of the EventError records, errors from tasks which don't
+	// fall into one of these are classed by their Go type
+	EVENT_ERROR_CLASS_LEGACY        = "legacy"
+	EVENT_ERROR_CLASS_LEASE_EXPIRED = "leaseExpired"
+	EVENT_ERROR_CLASS_CANCELLED     = "cancelled"
+	EVENT_ERROR_CLASS_UNKNOWN_TASK  = "unknownTask"
+	EVENT_ERROR_CLASS_TIMEOUT       = "timeout"
+	EVENT_ERROR_CLASS_PERMANENT     = "permanent"
+	EVENT_ERROR_CLASS_SHUTDOWN      = "shutdown"
+
+	EVENT_STATE_PENDING   = "pending"
+	EVENT_STATE_RUNNING   = "running"
+	EVENT_STATE_PASSED    = "passed"
+	EVENT_STATE_FAILED    = "failed"
+	EVENT_STATE_CANCELLED = "cancelled"
+)
+
+var EventStates = []string{
+	EVENT_STATE_PENDING,
+	EVENT_STATE_RUNNING,
+	EVENT_STATE_PASSED,
+	EVENT_STATE_FAILED,
+	EVENT_STATE_CANCELLED,
+}
 
 type Event struct {
-	ID             primitive.ObjectID `bson:"_id"`
-	UpdatedDate    primitive.DateTime `bson:"updated_date"`
-	EventType      string             `bson:"event_type"`
-	StartAfterDate primitive.DateTime `bson:"start_after_date"`
-	StartedDate    primitive.DateTime `bson:"started_date"`
-	Started        bool               `bson:"started"`
-	Attempts       int                `bson:"attempts"`
-	MaxAttemps     int                `bson:"max_attempts"`
-	Priority       int                `bson:"priority"`
-	Data           map[string]string  `bson:"data"`
-	Errors         []string           `bson:"errors"`
-	Passed         bool               `bson:"passed"`
-	Failed         bool               `bson:"failed"`
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
+	UpdatedDate    primitive.DateTime `bson:"updated_date" json:"updatedDate"`
+	EventType      string             `bson:"event_type" json:"eventType"`
+	StartAfterDate primitive.DateTime `bson:"start_after_date" json:"startAfterDate"`
+	StartedDate    primitive.DateTime `bson:"started_date" json:"startedDate"`
+	Started        bool               `bson:"started" json:"started"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	MaxAttemps     int                `bson:"max_attempts" json:"maxAttempts"`
+	Priority       int                `bson:"priority" json:"priority"`
+	Data           map[string]string  `bson:"data" json:"data"`
+	Errors         []EventError       `bson:"errors" json:"errors"`
+	Passed         bool               `bson:"passed" json:"passed"`
+	Failed         bool               `bson:"failed" json:"failed"`
+	// the worker currently running the event and when its claim runs
+	// out unless the worker renews it
+	LeaseOwner       string             `bson:"lease_owner" json:"leaseOwner"`
+	LeaseExpiresDate primitive.DateTime `bson:"lease_expires_date" json:"leaseExpiresDate"`
+	// optional, only one event that hasn't been attempted yet can hold
+	// a given key at a time
+	DedupKey string `bson:"dedup_key,omitempty" json:"dedupKey,omitempty"`
+	// the workflow run the event is part of and the event which
+	// published it, both optional
+	WorkflowId primitive.ObjectID `bson:"workflow_id,omitempty" json:"workflowId"`
+	ParentId   primitive.ObjectID `bson:"parent_id,omitempty" json:"parentId"`
+	// only set by CancelEvents, a cancelled event is never picked up
+	// again and a running one is stopped by its worker
+	Cancelled     bool               `bson:"cancelled" json:"cancelled"`
+	CancelledDate primitive.DateTime `bson:"cancelled_date" json:"cancelledDate"`
+	// what the task reported about its latest run
+	Result *EventResult `bson:"result,omitempty" json:"result,omitempty"`
+	// the user whose request published the event, events of users with
+	// many running events wait behind those of other users
+	UserId primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
+	// the worker which last claimed the event, kept after its lease ends
+	WorkerId string `bson:"worker_id,omitempty" json:"workerId,omitempty"`
+}
+
+// EventError records why an attempt of an event failed.
+type EventError struct {
+	Date    primitive.DateTime `bson:"date" json:"date"`
+	Attempt int                `bson:"attempt" json:"attempt"`
+	Class   string             `bson:"class" json:"class"`
+	Message string             `bson:"message" json:"message"`
+}
+
+// UnmarshalBSONValue also reads the plain error strings stored on older
+// events.
+func (obj *EventError) UnmarshalBSONValue(valueType bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: valueType, Value: data}
+	if message, ok := value.StringValueOK(); ok {
+		*obj = EventError{Class: EVENT_ERROR_CLASS_LEGACY, Message: message}
+		return nil
+	}
+
+	type eventErrorRecord EventError
+	var record eventErrorRecord
+	if err := value.Unmarshal(&record); err != nil {
+		return err
+	}
+	*obj = EventError(record)
+	return nil
+}
+
+// EventResult is what a task reports about a run, the counts are named
+// by each task.
+type EventResult struct {
+	Attempt         int                  `bson:"attempt" json:"attempt"`
+	Counts          map[string]int64     `bson:"counts" json:"counts"`
+	RasterIds       []primitive.ObjectID `bson:"raster_ids" json:"rasterIds"`
+	BytesDownloaded int64                `bson:"bytes_downloaded" json:"bytesDownloaded"`
+	// version of the settings an index run used
+	SettingVersion int `bson:"setting_version,omitempty" json:"settingVersion,omitempty"`
+}
+
+func NewEventResult() *EventResult {
+	return &EventResult{Counts: make(map[string]int64), RasterIds: make([]primitive.ObjectID, 0)}
+}
+
+func (obj *EventResult) AddCount(name string, count int64) {
+	obj.Counts[name] += count
+}
+
+// LastError is the message of the most recent error or an empty string.
+func (obj *Event) LastError() string {
+	if len(obj.Errors) == 0 {
+		return ""
+	}
+	return obj.Errors[len(obj.Errors)-1].Message
+}
+
+// EventQuery selects events by id, type, the mgrs code in their data,
+// workflow or state. Empty fields are ignored.
+type EventQuery struct {
+	EventId    string `json:"eventId"`
+	EventType  string `json:"eventType"`
+	MgrsCode   string `json:"mgrsCode"`
+	WorkflowId string `json:"workflowId"`
+	State      string `json:"state"`
+}
+
+func (obj *EventQuery) Filter() (bson.D, error) {
+	filter, err := obj.fieldFilter("")
+	if err != nil {
+		return nil, err
+	}
+	if obj.State != "" {
+		stateFilter, err := EventStateFilter(obj.State)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, stateFilter...)
+	}
+	if len(filter) == 0 {
+		return nil, ERROR_EMPTY_EVENT_QUERY
+	}
+	return filter, nil
+}
+
+// DeadFilter selects the dead events whose event matches the query. The
+// state is ignored since every dead event failed, and an empty query
+// matches all of them.
+func (obj *EventQuery) DeadFilter() (bson.D, error) {
+	return obj.fieldFilter("event.")
+}
+
+// fieldFilter matches every field of the query but the state, the prefix
+// is the path of the event in the documents.
+func (obj *EventQuery) fieldFilter(prefix string) (bson.D, error) {
+	filter := bson.D{}
+	if obj.EventId != "" {
+		eventId, err := primitive.ObjectIDFromHex(obj.EventId)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.E{prefix + "_id", eventId})
+	}
+	if obj.EventType != "" {
+		filter = append(filter, bson.E{prefix + "event_type", obj.EventType})
+	}
+	if obj.MgrsCode != "" {
+		filter = append(filter, bson.E{prefix + "data.mgrsCode", obj.MgrsCode})
+	}
+	if obj.WorkflowId != "" {
+		workflowId, err := primitive.ObjectIDFromHex(obj.WorkflowId)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.E{prefix + "workflow_id", workflowId})
+	}
+	return filter, nil
+}
+
+// EventStateFilter matches the events in one of the EventStates. Failed
+// events only stay in the event collection until they are dead lettered.
+func EventStateFilter(state string) (bson.D, error) {
+	notCancelled := bson.E{"cancelled", bson.D{{"$ne", true}}}
+	switch state {
+	case EVENT_STATE_PENDING:
+		return bson.D{{"started", false}, {"passed", false}, {"failed", false}, notCancelled}, nil
+	case EVENT_STATE_RUNNING:
+		return bson.D{{"started", true}, {"passed", false}, {"failed", false}, notCancelled}, nil
+	case EVENT_STATE_PASSED:
+		return bson.D{{"passed", true}}, nil
+	case EVENT_STATE_FAILED:
+		return bson.D{{"failed", true}}, nil
+	case EVENT_STATE_CANCELLED:
+		return bson.D{{"passed", false}, {"cancelled", true}}, nil
+	}
+	return nil, ERROR_UNKNOWN_EVENT_STATE
+}
+
+// NewChildEvent returns the child as part of the parent's workflow run.
+func NewChildEvent(parent *Event, child Event) Event {
+	child.WorkflowId = parent.WorkflowId
+	child.ParentId = parent.ID
+	return child
 }
 
 func (obj *Event) ToBson(includeId bool) bson.D {
@@ -41,6 +266,26 @@ func (obj *Event) ToBson(includeId bool) bson.D {
 		{"errors", obj.Errors},
 		{"passed", obj.Passed},
 		{"failed", obj.Failed},
+		{"lease_owner", obj.LeaseOwner},
+		{"lease_expires_date", obj.LeaseExpiresDate},
+	}
+	if obj.Result != nil {
+		doc = append(doc, bson.E{"result", obj.Result})
+	}
+	if obj.DedupKey != "" {
+		doc = append(doc, bson.E{"dedup_key", obj.DedupKey})
+	}
+	if !obj.WorkflowId.IsZero() {
+		doc = append(doc, bson.E{"workflow_id", obj.WorkflowId})
+	}
+	if !obj.ParentId.IsZero() {
+		doc = append(doc, bson.E{"parent_id", obj.ParentId})
+	}
+	if !obj.UserId.IsZero() {
+		doc = append(doc, bson.E{"user_id", obj.UserId})
+	}
+	if obj.WorkerId != "" {
+		doc = append(doc, bson.E{"worker_id", obj.WorkerId})
 	}
 	if includeId {
 		doc = append(doc, bson.E{"_id", obj.ID})
@@ -57,6 +302,56 @@ func EventCollection(client *mongo.Client) *mongo.Collection {
 	return client.Database(DatabaseName()).Collection("event")
 }
 
+// the part of the queue a dedup key is unique within, events which are
+// running or being retried are outside of it
+func pendingDedupKeyFilter(dedupKey interface{}) bson.D {
+	return bson.D{
+		{"dedup_key", dedupKey},
+		{"started", false},
+		{"attempts", 0},
+		{"passed", false},
+		{"failed", false},
+	}
+}
+
+// BuildBoundaryMapDedupKey is the dedup key of a build event for every
+// boundary in the mgrs tile, or for a single boundary when its id is
+// given.
+func BuildBoundaryMapDedupKey(mgrsCode, boundaryId string) string {
+	if boundaryId == "" {
+		return fmt.Sprintf("BuildBoundaryMapTask/%s", mgrsCode)
+	}
+	return fmt.Sprintf("BuildBoundaryMapTask/%s/%s", mgrsCode, boundaryId)
+}
+
+func CreateEventIndexes(ctx context.Context, client *mongo.Client) error {
+	coll := EventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	dedupKeyIndex := mongo.IndexModel{
+		Keys: bson.D{{"dedup_key", 1}},
+		Options: options.Index().
+			SetName("pending_dedup_key").
+			SetUnique(true).
+			SetPartialFilterExpression(pendingDedupKeyFilter(bson.D{{"$exists", true}})),
+	}
+	// serves the pages of runnable events read on every claim and the
+	// count of the running events of each user
+	claimIndex := mongo.IndexModel{
+		Keys:    bson.D{{"started", 1}, {"passed", 1}, {"failed", 1}, {"priority", -1}, {"_id", 1}},
+		Options: options.Index().SetName("claim_order"),
+	}
+	workflowIndex := mongo.IndexModel{
+		Keys: bson.D{{"workflow_id", 1}, {"passed", 1}, {"failed", 1}, {"started", 1}},
+		Options: options.Index().
+			SetName("workflow_state").
+			SetPartialFilterExpression(bson.D{{"workflow_id", bson.D{{"$exists", true}}}}),
+	}
+	_, err := coll.Indexes().CreateMany(mongoCtx, []mongo.IndexModel{dedupKeyIndex, claimIndex, workflowIndex})
+	return err
+}
+
 func SaveEvent(ctx context.Context, client *mongo.Client, event *Event) error {
 	nullId := primitive.NilObjectID
 	coll := EventCollection(client)
@@ -68,6 +363,10 @@ func SaveEvent(ctx context.Context, client *mongo.Client, event *Event) error {
 		event.ID = primitive.NewObjectID()
 		event.UpdatedDate = primitive.NewDateTimeFromTime(time.Now())
 		_, err := coll.InsertOne(mongoCtx, event)
+		if mongo.IsDuplicateKeyError(err) {
+			event.ID = nullId
+			return ERROR_DUPLICATE_EVENT
+		}
 		return err
 	} else {
 		event.UpdatedDate = primitive.NewDateTimeFromTime(time.Now())
@@ -77,6 +376,97 @@ func SaveEvent(ctx context.Context, client *mongo.Client, event *Event) error {
 	}
 }
 
+// BulkSaveEvents inserts the new events, batchSize events per
+// round-trip. Events refused because a pending event holds the same
+// dedup key are counted as duplicates. The events which weren't saved
+// are left without an id. The error is the report's Err.
+func BulkSaveEvents(ctx context.Context, client *mongo.Client, events []Event, batchSize int) (BulkWriteReport, error) {
+	coll := EventCollection(client)
+	batchSize = bulkWriteBatchSize(batchSize)
+
+	report := BulkWriteReport{}
+	now := primitive.NewDateTimeFromTime(time.Now())
+	opts := options.InsertMany().SetOrdered(false)
+	for start := 0; start < len(events); start += batchSize {
+		end := start + batchSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		documents := make([]interface{}, 0, end-start)
+		for i := start; i < end; i++ {
+			events[i].ID = primitive.NewObjectID()
+			events[i].UpdatedDate = now
+			documents = append(documents, events[i])
+		}
+
+		mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+		_, err := coll.InsertMany(mongoCtx, documents, opts)
+		mongoCancel()
+
+		for _, i := range report.addBatch(start, end, err, true) {
+			events[i].ID = primitive.NilObjectID
+		}
+	}
+	return report, report.Err()
+}
+
+// MergeEvent saves a new event unless a pending event with the same
+// dedup key exists, in which case the data of the new event is merged
+// into the pending one and the higher of the two priorities is kept.
+// The event is updated to the stored version either way.
+func MergeEvent(ctx context.Context, client *mongo.Client, event *Event) error {
+	if event.DedupKey == "" {
+		return errors.New("event must have a dedup key to be merged")
+	}
+
+	coll := EventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	setOnInsert := bson.D{
+		{"event_type", event.EventType},
+		{"start_after_date", event.StartAfterDate},
+		{"started_date", event.StartedDate},
+		{"max_attempts", event.MaxAttemps},
+		{"errors", event.Errors},
+		{"lease_owner", ""},
+		{"lease_expires_date", primitive.DateTime(0)},
+	}
+	if !event.WorkflowId.IsZero() {
+		setOnInsert = append(setOnInsert, bson.E{"workflow_id", event.WorkflowId})
+	}
+	if !event.ParentId.IsZero() {
+		setOnInsert = append(setOnInsert, bson.E{"parent_id", event.ParentId})
+	}
+	if !event.UserId.IsZero() {
+		setOnInsert = append(setOnInsert, bson.E{"user_id", event.UserId})
+	}
+	set := bson.D{{"updated_date", primitive.NewDateTimeFromTime(time.Now())}}
+	if len(event.Data) == 0 {
+		setOnInsert = append(setOnInsert, bson.E{"data", bson.D{}})
+	}
+	for key, value := range event.Data {
+		set = append(set, bson.E{"data." + key, value})
+	}
+	update := bson.D{
+		{"$setOnInsert", setOnInsert},
+		{"$set", set},
+		{"$max", bson.D{{"priority", event.Priority}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var err error
+	// two upserts racing for the same key can both try to insert, the
+	// loser sees a duplicate key error and merges on the second try
+	for i := 0; i < 2; i++ {
+		err = coll.FindOneAndUpdate(mongoCtx, pendingDedupKeyFilter(event.DedupKey), update, opts).Decode(event)
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+	}
+	return err
+}
 
 func CountEvents(ctx context.Context, client *mongo.Client, filter bson.D) (int64, error) {
 	coll := EventCollection(client)
@@ -98,43 +488,466 @@ func FindEvents(ctx context.Context, client *mongo.Client, filter bson.D, opts *
 
 	events := make([]Event, 0, 100)
 	cursor, err := coll.Find(mongoCtx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
 	if err = cursor.All(mongoCtx, &events); err != nil {
 		return nil, err
 	}
 
-	return &events, err
+	return &events, nil
+}
+
+// NextEventOptions narrows which events FindNextEvent is allowed to claim.
+type NextEventOptions struct {
+	// event types the caller can not run right now, for example because
+	// the worker is already running as many of them as allowed
+	ExcludedEventTypes []string
+	// the worker claiming the event and how long the claim lasts before
+	// it must be renewed with RenewEventLease
+	LeaseOwner    string
+	LeaseDuration time.Duration
+}
+
+// EventSchedulingPriority is the priority an event is claimed by. It
+// adds the aging of a runnable event to its priority and takes off the
+// penalty for the running events of its user. Events with the same
+// scheduling priority are claimed oldest first.
+func EventSchedulingPriority(event *Event, now time.Time, runningUserEvents map[primitive.ObjectID]int) int {
+	waitingSince := event.ID.Timestamp()
+	if startAfterDate := event.StartAfterDate.Time(); startAfterDate.After(waitingSince) {
+		waitingSince = startAfterDate
+	}
+	aging := 0
+	if now.After(waitingSince) {
+		aging = int(now.Sub(waitingSince) / EVENT_PRIORITY_AGING_INTERVAL)
+	}
+	if aging > EVENT_PRIORITY_MAX_AGING {
+		aging = EVENT_PRIORITY_MAX_AGING
+	}
+
+	penalty := 0
+	if !event.UserId.IsZero() {
+		penalty = runningUserEvents[event.UserId] * EVENT_USER_RUNNING_PENALTY
+	}
+	return event.Priority + aging - penalty
+}
+
+// FindRunningUserEvents counts the running events of each user.
+func FindRunningUserEvents(ctx context.Context, client *mongo.Client) (map[primitive.ObjectID]int, error) {
+	coll := EventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	runningFilter, err := EventStateFilter(EVENT_STATE_RUNNING)
+	if err != nil {
+		return nil, err
+	}
+	match := append(runningFilter, bson.E{"user_id", bson.D{{"$exists", true}}})
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", match}},
+		bson.D{{"$group", bson.D{{"_id", "$user_id"}, {"running", bson.D{{"$sum", 1}}}}}},
+	}
+	cursor, err := coll.Aggregate(mongoCtx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []struct {
+		UserId  primitive.ObjectID `bson:"_id"`
+		Running int                `bson:"running"`
+	}
+	if err := cursor.All(mongoCtx, &counts); err != nil {
+		return nil, err
+	}
+	runningUserEvents := make(map[primitive.ObjectID]int)
+	for _, count := range counts {
+		runningUserEvents[count.UserId] = count.Running
+	}
+	return runningUserEvents, nil
 }
 
-func FindNextEvent(ctx context.Context, client *mongo.Client) (*Event, error) {
+// FindNextEvent claims the runnable event with the highest
+// EventSchedulingPriority. The best events are picked with
+// findClaimCandidates and then claimed, if another worker claims one
+// first the next best event is tried.
+func FindNextEvent(ctx context.Context, client *mongo.Client, nextEventOpts *NextEventOptions) (*Event, error) {
 	coll := EventCollection(client)
 	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
 	defer mongoCancel()
-	
-	opts := options.FindOneAndUpdate().SetUpsert(false).SetSort(bson.D{{"priority", -1}})
+
+	now := time.Now()
 	filter := bson.D{
 		{"started", false},
 		{"passed", false},
 		{"failed", false},
+		{"cancelled", bson.D{{"$ne", true}}},
 		{"$expr", bson.D{
-			{"$lt", bson.A{"$attempts", "$max_attempts"}},
-		}},
-		{"$expr", bson.D{
-			{"$gt", bson.A{primitive.NewDateTimeFromTime(time.Now()), "$start_after_date"}},
+			{"$and", bson.A{
+				// events without max attempts use the retry policy of their task
+				bson.D{{"$or", bson.A{
+					bson.D{{"$lte", bson.A{"$max_attempts", 0}}},
+					bson.D{{"$lt", bson.A{"$attempts", "$max_attempts"}}},
+				}}},
+				bson.D{{"$gt", bson.A{primitive.NewDateTimeFromTime(now), "$start_after_date"}}},
+			}},
 		}},
 	}
+	leaseOwner := ""
+	leaseDuration := DEFAULT_EVENT_LEASE_DURATION
+	if nextEventOpts != nil {
+		if len(nextEventOpts.ExcludedEventTypes) > 0 {
+			filter = append(filter, bson.E{"event_type", bson.D{{"$nin", nextEventOpts.ExcludedEventTypes}}})
+		}
+		if nextEventOpts.LeaseDuration != 0 {
+			leaseDuration = nextEventOpts.LeaseDuration
+		}
+		leaseOwner = nextEventOpts.LeaseOwner
+	}
+
+	candidates, err := findClaimCandidates(mongoCtx, client, filter, now)
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.D{
+		{"updated_date", primitive.NewDateTimeFromTime(now)},
+		{"started_date", primitive.NewDateTimeFromTime(now)},
+		{"started", true},
+		{"lease_owner", leaseOwner},
+		{"lease_expires_date", primitive.NewDateTimeFromTime(now.Add(leaseDuration))},
+	}
+	if leaseOwner != "" {
+		set = append(set, bson.E{"worker_id", leaseOwner})
+	}
+	update := bson.D{{"$set", set}}
+	opts := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After)
+	for _, candidate := range candidates {
+		var updatedEvent Event
+		candidateFilter := append(bson.D{{"_id", candidate.ID}}, filter...)
+		err := coll.FindOneAndUpdate(mongoCtx, candidateFilter, update, opts).Decode(&updatedEvent)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		return &updatedEvent, err
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+// findClaimCandidates returns the EVENT_CLAIM_CANDIDATES runnable events
+// with the highest EventSchedulingPriority. The events are read a page
+// at a time by priority, oldest first, and only the oldest ones of each
+// priority are scored. Reading stops once a lower priority can't age
+// past the candidates, so a long queue isn't scanned on every claim.
+func findClaimCandidates(ctx context.Context, client *mongo.Client, filter bson.D, now time.Time) ([]Event, error) {
+	coll := EventCollection(client)
+	opts := options.Find().
+		SetSort(bson.D{{"priority", -1}, {"_id", 1}}).
+		SetLimit(EVENT_CLAIM_PRIORITY_CANDIDATES).
+		SetProjection(bson.D{{"priority", 1}, {"start_after_date", 1}, {"user_id", 1}})
+
+	// the running events are only counted once a candidate has a user
+	var runningUserEvents map[primitive.ObjectID]int
+	candidates := make([]Event, 0, EVENT_CLAIM_CANDIDATES+EVENT_CLAIM_PRIORITY_CANDIDATES)
+	priorityCandidates := make(map[int]int)
+	pageFilter := filter
+	for {
+		var page []Event
+		cursor, err := coll.Find(ctx, pageFilter, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := cursor.All(ctx, &page); err != nil {
+			return nil, err
+		}
+		for _, event := range page {
+			if runningUserEvents == nil && !event.UserId.IsZero() {
+				if runningUserEvents, err = FindRunningUserEvents(ctx, client); err != nil {
+					return nil, err
+				}
+			}
+			priorityCandidates[event.Priority] += 1
+		}
+
+		candidates = append(candidates, page...)
+		sort.SliceStable(candidates, func(i, j int) bool {
+			iPriority := EventSchedulingPriority(&candidates[i], now, runningUserEvents)
+			jPriority := EventSchedulingPriority(&candidates[j], now, runningUserEvents)
+			if iPriority != jPriority {
+				return iPriority > jPriority
+			}
+			return bytes.Compare(candidates[i].ID[:], candidates[j].ID[:]) < 0
+		})
+		if len(candidates) > EVENT_CLAIM_CANDIDATES {
+			candidates = candidates[:EVENT_CLAIM_CANDIDATES]
+		}
+		if len(page) < EVENT_CLAIM_PRIORITY_CANDIDATES {
+			return candidates, nil
+		}
+
+		// the events left can't be aged past the last candidate
+		lastEvent := page[len(page)-1]
+		lastCandidatePriority := EventSchedulingPriority(&candidates[len(candidates)-1], now, runningUserEvents)
+		if len(candidates) == EVENT_CLAIM_CANDIDATES && lastEvent.Priority+EVENT_PRIORITY_MAX_AGING < lastCandidatePriority {
+			return candidates, nil
+		}
+
+		// skip the newer events of a priority with enough candidates
+		nextPage := bson.E{"priority", bson.D{{"$lt", lastEvent.Priority}}}
+		if priorityCandidates[lastEvent.Priority] < EVENT_CLAIM_PRIORITY_CANDIDATES {
+			nextPage = bson.E{"$or", bson.A{
+				bson.D{{"priority", lastEvent.Priority}, {"_id", bson.D{{"$gt", lastEvent.ID}}}},
+				bson.D{{"priority", bson.D{{"$lt", lastEvent.Priority}}}},
+			}}
+		}
+		pageFilter = append(filter[:len(filter):len(filter)], nextPage)
+	}
+}
+
+// RenewEventLease pushes back the lease expiration of a running event.
+// Once the event has been cancelled ERROR_EVENT_CANCELLED is returned.
+// If the lease was already taken away from the worker, for example by
+// ReleaseExpiredEventLeases, ERROR_EVENT_LEASE_LOST is returned and the
+// worker should stop working on the event.
+func RenewEventLease(ctx context.Context, client *mongo.Client, event *Event, leaseDuration time.Duration) error {
+	coll := EventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	leaseExpiresDate := primitive.NewDateTimeFromTime(time.Now().Add(leaseDuration))
+	filter := bson.D{
+		{"_id", event.ID},
+		{"started", true},
+		{"lease_owner", event.LeaseOwner},
+	}
 	update := bson.D{{"$set", bson.D{
 		{"updated_date", primitive.NewDateTimeFromTime(time.Now())},
-		{"started_date", primitive.NewDateTimeFromTime(time.Now())},
+		{"lease_expires_date", leaseExpiresDate},
+	}}}
+	opts := options.FindOneAndUpdate().SetProjection(bson.D{{"cancelled", 1}})
+
+	var leasedEvent Event
+	err := coll.FindOneAndUpdate(mongoCtx, filter, update, opts).Decode(&leasedEvent)
+	if err == mongo.ErrNoDocuments {
+		return ERROR_EVENT_LEASE_LOST
+	} else if err != nil {
+		return err
+	}
+
+	event.LeaseExpiresDate = leaseExpiresDate
+	if leasedEvent.Cancelled {
+		return ERROR_EVENT_CANCELLED
+	}
+	return nil
+}
+
+// SaveLeasedEvent saves an event only if the lease is still held by
+// leaseOwner so a worker whose lease expired can't overwrite the work
+// of the worker that picked the event up afterwards.
+func SaveLeasedEvent(ctx context.Context, client *mongo.Client, event *Event, leaseOwner string) error {
+	coll := EventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	event.UpdatedDate = primitive.NewDateTimeFromTime(time.Now())
+	filter := bson.D{
+		{"_id", event.ID},
+		{"lease_owner", leaseOwner},
+	}
+	result, err := coll.UpdateOne(mongoCtx, filter, bson.D{{"$set", event.ToBson(false)}})
+	if err != nil {
+		return err
+	} else if result.MatchedCount == 0 {
+		return ERROR_EVENT_LEASE_LOST
+	}
+	return nil
+}
+
+// ReleaseExpiredEventLeases returns events whose worker stopped renewing
+// the lease back to the queue. The lost run counts as an attempt so an
+// event which keeps killing its worker eventually fails. Events without
+// max attempts use the max attempts of their type, the same limit the
+// worker retries them with, and fail on their first lost lease when
+// their type has none. Cancelled events are only marked as stopped.
+func ReleaseExpiredEventLeases(ctx context.Context, client *mongo.Client, maxAttemptsByType map[string]int) (int64, error) {
+	coll := EventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	filter := bson.D{
 		{"started", true},
+		{"passed", false},
+		{"failed", false},
+		{"lease_expires_date", bson.D{{"$lt", now}}},
+	}
+	nextAttempt := bson.D{{"$add", bson.A{"$attempts", 1}}}
+	var typeMaxAttempts interface{} = 1
+	if len(maxAttemptsByType) > 0 {
+		branches := make(bson.A, 0, len(maxAttemptsByType))
+		for eventType, maxAttempts := range maxAttemptsByType {
+			branches = append(branches, bson.D{
+				{"case", bson.D{{"$eq", bson.A{"$event_type", eventType}}}},
+				{"then", maxAttempts},
+			})
+		}
+		typeMaxAttempts = bson.D{{"$switch", bson.D{{"branches", branches}, {"default", 1}}}}
+	}
+	maxAttempts := bson.D{{"$cond", bson.A{
+		bson.D{{"$gt", bson.A{"$max_attempts", 0}}}, "$max_attempts", typeMaxAttempts,
 	}}}
-	var updatedEvent Event
-	err := coll.FindOneAndUpdate(
-		mongoCtx,
+	update := bson.A{
+		bson.D{{"$set", bson.D{
+			{"updated_date", now},
+			{"started", false},
+			{"lease_owner", ""},
+			{"attempts", nextAttempt},
+			{"failed", bson.D{{"$and", bson.A{
+				bson.D{{"$ne", bson.A{"$cancelled", true}}},
+				bson.D{{"$gte", bson.A{nextAttempt, maxAttempts}}},
+			}}}},
+			{"errors", bson.D{{"$concatArrays", bson.A{
+				bson.D{{"$ifNull", bson.A{"$errors", bson.A{}}}},
+				bson.A{bson.D{
+					{"date", now},
+					{"attempt", nextAttempt},
+					{"class", EVENT_ERROR_CLASS_LEASE_EXPIRED},
+					{"message", "lease expired"},
+				}},
+			}}}},
+		}}},
+	}
+	result, err := coll.UpdateMany(mongoCtx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// CancelEvents cancels every event matching the filter which hasn't
+// finished yet and returns the number of cancelled events. The dedup key
+// is dropped so the same work can be queued again later.
+func CancelEvents(ctx context.Context, client *mongo.Client, filter bson.D) (int64, error) {
+	coll := EventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	cancellableFilter := bson.D{{"$and", bson.A{
 		filter,
-		update,
-		opts,
-	).Decode(&updatedEvent)
+		bson.D{
+			{"passed", false},
+			{"failed", false},
+			{"cancelled", bson.D{{"$ne", true}}},
+		},
+	}}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"updated_date", now},
+			{"cancelled", true},
+			{"cancelled_date", now},
+		}},
+		{"$unset", bson.D{{"dedup_key", ""}}},
+	}
+	result, err := coll.UpdateMany(mongoCtx, cancellableFilter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
 
-	return &updatedEvent, err
+// RequeueEvent resets a finished or cancelled event so it runs again
+// with a fresh set of attempts. Running events can't be requeued, this
+// includes cancelled events whose worker hasn't stopped yet.
+func RequeueEvent(ctx context.Context, client *mongo.Client, eventId primitive.ObjectID) (*Event, error) {
+	coll := EventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	filter := bson.D{
+		{"_id", eventId},
+		{"$or", bson.A{
+			bson.D{{"passed", true}},
+			bson.D{{"failed", true}},
+			bson.D{{"cancelled", true}, {"started", false}},
+			bson.D{{"started", false}},
+		}},
+	}
+	update := bson.D{
+		{"$set", bson.D{
+			{"updated_date", now},
+			{"start_after_date", now},
+			{"started", false},
+			{"passed", false},
+			{"failed", false},
+			{"cancelled", false},
+			{"attempts", 0},
+			{"lease_owner", ""},
+			{"lease_expires_date", primitive.DateTime(0)},
+		}},
+		// a newer pending event may hold the key by now
+		{"$unset", bson.D{{"dedup_key", ""}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var event Event
+	err := coll.FindOneAndUpdate(mongoCtx, filter, update, opts).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		if count, countErr := CountEvents(ctx, client, bson.D{{"_id", eventId}}); countErr == nil && count > 0 {
+			return nil, ERROR_EVENT_RUNNING
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	return &event, nil
 }
 
+// FindEventTypes returns every event type in the event collection.
+func FindEventTypes(ctx context.Context, client *mongo.Client) ([]string, error) {
+	coll := EventCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	values, err := coll.Distinct(mongoCtx, "event_type", bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	eventTypes := make([]string, 0, len(values))
+	for _, value := range values {
+		if eventType, ok := value.(string); ok {
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+	return eventTypes, nil
+}
+
+// WatchEventInserts calls notify for every event inserted into the
+// event collection until the context is done or the change stream
+// fails. Change streams need a replica set, on a standalone mongod
+// ERROR_CHANGE_STREAMS_UNSUPPORTED is returned straight away.
+func WatchEventInserts(ctx context.Context, client *mongo.Client, notify func()) error {
+	coll := EventCollection(client)
+
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", bson.D{{"operationType", "insert"}}}},
+		bson.D{{"$project", bson.D{{"_id", 1}}}},
+	}
+	stream, err := coll.Watch(ctx, pipeline)
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.HasErrorCode(CHANGE_STREAM_UNSUPPORTED_CODE) {
+		return ERROR_CHANGE_STREAMS_UNSUPPORTED
+	} else if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		notify()
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return stream.Err()
+}
@@ -0,0 +1,481 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestSaveEventWithDedupKey(t *testing.T) {
+	CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event1 := Event{
+		EventType:  "BuildBoundaryMapTask",
+		MaxAttemps: 1,
+		DedupKey:   BuildBoundaryMapDedupKey("14TNR", ""),
+		Data:       map[string]string{"mgrsCode": "14TNR"},
+	}
+	if err := SaveEvent(ctx, dbClient, &event1); err != nil {
+		t.Fatal(err)
+	}
+
+	event2 := event1
+	event2.ID = primitive.NilObjectID
+	if err := SaveEvent(ctx, dbClient, &event2); err != ERROR_DUPLICATE_EVENT {
+		t.Fatalf("expected a duplicate event error but found %v", err)
+	}
+
+	// once the first event is claimed the key is free again
+	if _, err := FindNextEvent(ctx, dbClient, &NextEventOptions{LeaseOwner: "worker"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveEvent(ctx, dbClient, &event2); err != nil {
+		t.Fatal(err)
+	}
+
+	if eventCount, err := CountEvents(ctx, dbClient, bson.D{}); err != nil {
+		t.Fatal(err)
+	} else if eventCount != 2 {
+		t.Fatalf("expected 2 events but found %d", eventCount)
+	}
+}
+
+func TestMergeEvent(t *testing.T) {
+	CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event1 := Event{
+		EventType:  "BuildBoundaryMapTask",
+		MaxAttemps: 1,
+		Priority:   4,
+		DedupKey:   "merge-key",
+		Data:       map[string]string{"mgrsCode": "14TNR"},
+	}
+	if err := MergeEvent(ctx, dbClient, &event1); err != nil {
+		t.Fatal(err)
+	}
+
+	event2 := Event{
+		EventType:  "BuildBoundaryMapTask",
+		MaxAttemps: 1,
+		Priority:   6,
+		DedupKey:   "merge-key",
+		Data:       map[string]string{"boundaryId": "abc"},
+	}
+	if err := MergeEvent(ctx, dbClient, &event2); err != nil {
+		t.Fatal(err)
+	}
+
+	if event1.ID != event2.ID {
+		t.Fatal("the second event should have been merged into the first")
+	} else if event2.Priority != 6 || event2.Data["mgrsCode"] != "14TNR" || event2.Data["boundaryId"] != "abc" {
+		t.Fatal(event2)
+	}
+
+	if eventCount, err := CountEvents(ctx, dbClient, bson.D{}); err != nil {
+		t.Fatal(err)
+	} else if eventCount != 1 {
+		t.Fatalf("expected 1 event but found %d", eventCount)
+	}
+}
+
+func TestEventQueryFilter(t *testing.T) {
+	eventId := primitive.NewObjectID()
+
+	query := EventQuery{EventId: eventId.Hex(), EventType: "BuildBoundaryMapTask", MgrsCode: "15TUL"}
+	filter, err := query.Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFilter := bson.D{
+		{"_id", eventId},
+		{"event_type", "BuildBoundaryMapTask"},
+		{"data.mgrsCode", "15TUL"},
+	}
+	if len(filter) != len(expectedFilter) {
+		t.Fatal(filter)
+	}
+	for i := range expectedFilter {
+		if filter[i] != expectedFilter[i] {
+			t.Fatalf("expected %v but found %v", expectedFilter[i], filter[i])
+		}
+	}
+
+	query = EventQuery{}
+	if _, err := query.Filter(); err != ERROR_EMPTY_EVENT_QUERY {
+		t.Fatalf("expected an empty query error but found %v", err)
+	}
+
+	query = EventQuery{EventType: "RequestMapTask", State: EVENT_STATE_CANCELLED}
+	if filter, err := query.Filter(); err != nil {
+		t.Fatal(err)
+	} else if len(filter) != 3 || filter[2].Key != "cancelled" {
+		t.Fatal(filter)
+	}
+
+	query = EventQuery{State: "sleeping"}
+	if _, err := query.Filter(); err != ERROR_UNKNOWN_EVENT_STATE {
+		t.Fatalf("expected an unknown state error but found %v", err)
+	}
+
+	query = EventQuery{EventId: "not-an-id"}
+	if _, err := query.Filter(); err == nil {
+		t.Fatal("expected an invalid event id error")
+	}
+
+	workflowId := primitive.NewObjectID()
+	query = EventQuery{WorkflowId: workflowId.Hex(), State: EVENT_STATE_PASSED}
+	if filter, err := query.Filter(); err != nil {
+		t.Fatal(err)
+	} else if len(filter) != 2 || filter[0] != (bson.E{"workflow_id", workflowId}) {
+		t.Fatal(filter)
+	}
+
+	// dead events are matched by their event and regardless of the state
+	if filter, err := query.DeadFilter(); err != nil {
+		t.Fatal(err)
+	} else if len(filter) != 1 || filter[0] != (bson.E{"event.workflow_id", workflowId}) {
+		t.Fatal(filter)
+	}
+	query = EventQuery{}
+	if filter, err := query.DeadFilter(); err != nil || len(filter) != 0 {
+		t.Fatalf("expected an empty dead event filter but found %v, %v", filter, err)
+	}
+
+	query = EventQuery{WorkflowId: "not-an-id"}
+	if _, err := query.Filter(); err == nil {
+		t.Fatal("expected an invalid workflow id error")
+	}
+}
+
+func TestCancelEvents(t *testing.T) {
+	CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event1 := Event{
+		EventType: "BuildBoundaryMapTask",
+		DedupKey:  BuildBoundaryMapDedupKey("15TUL", ""),
+		Data:      map[string]string{"mgrsCode": "15TUL"},
+	}
+	event2 := Event{
+		EventType: "BuildBoundaryMapTask",
+		DedupKey:  BuildBoundaryMapDedupKey("15TUK", ""),
+		Data:      map[string]string{"mgrsCode": "15TUK"},
+	}
+	for _, event := range []*Event{&event1, &event2} {
+		if err := SaveEvent(ctx, dbClient, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancelledCount, err := CancelEvents(ctx, dbClient, bson.D{{"data.mgrsCode", "15TUL"}})
+	if err != nil {
+		t.Fatal(err)
+	} else if cancelledCount != 1 {
+		t.Fatalf("expected 1 cancelled event but found %d", cancelledCount)
+	}
+
+	// cancelling again doesn't count the event twice
+	if cancelledCount, err := CancelEvents(ctx, dbClient, bson.D{{"data.mgrsCode", "15TUL"}}); err != nil {
+		t.Fatal(err)
+	} else if cancelledCount != 0 {
+		t.Fatalf("expected 0 cancelled events but found %d", cancelledCount)
+	}
+
+	// only the other event can be claimed
+	nextEvent, err := FindNextEvent(ctx, dbClient, &NextEventOptions{LeaseOwner: "worker1"})
+	if err != nil {
+		t.Fatal(err)
+	} else if nextEvent.ID != event2.ID {
+		t.Fatal(nextEvent)
+	}
+	if _, err := FindNextEvent(ctx, dbClient, &NextEventOptions{LeaseOwner: "worker1"}); err == nil {
+		t.Fatal("claimed a cancelled event")
+	}
+
+	// the running event learns about the cancellation on its next renewal
+	if _, err := CancelEvents(ctx, dbClient, bson.D{{"_id", event2.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RenewEventLease(ctx, dbClient, nextEvent, DEFAULT_EVENT_LEASE_DURATION); err != ERROR_EVENT_CANCELLED {
+		t.Fatalf("expected a cancelled error but found %v", err)
+	}
+
+	// the dedup key was released so the work can be queued again
+	event3 := Event{
+		EventType: "BuildBoundaryMapTask",
+		DedupKey:  BuildBoundaryMapDedupKey("15TUL", ""),
+		Data:      map[string]string{"mgrsCode": "15TUL"},
+	}
+	if err := SaveEvent(ctx, dbClient, &event3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequeueEvent(t *testing.T) {
+	CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event1 := Event{EventType: "BuildBoundaryMapTask", MaxAttemps: 1, Data: map[string]string{"mgrsCode": "15TUL"}}
+	if err := SaveEvent(ctx, dbClient, &event1); err != nil {
+		t.Fatal(err)
+	}
+
+	// running events can't be requeued
+	runningEvent, err := FindNextEvent(ctx, dbClient, &NextEventOptions{LeaseOwner: "worker1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RequeueEvent(ctx, dbClient, runningEvent.ID); err != ERROR_EVENT_RUNNING {
+		t.Fatalf("expected a running event error but found %v", err)
+	}
+
+	// nor can cancelled ones until their worker stopped
+	if _, err := CancelEvents(ctx, dbClient, bson.D{{"_id", runningEvent.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RequeueEvent(ctx, dbClient, runningEvent.ID); err != ERROR_EVENT_RUNNING {
+		t.Fatalf("expected a running event error for the cancelled event but found %v", err)
+	}
+
+	// a passed event is saved the way the worker completes it, still started
+	runningEvent.Attempts = 1
+	runningEvent.Passed = true
+	runningEvent.LeaseOwner = ""
+	runningEvent.LeaseExpiresDate = 0
+	if err := SaveLeasedEvent(ctx, dbClient, runningEvent, "worker1"); err != nil {
+		t.Fatal(err)
+	}
+
+	requeuedEvent, err := RequeueEvent(ctx, dbClient, event1.ID)
+	if err != nil {
+		t.Fatal(err)
+	} else if requeuedEvent.Passed || requeuedEvent.Attempts != 0 || requeuedEvent.Started {
+		t.Fatal(requeuedEvent)
+	}
+
+	if count, err := CountEvents(ctx, dbClient, bson.D{{"_id", event1.ID}, {"passed", false}, {"started", false}}); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Fatal("event was not requeued")
+	}
+
+	if _, err := RequeueEvent(ctx, dbClient, primitive.NewObjectID()); err != mongo.ErrNoDocuments {
+		t.Fatalf("expected no documents but found %v", err)
+	}
+}
+
+func TestEventErrorsDecodeLegacyStrings(t *testing.T) {
+	errorDate := primitive.NewDateTimeFromTime(time.Now())
+	data, err := bson.Marshal(bson.D{
+		{"event_type", "FailableTask"},
+		{"errors", bson.A{
+			"failed task!",
+			bson.D{{"date", errorDate}, {"attempt", 2}, {"class", EVENT_ERROR_CLASS_TIMEOUT}, {"message", "context deadline exceeded"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var event Event
+	if err := bson.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedErrors := []EventError{
+		{Class: EVENT_ERROR_CLASS_LEGACY, Message: "failed task!"},
+		{Date: errorDate, Attempt: 2, Class: EVENT_ERROR_CLASS_TIMEOUT, Message: "context deadline exceeded"},
+	}
+	if len(event.Errors) != len(expectedErrors) {
+		t.Fatal(event.Errors)
+	}
+	for i := range expectedErrors {
+		if event.Errors[i] != expectedErrors[i] {
+			t.Fatalf("expected %v but found %v", expectedErrors[i], event.Errors[i])
+		}
+	}
+	if event.LastError() != "context deadline exceeded" {
+		t.Fatal(event.LastError())
+	}
+}
+
+func TestEventSchedulingPriority(t *testing.T) {
+	now := time.Now()
+	user1 := primitive.NewObjectID()
+	user2 := primitive.NewObjectID()
+	runningUserEvents := map[primitive.ObjectID]int{user1: 3}
+
+	testCases := []struct {
+		name     string
+		event    Event
+		priority int
+	}{
+		{
+			name:     "new event",
+			event:    Event{ID: primitive.NewObjectIDFromTimestamp(now), Priority: 4},
+			priority: 4,
+		},
+		{
+			name:     "aged event",
+			event:    Event{ID: primitive.NewObjectIDFromTimestamp(now.Add(-25 * time.Minute)), Priority: 4},
+			priority: 6,
+		},
+		{
+			name:     "aging is capped",
+			event:    Event{ID: primitive.NewObjectIDFromTimestamp(now.Add(-48 * time.Hour)), Priority: 1},
+			priority: 1 + EVENT_PRIORITY_MAX_AGING,
+		},
+		{
+			name: "aging starts once the event is runnable",
+			event: Event{
+				ID:             primitive.NewObjectIDFromTimestamp(now.Add(-time.Hour)),
+				StartAfterDate: primitive.NewDateTimeFromTime(now.Add(-10 * time.Minute)),
+				Priority:       4,
+			},
+			priority: 5,
+		},
+		{
+			name:     "user with running events",
+			event:    Event{ID: primitive.NewObjectIDFromTimestamp(now), Priority: 5, UserId: user1},
+			priority: 2,
+		},
+		{
+			name:     "user without running events",
+			event:    Event{ID: primitive.NewObjectIDFromTimestamp(now), Priority: 5, UserId: user2},
+			priority: 5,
+		},
+	}
+	for _, testCase := range testCases {
+		if priority := EventSchedulingPriority(&testCase.event, now, runningUserEvents); priority != testCase.priority {
+			t.Fatalf("%s: expected priority %d but found %d", testCase.name, testCase.priority, priority)
+		}
+	}
+}
+
+func TestFindNextEventSchedulingOrder(t *testing.T) {
+	CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busyUser := primitive.NewObjectID()
+	otherUser := primitive.NewObjectID()
+	events := []Event{
+		// waited long enough to overtake the newer higher priority events
+		{ID: primitive.NewObjectIDFromTimestamp(time.Now().Add(-time.Hour)), EventType: "CleanupRastersTask", Priority: 1},
+		{ID: primitive.NewObjectIDFromTimestamp(time.Now().Add(-time.Minute)), EventType: "BuildBoundaryMapTask", Priority: 5, UserId: busyUser},
+		{ID: primitive.NewObjectIDFromTimestamp(time.Now()), EventType: "BuildBoundaryMapTask", Priority: 5, UserId: busyUser},
+		{ID: primitive.NewObjectIDFromTimestamp(time.Now()), EventType: "BuildBoundaryMapTask", Priority: 5, UserId: otherUser},
+	}
+	for i := range events {
+		if _, err := EventCollection(dbClient).InsertOne(ctx, events[i].ToBson(true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectedOrder := []primitive.ObjectID{events[0].ID, events[1].ID, events[3].ID, events[2].ID}
+	for _, expectedId := range expectedOrder {
+		nextEvent, err := FindNextEvent(ctx, dbClient, &NextEventOptions{LeaseOwner: "worker"})
+		if err != nil {
+			t.Fatal(err)
+		} else if nextEvent.ID != expectedId {
+			t.Fatalf("expected event %s but claimed %s", expectedId.Hex(), nextEvent.ID.Hex())
+		}
+	}
+	if _, err := FindNextEvent(ctx, dbClient, &NextEventOptions{LeaseOwner: "worker"}); err != mongo.ErrNoDocuments {
+		t.Fatalf("expected no documents but found %v", err)
+	}
+}
+
+func TestFindNextEventAgesPastLongQueue(t *testing.T) {
+	CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more higher priority events than a page of candidates
+	events := make([]interface{}, 0, 2*EVENT_CLAIM_PRIORITY_CANDIDATES+1)
+	for i := 0; i < 2*EVENT_CLAIM_PRIORITY_CANDIDATES; i++ {
+		event := Event{ID: primitive.NewObjectID(), EventType: "RequestMapTask", Priority: 5}
+		events = append(events, event.ToBson(true))
+	}
+	agedEvent := Event{ID: primitive.NewObjectIDFromTimestamp(time.Now().Add(-time.Hour)), EventType: "CleanupRastersTask", Priority: 1}
+	events = append(events, agedEvent.ToBson(true))
+	if _, err := EventCollection(dbClient).InsertMany(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	if nextEvent, err := FindNextEvent(ctx, dbClient, &NextEventOptions{LeaseOwner: "worker"}); err != nil {
+		t.Fatal(err)
+	} else if nextEvent.ID != agedEvent.ID {
+		t.Fatalf("expected the aged event %s but claimed %s", agedEvent.ID.Hex(), nextEvent.ID.Hex())
+	}
+	if nextEvent, err := FindNextEvent(ctx, dbClient, &NextEventOptions{LeaseOwner: "worker"}); err != nil {
+		t.Fatal(err)
+	} else if nextEvent.Priority != 5 {
+		t.Fatalf("expected a priority 5 event but claimed %v", nextEvent)
+	}
+}
+
+func TestBulkSaveEvents(t *testing.T) {
+	CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []Event{
+		{EventType: "RequestMapTask", DedupKey: "RequestMapTask/object1"},
+		{EventType: "RequestMapTask", DedupKey: "RequestMapTask/object2"},
+		{EventType: "RequestMapTask", DedupKey: "RequestMapTask/object1"},
+	}
+	report, err := BulkSaveEvents(ctx, dbClient, events, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if report.Written != 2 || report.Duplicates != 1 {
+		t.Fatalf("expected 2 written and 1 duplicate but found %v", report)
+	}
+	if events[0].ID.IsZero() || events[1].ID.IsZero() || !events[2].ID.IsZero() {
+		t.Fatal("only the saved events should have an id")
+	}
+
+	if eventCount, err := CountEvents(ctx, dbClient, bson.D{}); err != nil {
+		t.Fatal(err)
+	} else if eventCount != 2 {
+		t.Fatalf("expected 2 events but found %d", eventCount)
+	}
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the most object paths sent to the database in a single query
+const INGESTED_OBJECT_BATCH_SIZE = 1000
+
+// IngestedObject is a satellite data object whose tile and events were
+// created by an index run. The id is the object path.
+type IngestedObject struct {
+	ObjectPath   string             `bson:"_id" json:"objectPath"`
+	InventoryKey string             `bson:"inventory_key" json:"inventoryKey"`
+	IngestedDate primitive.DateTime `bson:"ingested_date" json:"ingestedDate"`
+}
+
+func IngestedObjectCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("ingested_object")
+}
+
+// FindNewObjectPaths returns the object paths which have not been
+// ingested yet, in their original order.
+func FindNewObjectPaths(ctx context.Context, client *mongo.Client, objectPaths []string) ([]string, error) {
+	coll := IngestedObjectCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	ingested := make(map[string]bool)
+	opts := options.Find().SetProjection(bson.D{{"_id", 1}})
+	for start := 0; start < len(objectPaths); start += INGESTED_OBJECT_BATCH_SIZE {
+		end := start + INGESTED_OBJECT_BATCH_SIZE
+		if end > len(objectPaths) {
+			end = len(objectPaths)
+		}
+
+		cursor, err := coll.Find(mongoCtx, bson.D{{"_id", bson.D{{"$in", objectPaths[start:end]}}}}, opts)
+		if err != nil {
+			return nil, err
+		}
+		var ingestedObjects []IngestedObject
+		if err := cursor.All(mongoCtx, &ingestedObjects); err != nil {
+			return nil, err
+		}
+		for _, ingestedObject := range ingestedObjects {
+			ingested[ingestedObject.ObjectPath] = true
+		}
+	}
+
+	newObjectPaths := make([]string, 0, len(objectPaths)-len(ingested))
+	for _, objectPath := range objectPaths {
+		if !ingested[objectPath] {
+			newObjectPaths = append(newObjectPaths, objectPath)
+		}
+	}
+	return newObjectPaths, nil
+}
+
+// MarkObjectsIngested records the object paths as ingested from the
+// inventory file. Paths which were already ingested are left alone.
+func MarkObjectsIngested(ctx context.Context, client *mongo.Client, inventoryKey string, objectPaths []string) error {
+	coll := IngestedObjectCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	opts := options.InsertMany().SetOrdered(false)
+	for start := 0; start < len(objectPaths); start += INGESTED_OBJECT_BATCH_SIZE {
+		end := start + INGESTED_OBJECT_BATCH_SIZE
+		if end > len(objectPaths) {
+			end = len(objectPaths)
+		}
+
+		documents := make([]interface{}, 0, end-start)
+		for _, objectPath := range objectPaths[start:end] {
+			documents = append(documents, IngestedObject{ObjectPath: objectPath, InventoryKey: inventoryKey, IngestedDate: now})
+		}
+		if _, err := coll.InsertMany(mongoCtx, documents, opts); err != nil && !onlyDuplicateKeyErrors(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func onlyDuplicateKeyErrors(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != DUPLICATE_KEY_CODE {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InventoryFile is a csv file of the s3 inventory which has been fully
+// ingested by an index run. The id is the key of the file. The file is
+// only ingested for the setting version it was read with, a new setting
+// can select objects the file was filtered down without.
+type InventoryFile struct {
+	Key            string             `bson:"_id" json:"key"`
+	RunKey         string             `bson:"run_key" json:"runKey"`
+	SettingVersion int                `bson:"setting_version" json:"settingVersion"`
+	IngestedDate   primitive.DateTime `bson:"ingested_date" json:"ingestedDate"`
+	// the objects of the file which passed the settings filter and how
+	// many of those had not been ingested before
+	ObjectCount    int64 `bson:"object_count" json:"objectCount"`
+	NewObjectCount int64 `bson:"new_object_count" json:"newObjectCount"`
+	// objects whose event couldn't be saved, a file with failed objects
+	// isn't saved so the next run retries them
+	FailedObjectCount int64 `bson:"failed_object_count" json:"failedObjectCount"`
+}
+
+func InventoryFileCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("inventory_file")
+}
+
+// InventoryFileIngested is true once SaveInventoryFile was called for
+// the key with the setting version.
+func InventoryFileIngested(ctx context.Context, client *mongo.Client, key string, settingVersion int) (bool, error) {
+	coll := InventoryFileCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	count, err := coll.CountDocuments(mongoCtx, bson.D{{"_id", key}, {"setting_version", settingVersion}})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func SaveInventoryFile(ctx context.Context, client *mongo.Client, inventoryFile *InventoryFile) error {
+	coll := InventoryFileCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	inventoryFile.IngestedDate = primitive.NewDateTimeFromTime(time.Now())
+	opts := options.Replace().SetUpsert(true)
+	_, err := coll.ReplaceOne(mongoCtx, bson.D{{"_id", inventoryFile.Key}}, inventoryFile, opts)
+	return err
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Job is a scheduled job run by the worker observer. The schedule is a
+// cron expression and can be changed or disabled in the database, the
+// worker only sets it when the job is first created.
+type Job struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	Name         string             `bson:"name" json:"name"`
+	Schedule     string             `bson:"schedule" json:"schedule"`
+	Enabled      bool               `bson:"enabled" json:"enabled"`
+	UpdatedDate  primitive.DateTime `bson:"updated_date" json:"updatedDate"`
+	LastRunDate  primitive.DateTime `bson:"last_run_date" json:"lastRunDate"`
+	NextRunDate  primitive.DateTime `bson:"next_run_date" json:"nextRunDate"`
+	LastRunOwner string             `bson:"last_run_owner" json:"lastRunOwner"`
+	LastError    string             `bson:"last_error" json:"lastError"`
+}
+
+func JobCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("job")
+}
+
+func CreateJobIndexes(ctx context.Context, client *mongo.Client) error {
+	coll := JobCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	nameIndex := mongo.IndexModel{
+		Keys:    bson.D{{"name", 1}},
+		Options: options.Index().SetName("name").SetUnique(true),
+	}
+	_, err := coll.Indexes().CreateMany(mongoCtx, []mongo.IndexModel{nameIndex})
+	return err
+}
+
+// EnsureJob creates the job if no job by the same name exists. An
+// existing job is left untouched so changes made to it are kept.
+func EnsureJob(ctx context.Context, client *mongo.Client, job *Job) error {
+	coll := JobCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	opts := options.Update().SetUpsert(true)
+	filter := bson.D{{"name", job.Name}}
+	update := bson.D{{"$setOnInsert", bson.D{
+		{"schedule", job.Schedule},
+		{"enabled", job.Enabled},
+		{"updated_date", primitive.NewDateTimeFromTime(time.Now())},
+		{"last_run_date", job.LastRunDate},
+		{"next_run_date", job.NextRunDate},
+		{"last_run_owner", ""},
+		{"last_error", ""},
+	}}}
+	_, err := coll.UpdateOne(mongoCtx, filter, update, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		// another worker created the job at the same time
+		return nil
+	}
+	return err
+}
+
+func FindJobs(ctx context.Context, client *mongo.Client, filter bson.D, opts *options.FindOptions) (*[]Job, error) {
+	coll := JobCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	jobs := make([]Job, 0, 10)
+	cursor, err := coll.Find(mongoCtx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(mongoCtx, &jobs); err != nil {
+		return nil, err
+	}
+
+	return &jobs, nil
+}
+
+// ClaimJobRun moves the job on to its next run. Only one caller can
+// claim a given run, it returns false when the run was already claimed
+// by someone else.
+func ClaimJobRun(ctx context.Context, client *mongo.Client, job *Job, nextRunDate time.Time, owner string) (bool, error) {
+	coll := JobCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	filter := bson.D{
+		{"_id", job.ID},
+		{"next_run_date", job.NextRunDate},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"updated_date", now},
+		{"last_run_date", now},
+		{"next_run_date", primitive.NewDateTimeFromTime(nextRunDate)},
+		{"last_run_owner", owner},
+	}}}
+	result, err := coll.UpdateOne(mongoCtx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	job.LastRunDate = now
+	job.NextRunDate = primitive.NewDateTimeFromTime(nextRunDate)
+	job.LastRunOwner = owner
+	return result.ModifiedCount == 1, nil
+}
+
+func RecordJobError(ctx context.Context, client *mongo.Client, job *Job, errorData string) error {
+	coll := JobCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	job.LastError = errorData
+	update := bson.D{{"$set", bson.D{
+		{"updated_date", primitive.NewDateTimeFromTime(time.Now())},
+		{"last_error", errorData},
+	}}}
+	_, err := coll.UpdateOne(mongoCtx, bson.D{{"_id", job.ID}}, update)
+	return err
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Leader records which worker holds a role, like running the scheduler,
+// and until when. A worker keeps the role by acquiring it again before
+// it expires.
+type Leader struct {
+	Role        string             `bson:"_id" json:"role"`
+	Owner       string             `bson:"owner" json:"owner"`
+	ExpiresDate primitive.DateTime `bson:"expires_date" json:"expiresDate"`
+}
+
+func LeaderCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("leader")
+}
+
+// AcquireLeadership makes owner the leader of the role if nobody holds
+// it or the current leader let it expire. A leader calling this again
+// renews its term. Returns true while owner is the leader.
+func AcquireLeadership(ctx context.Context, client *mongo.Client, role, owner string, duration time.Duration) (bool, error) {
+	coll := LeaderCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	now := time.Now()
+	opts := options.Update().SetUpsert(true)
+	filter := bson.D{
+		{"_id", role},
+		{"$or", bson.A{
+			bson.D{{"owner", owner}},
+			bson.D{{"expires_date", bson.D{{"$lt", primitive.NewDateTimeFromTime(now)}}}},
+		}},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"owner", owner},
+		{"expires_date", primitive.NewDateTimeFromTime(now.Add(duration))},
+	}}}
+	_, err := coll.UpdateOne(mongoCtx, filter, update, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		// the role exists and is held by someone else
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ResignLeadership gives up the role so another worker can take it
+// without waiting for the term to expire.
+func ResignLeadership(ctx context.Context, client *mongo.Client, role, owner string) error {
+	coll := LeaderCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	_, err := coll.DeleteOne(mongoCtx, bson.D{{"_id", role}, {"owner", owner}})
+	return err
+}
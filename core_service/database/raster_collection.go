@@ -184,3 +184,32 @@ func DeleteExistingBoundaryRastersByType(ctx context.Context, dbClient *mongo.Cl
 
 	return nil
 }
+
+
+// FindOrphanedRasterBoundaryIds returns the ids of boundaries which no
+// longer exist but still have rasters stored for them.
+func FindOrphanedRasterBoundaryIds(ctx context.Context, dbClient *mongo.Client) ([]primitive.ObjectID, error) {
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	rasterBoundaryIds, err := RasterCollection(dbClient).Distinct(mongoCtx, "boundary_id", bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	orphanedBoundaryIds := make([]primitive.ObjectID, 0)
+	for _, value := range rasterBoundaryIds {
+		boundaryId, ok := value.(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		boundaryCount, err := BoundaryCollection(dbClient).CountDocuments(mongoCtx, bson.D{{"_id", boundaryId}})
+		if err != nil {
+			return nil, err
+		} else if boundaryCount == 0 {
+			orphanedBoundaryIds = append(orphanedBoundaryIds, boundaryId)
+		}
+	}
+
+	return orphanedBoundaryIds, nil
+}
@@ -2,34 +2,270 @@ package database
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
 	"time"
-	
+
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ERROR_INVALID_SETTING          = errors.New("Invalid setting")
+	ERROR_SETTING_VERSION_CONFLICT = errors.New("Setting was changed by someone else")
+)
+
+// index the mgrs squares of the user boundaries instead of utm zones
+const INDEX_MODE_BOUNDARIES = "boundaries"
+
+// the ways a boundary's map picks its scene from the newest tiles of its
+// mgrs square, an empty policy is newest
+const (
+	SCENE_POLICY_NEWEST           = "newest"
+	SCENE_POLICY_LEAST_CLOUDY     = "leastCloudy"
+	SCENE_POLICY_MAX_VALID_PIXELS = "maxValidPixels"
 )
 
+var SCENE_SELECTION_POLICIES = map[string]bool{
+	SCENE_POLICY_NEWEST: true, SCENE_POLICY_LEAST_CLOUDY: true, SCENE_POLICY_MAX_VALID_PIXELS: true,
+}
+
+// the files of the sentinel 2 l2a cogs which can be indexed
+var KNOWN_TILE_FILES = map[string]bool{
+	"AOT.tif": true, "B01.tif": true, "B02.tif": true, "B03.tif": true, "B04.tif": true,
+	"B05.tif": true, "B06.tif": true, "B07.tif": true, "B08.tif": true, "B8A.tif": true,
+	"B09.tif": true, "B11.tif": true, "B12.tif": true, "SCL.tif": true, "TCI.tif": true,
+	"WVP.tif": true,
+}
+
+// the launch of sentinel 2a, there is no data before it
+var SENTINEL_2_START_DATE = time.Date(2015, time.Month(6), 23, 0, 0, 0, 0, time.UTC)
+
+// a utm zone as the satellite data object paths write it, the zone
+// number without a leading zero followed by the latitude band
+var utmZoneExpression = regexp.MustCompile(`^([1-9]|[1-5][0-9]|60)[C-HJ-NP-X]$`)
 
+// Setting is a version of the index settings. Every change saves a new
+// version and the one with the highest version is current.
 type Setting struct {
-    ID 			   primitive.ObjectID  `bson:"_id" json:"id"`
-	UtmZones   	   []string            `bson:"utm_zones" json:"utmZones"`
-	TileFiles	   []string			   `bson:"tile_files" json:"tileFiles"`
-    TileStartDate  primitive.DateTime  `bson:"tile_start_date" json:"tileStartDate"`
+	ID            primitive.ObjectID `bson:"_id" json:"id"`
+	Version       int                `bson:"version" json:"version"`
+	CreatedDate   primitive.DateTime `bson:"created_date" json:"createdDate"`
+	CreatedBy     string             `bson:"created_by" json:"createdBy"`
+	UtmZones      []string           `bson:"utm_zones" json:"utmZones"`
+	TileFiles     []string           `bson:"tile_files" json:"tileFiles"`
+	TileStartDate primitive.DateTime `bson:"tile_start_date" json:"tileStartDate"`
+	// polygons limiting the indexed tiles to the mgrs squares they touch,
+	// when set the utm zones are ignored
+	AreasOfInterest []Geometry `bson:"areas_of_interest" json:"areasOfInterest"`
+	// set to boundaries to also index every square with a user boundary
+	IndexMode string `bson:"index_mode" json:"indexMode"`
+	// index records parsed and written per batch, zero uses the default
+	IndexBatchSize int `bson:"index_batch_size" json:"indexBatchSize"`
+	// how the boundary map builds pick the scene of each boundary
+	SceneSelection SceneSelection `bson:"scene_selection" json:"sceneSelection"`
 }
 
+// SceneSelection is the policy picking the scene of each boundary's map.
+// When within days is set only the scenes sensed in the last that many
+// days are considered, boundaries without one keep their current map.
+type SceneSelection struct {
+	Policy     string `bson:"policy" json:"policy"`
+	WithinDays int    `bson:"within_days" json:"withinDays"`
+}
+
+func (obj *SceneSelection) Validate() error {
+	if obj.Policy != "" && !SCENE_SELECTION_POLICIES[obj.Policy] {
+		return fmt.Errorf("%w: unknown scene selection policy %s", ERROR_INVALID_SETTING, obj.Policy)
+	}
+	if obj.WithinDays < 0 {
+		return fmt.Errorf("%w: negative scene selection days", ERROR_INVALID_SETTING)
+	}
+	return nil
+}
 
-func SettingCollection(client *mongo.Client) *mongo.Collection{
-	return client.Database(DatabaseName()).Collection("setting");
+func SettingCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("setting")
 }
 
+func CreateSettingIndexes(ctx context.Context, client *mongo.Client) error {
+	coll := SettingCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	// settings inserted by hand before versioning have no version
+	versionIndex := mongo.IndexModel{
+		Keys: bson.D{{"version", 1}},
+		Options: options.Index().SetName("version").SetUnique(true).
+			SetPartialFilterExpression(bson.D{{"version", bson.D{{"$gt", 0}}}}),
+	}
+	_, err := coll.Indexes().CreateMany(mongoCtx, []mongo.IndexModel{versionIndex})
+	return err
+}
+
+// Validate checks the setting can be used by an index run.
+func (obj *Setting) Validate() error {
+	if len(obj.UtmZones) == 0 && len(obj.AreasOfInterest) == 0 && obj.IndexMode != INDEX_MODE_BOUNDARIES {
+		return fmt.Errorf("%w: set utm zones, areas of interest or the boundaries index mode", ERROR_INVALID_SETTING)
+	}
+	for _, zone := range obj.UtmZones {
+		if !utmZoneExpression.MatchString(zone) {
+			return fmt.Errorf("%w: invalid utm zone %s", ERROR_INVALID_SETTING, zone)
+		}
+	}
+	if len(obj.TileFiles) == 0 {
+		return fmt.Errorf("%w: no tile files", ERROR_INVALID_SETTING)
+	}
+	for _, tileFile := range obj.TileFiles {
+		if !KNOWN_TILE_FILES[tileFile] {
+			return fmt.Errorf("%w: unknown tile file %s", ERROR_INVALID_SETTING, tileFile)
+		}
+	}
+	startDate := obj.TileStartDate.Time()
+	if startDate.Before(SENTINEL_2_START_DATE) {
+		return fmt.Errorf("%w: tile start date is before %s", ERROR_INVALID_SETTING, SENTINEL_2_START_DATE.Format("2006-01-02"))
+	} else if startDate.After(time.Now()) {
+		return fmt.Errorf("%w: tile start date is in the future", ERROR_INVALID_SETTING)
+	}
+	if obj.IndexMode != "" && obj.IndexMode != INDEX_MODE_BOUNDARIES {
+		return fmt.Errorf("%w: unknown index mode %s", ERROR_INVALID_SETTING, obj.IndexMode)
+	}
+	if obj.IndexBatchSize < 0 {
+		return fmt.Errorf("%w: negative index batch size", ERROR_INVALID_SETTING)
+	}
+	if err := obj.SceneSelection.Validate(); err != nil {
+		return err
+	}
+	if _, err := obj.IndexMgrsSquares(); err != nil {
+		return fmt.Errorf("%w: %s", ERROR_INVALID_SETTING, err)
+	}
+	return nil
+}
+
+// SaveSetting validates the setting and saves it as the next version
+// after the current setting. A setting saved at the same time by someone
+// else returns ERROR_SETTING_VERSION_CONFLICT.
 func SaveSetting(ctx context.Context, client *mongo.Client, setting *Setting) error {
+	if err := setting.Validate(); err != nil {
+		return err
+	}
+
+	currentSetting, err := FindCurrentSetting(ctx, client)
+	if err == mongo.ErrNoDocuments {
+		currentSetting = &Setting{}
+	} else if err != nil {
+		return err
+	}
+
 	coll := SettingCollection(client)
 	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
 	defer mongoCancel()
-	
+
 	setting.ID = primitive.NewObjectID()
-	_, err := coll.InsertOne(mongoCtx, setting)
-	if err != nil {
+	setting.Version = currentSetting.Version + 1
+	setting.CreatedDate = primitive.NewDateTimeFromTime(time.Now())
+	_, err = coll.InsertOne(mongoCtx, setting)
+	if mongo.IsDuplicateKeyError(err) {
+		return ERROR_SETTING_VERSION_CONFLICT
+	} else if err != nil {
 		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// FindCurrentSetting returns the setting with the highest version, or
+// the newest setting when none of them are versioned.
+func FindCurrentSetting(ctx context.Context, client *mongo.Client) (*Setting, error) {
+	coll := SettingCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	opts := options.FindOne().SetSort(bson.D{{"version", -1}, {"_id", -1}})
+	var setting Setting
+	if err := coll.FindOne(mongoCtx, bson.D{}, opts).Decode(&setting); err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+func FindSettingVersion(ctx context.Context, client *mongo.Client, version int) (*Setting, error) {
+	coll := SettingCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	var setting Setting
+	if err := coll.FindOne(mongoCtx, bson.D{{"version", version}}).Decode(&setting); err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+func FindSettings(ctx context.Context, client *mongo.Client, filter bson.D, opts *options.FindOptions) (*[]Setting, error) {
+	coll := SettingCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	settings := make([]Setting, 0)
+	cursor, err := coll.Find(mongoCtx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(mongoCtx, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// FindSettingHistory returns the versions of the setting newest first,
+// a page size of zero returns every version.
+func FindSettingHistory(ctx context.Context, client *mongo.Client, page, pageSize int64) (*[]Setting, error) {
+	opts := options.Find().SetSort(bson.D{{"version", -1}, {"_id", -1}}).SetSkip(page * pageSize).SetLimit(pageSize)
+	return FindSettings(ctx, client, bson.D{}, opts)
+}
+
+func CountSettings(ctx context.Context, client *mongo.Client, filter bson.D) (int64, error) {
+	coll := SettingCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	return coll.CountDocuments(mongoCtx, filter)
+}
+
+// RestoreSetting saves a copy of an earlier version as the next version.
+func RestoreSetting(ctx context.Context, client *mongo.Client, version int, createdBy string) (*Setting, error) {
+	setting, err := FindSettingVersion(ctx, client, version)
+	if err != nil {
+		return nil, err
+	}
+	setting.CreatedBy = createdBy
+	if err := SaveSetting(ctx, client, setting); err != nil {
+		return nil, err
+	}
+	return setting, nil
+}
+
+// IndexMgrsSquares is the sorted set of mgrs 100km squares touched by
+// the areas of interest.
+func (obj *Setting) IndexMgrsSquares() ([]string, error) {
+	squareIndex := make(map[string]bool)
+	for i := range obj.AreasOfInterest {
+		squares, err := ComputeMgrsSquaresFromGeometry(&obj.AreasOfInterest[i])
+		if err != nil {
+			return nil, fmt.Errorf("area of interest %d: %w", i, err)
+		}
+		for _, square := range squares {
+			squareIndex[square] = true
+		}
+	}
+
+	squares := make([]string, 0, len(squareIndex))
+	for square := range squareIndex {
+		squares = append(squares, square)
+	}
+	sort.Strings(squares)
+	return squares, nil
+}
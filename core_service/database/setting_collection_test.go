@@ -0,0 +1,124 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func validSetting() Setting {
+	return Setting{
+		UtmZones:      []string{"15T", "4Q"},
+		TileFiles:     []string{"B04.tif", "B08.tif", "SCL.tif"},
+		TileStartDate: primitive.NewDateTimeFromTime(time.Date(2023, time.Month(8), 1, 0, 0, 0, 0, time.UTC)),
+	}
+}
+
+func TestSettingValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		change func(setting *Setting)
+		valid  bool
+	}{
+		{name: "valid", change: func(setting *Setting) {}, valid: true},
+		{
+			name:   "boundaries mode without zones",
+			change: func(setting *Setting) { setting.UtmZones = nil; setting.IndexMode = INDEX_MODE_BOUNDARIES },
+			valid:  true,
+		},
+		{name: "nothing to index", change: func(setting *Setting) { setting.UtmZones = nil }},
+		{name: "padded zone", change: func(setting *Setting) { setting.UtmZones = []string{"04Q"} }},
+		{name: "zone out of range", change: func(setting *Setting) { setting.UtmZones = []string{"61T"} }},
+		{name: "invalid latitude band", change: func(setting *Setting) { setting.UtmZones = []string{"15I"} }},
+		{name: "unknown band", change: func(setting *Setting) { setting.TileFiles = []string{"B10.tif"} }},
+		{name: "no tile files", change: func(setting *Setting) { setting.TileFiles = nil }},
+		{
+			name: "start date before sentinel 2",
+			change: func(setting *Setting) {
+				setting.TileStartDate = primitive.NewDateTimeFromTime(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+			},
+		},
+		{
+			name: "start date in the future",
+			change: func(setting *Setting) {
+				setting.TileStartDate = primitive.NewDateTimeFromTime(time.Now().Add(48 * time.Hour))
+			},
+		},
+		{name: "unknown index mode", change: func(setting *Setting) { setting.IndexMode = "everything" }},
+		{name: "negative batch size", change: func(setting *Setting) { setting.IndexBatchSize = -1 }},
+		{
+			name: "least cloudy scenes of the last month",
+			change: func(setting *Setting) {
+				setting.SceneSelection = SceneSelection{Policy: SCENE_POLICY_LEAST_CLOUDY, WithinDays: 30}
+			},
+			valid: true,
+		},
+		{name: "unknown scene policy", change: func(setting *Setting) { setting.SceneSelection.Policy = "sunniest" }},
+		{name: "negative scene days", change: func(setting *Setting) { setting.SceneSelection.WithinDays = -1 }},
+		{
+			name:   "area of interest which is not a polygon",
+			change: func(setting *Setting) { setting.AreasOfInterest = []Geometry{{Type: "Point"}} },
+		},
+	}
+
+	for _, testCase := range testCases {
+		setting := validSetting()
+		testCase.change(&setting)
+		err := setting.Validate()
+		if testCase.valid && err != nil {
+			t.Errorf("%s: expected a valid setting but found %s", testCase.name, err)
+		} else if !testCase.valid && !errors.Is(err, ERROR_INVALID_SETTING) {
+			t.Errorf("%s: expected an invalid setting but found %v", testCase.name, err)
+		}
+	}
+}
+
+func TestSaveSettingVersions(t *testing.T) {
+	CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		setting := validSetting()
+		setting.IndexBatchSize = 100 * (i + 1)
+		if err := SaveSetting(ctx, dbClient, &setting); err != nil {
+			t.Fatal(err)
+		} else if setting.Version != i+1 {
+			t.Fatalf("expected version %d but found %d", i+1, setting.Version)
+		}
+	}
+
+	invalidSetting := validSetting()
+	invalidSetting.TileFiles = []string{"B10.tif"}
+	if err := SaveSetting(ctx, dbClient, &invalidSetting); !errors.Is(err, ERROR_INVALID_SETTING) {
+		t.Fatalf("expected an invalid setting error but found %v", err)
+	}
+
+	currentSetting, err := FindCurrentSetting(ctx, dbClient)
+	if err != nil {
+		t.Fatal(err)
+	} else if currentSetting.Version != 2 || currentSetting.IndexBatchSize != 200 {
+		t.Fatalf("expected version 2 to be current but found %+v", currentSetting)
+	}
+
+	restoredSetting, err := RestoreSetting(ctx, dbClient, 1, "test")
+	if err != nil {
+		t.Fatal(err)
+	} else if restoredSetting.Version != 3 || restoredSetting.IndexBatchSize != 100 || restoredSetting.CreatedBy != "test" {
+		t.Fatalf("expected version 1 to be restored as version 3 but found %+v", restoredSetting)
+	}
+
+	settings, err := FindSettingHistory(ctx, dbClient, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(*settings) != 3 || (*settings)[0].Version != 3 {
+		t.Fatalf("expected 3 versions newest first but found %+v", *settings)
+	}
+}
@@ -32,6 +32,15 @@ func CleanTestDatabase() {
 	boundaryColl := dbClient.Database("test_db").Collection("boundary")
 	eventColl := dbClient.Database("test_db").Collection("event")
 	rasterColl := dbClient.Database("test_db").Collection("raster")
+	deadEventColl := dbClient.Database("test_db").Collection("dead_event")
+	jobColl := dbClient.Database("test_db").Collection("job")
+	leaderColl := dbClient.Database("test_db").Collection("leader")
+	workflowColl := dbClient.Database("test_db").Collection("workflow")
+	workerColl := dbClient.Database("test_db").Collection("worker")
+	inventoryFileColl := dbClient.Database("test_db").Collection("inventory_file")
+	ingestedObjectColl := dbClient.Database("test_db").Collection("ingested_object")
+	boundaryMgrsSquareColl := dbClient.Database("test_db").Collection("boundary_mgrs_square")
+	boundarySceneStatColl := dbClient.Database("test_db").Collection("boundary_scene_stat")
 
 	collectionsToClean := []*mongo.Collection{
 		objectStoreColl, 
@@ -40,6 +49,15 @@ func CleanTestDatabase() {
 		boundaryColl, 
 		eventColl, 
 		rasterColl,
+		deadEventColl,
+		jobColl,
+		leaderColl,
+		workflowColl,
+		workerColl,
+		inventoryFileColl,
+		ingestedObjectColl,
+		boundaryMgrsSquareColl,
+		boundarySceneStatColl,
 	}
 	mongoCtx, _ := context.WithTimeout(ctx, 3*time.Second)
 	for _, coll := range collectionsToClean {
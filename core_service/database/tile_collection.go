@@ -29,6 +29,29 @@ func (obj *TileFile) ToBson() bson.D {
 	}
 }
 
+// SceneMetadata is read from the scene's json metadata or STAC item, the
+// values the metadata doesn't have are nil or empty.
+type SceneMetadata struct {
+	// percentages of the scene
+	CloudCover         *float64 `bson:"cloud_cover" json:"cloudCover"`
+	DataCoverage       *float64 `bson:"data_coverage" json:"dataCoverage"`
+	// in degrees
+	SunElevation       *float64 `bson:"sun_elevation" json:"sunElevation"`
+	SunAzimuth         *float64 `bson:"sun_azimuth" json:"sunAzimuth"`
+	ProcessingBaseline string   `bson:"processing_baseline" json:"processingBaseline"`
+	ProductId          string   `bson:"product_id" json:"productId"`
+}
+func (obj *SceneMetadata) ToBson() bson.D {
+	return bson.D{
+		{"cloud_cover", obj.CloudCover},
+		{"data_coverage", obj.DataCoverage},
+		{"sun_elevation", obj.SunElevation},
+		{"sun_azimuth", obj.SunAzimuth},
+		{"processing_baseline", obj.ProcessingBaseline},
+		{"product_id", obj.ProductId},
+	}
+}
+
 type Tile struct {
     ID 			 	primitive.ObjectID  `bson:"_id" json:"id"`
 	UpdatedDate  	primitive.DateTime  `bson:"updated_date" json:"updatedDate"`
@@ -37,6 +60,7 @@ type Tile struct {
 	SourceSatellite string		     	`bson:"source_satellite" json:"sourceSatellite"`
 	Geometry 		Geometry			`bson:"geometry" json:"geometry"`
 	Files       	[]TileFile          `bson:"files" json:"files"`
+	SceneMetadata						`bson:",inline"`
 }
 func (s *Tile) UniqueKey() string {
 	date := s.Date.Time()
@@ -127,6 +151,10 @@ func UpdateTileAttribute(ctx context.Context, client *mongo.Client, tile *Tile,
 			{"updated_date", primitive.NewDateTimeFromTime(time.Now())},
 			{"geometry", tile.Geometry.ToBson()},
 		}
+	} else if attribute == "sceneMetadata" {
+		attributeData = append(bson.D{
+			{"updated_date", primitive.NewDateTimeFromTime(time.Now())},
+		}, tile.SceneMetadata.ToBson()...)
 	} else {
 		return errors.New("attribute not recognized")
 	}
@@ -164,11 +192,11 @@ func UpdateOrCreateTile(ctx context.Context, client *mongo.Client, tile *Tile) (
 		files = append(files, file.ToBson())
 	}
 	update := bson.D{
-		{"$set", bson.D{
+		{"$set", append(bson.D{
 			{"updated_date", primitive.NewDateTimeFromTime(time.Now())},
 			{"geometry", tile.Geometry.ToBson()},
 			{"files", files},
-		}},
+		}, tile.SceneMetadata.ToBson()...)},
 	}
 	var updatedTile Tile
 	err := coll.FindOneAndUpdate(
@@ -185,4 +213,48 @@ func UpdateOrCreateTile(ctx context.Context, client *mongo.Client, tile *Tile) (
 		return nil, err
 	}
 	return &updatedTile, nil
-}
\ No newline at end of file
+}
+// BulkUpsertTiles creates the tiles which don't exist yet, batchSize
+// tiles per round-trip. The geometry, files and scene metadata of
+// existing tiles are left alone. The error is the report's Err.
+func BulkUpsertTiles(ctx context.Context, client *mongo.Client, tiles []Tile, batchSize int) (BulkWriteReport, error) {
+	coll := TileCollection(client)
+	batchSize = bulkWriteBatchSize(batchSize)
+
+	report := BulkWriteReport{}
+	now := primitive.NewDateTimeFromTime(time.Now())
+	opts := options.BulkWrite().SetOrdered(false)
+	for start := 0; start < len(tiles); start += batchSize {
+		end := start + batchSize
+		if end > len(tiles) {
+			end = len(tiles)
+		}
+
+		models := make([]mongo.WriteModel, 0, end-start)
+		for _, tile := range tiles[start:end] {
+			filter := bson.D{
+				{"date", tile.Date},
+				{"mgrs_code", tile.MgrsCode},
+				{"source_satellite", tile.SourceSatellite},
+			}
+			files := make([]bson.D, 0, len(tile.Files))
+			for _, file := range tile.Files {
+				files = append(files, file.ToBson())
+			}
+			update := bson.D{
+				{"$set", bson.D{{"updated_date", now}}},
+				{"$setOnInsert", append(bson.D{
+					{"geometry", tile.Geometry.ToBson()},
+					{"files", files},
+				}, tile.SceneMetadata.ToBson()...)},
+			}
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+		}
+
+		mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+		_, err := coll.BulkWrite(mongoCtx, models, opts)
+		mongoCancel()
+		report.addBatch(start, end, err, false)
+	}
+	return report, report.Err()
+}
@@ -35,6 +35,7 @@ type User struct {
 	MaxAllowedBoundaryCreations int32              `bson:"max_allowed_boundary_creations" json:"maxAllowedBoundaryCreations"`
 	BoundariesCreated           int32              `bson:"boundaries_created" json:"boundariesCreated"`
 	Enabled                     bool               `bson:"enabled" json:"enabled"`
+	Admin                       bool               `bson:"admin" json:"admin"`
 }
 
 func UserCollection(client *mongo.Client) *mongo.Collection {
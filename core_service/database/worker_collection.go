@@ -0,0 +1,146 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// a worker which hasn't sent a heartbeat for this long is considered dead
+const WORKER_DEAD_AFTER = 1 * time.Minute
+
+const (
+	WORKER_STATE_LIVE = "live"
+	WORKER_STATE_DEAD = "dead"
+)
+
+var ERROR_UNKNOWN_WORKER_STATE = errors.New("Unknown worker state")
+
+// Worker is the registration of a worker process. The id is the lease
+// owner the worker claims events with, so it matches the worker_id
+// stamped on the events it ran.
+type Worker struct {
+	ID            string             `bson:"_id" json:"id"`
+	Name          string             `bson:"name" json:"name"`
+	Host          string             `bson:"host" json:"host"`
+	Version       string             `bson:"version" json:"version"`
+	Concurrency   int                `bson:"concurrency" json:"concurrency"`
+	StartedDate   primitive.DateTime `bson:"started_date" json:"startedDate"`
+	HeartbeatDate primitive.DateTime `bson:"heartbeat_date" json:"heartbeatDate"`
+	// only set when the worker shut down cleanly
+	StoppedDate   primitive.DateTime `bson:"stopped_date" json:"stoppedDate"`
+	CurrentEvents []WorkerEvent      `bson:"current_events" json:"currentEvents"`
+}
+
+// WorkerEvent is an event a worker is running.
+type WorkerEvent struct {
+	EventId     primitive.ObjectID `bson:"event_id" json:"eventId"`
+	EventType   string             `bson:"event_type" json:"eventType"`
+	StartedDate primitive.DateTime `bson:"started_date" json:"startedDate"`
+}
+
+// Live is true while the worker is running and sending heartbeats.
+func (obj *Worker) Live(now time.Time) bool {
+	return obj.StoppedDate == 0 && now.Sub(obj.HeartbeatDate.Time()) < WORKER_DEAD_AFTER
+}
+
+// WorkerStateFilter matches the workers which are live or dead at the
+// given time, the same way Live does.
+func WorkerStateFilter(state string, now time.Time) (bson.D, error) {
+	heartbeatCutoff := primitive.NewDateTimeFromTime(now.Add(-WORKER_DEAD_AFTER))
+	switch state {
+	case WORKER_STATE_LIVE:
+		return bson.D{
+			{"stopped_date", primitive.DateTime(0)},
+			{"heartbeat_date", bson.D{{"$gt", heartbeatCutoff}}},
+		}, nil
+	case WORKER_STATE_DEAD:
+		return bson.D{{"$or", bson.A{
+			bson.D{{"stopped_date", bson.D{{"$ne", primitive.DateTime(0)}}}},
+			bson.D{{"heartbeat_date", bson.D{{"$lte", heartbeatCutoff}}}},
+		}}}, nil
+	}
+	return nil, ERROR_UNKNOWN_WORKER_STATE
+}
+
+func WorkerCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("worker")
+}
+
+// RegisterWorker stores the worker, replacing an earlier registration
+// with the same id.
+func RegisterWorker(ctx context.Context, client *mongo.Client, worker *Worker) error {
+	coll := WorkerCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	worker.StartedDate = now
+	worker.HeartbeatDate = now
+	worker.StoppedDate = 0
+	if worker.CurrentEvents == nil {
+		worker.CurrentEvents = make([]WorkerEvent, 0)
+	}
+
+	opts := options.Replace().SetUpsert(true)
+	_, err := coll.ReplaceOne(mongoCtx, bson.D{{"_id", worker.ID}}, worker, opts)
+	return err
+}
+
+// SaveWorkerHeartbeat marks the worker as alive and records the events
+// it is running.
+func SaveWorkerHeartbeat(ctx context.Context, client *mongo.Client, workerId string, currentEvents []WorkerEvent) error {
+	coll := WorkerCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	update := bson.D{{"$set", bson.D{
+		{"heartbeat_date", primitive.NewDateTimeFromTime(time.Now())},
+		{"current_events", currentEvents},
+	}}}
+	_, err := coll.UpdateOne(mongoCtx, bson.D{{"_id", workerId}}, update)
+	return err
+}
+
+// StopWorker marks the worker as shut down.
+func StopWorker(ctx context.Context, client *mongo.Client, workerId string) error {
+	coll := WorkerCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	update := bson.D{{"$set", bson.D{
+		{"stopped_date", primitive.NewDateTimeFromTime(time.Now())},
+		{"current_events", bson.A{}},
+	}}}
+	_, err := coll.UpdateOne(mongoCtx, bson.D{{"_id", workerId}}, update)
+	return err
+}
+
+func FindWorkers(ctx context.Context, client *mongo.Client, filter bson.D, opts *options.FindOptions) (*[]Worker, error) {
+	coll := WorkerCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	workers := make([]Worker, 0, 10)
+	cursor, err := coll.Find(mongoCtx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(mongoCtx, &workers); err != nil {
+		return nil, err
+	}
+	return &workers, nil
+}
+
+func CountWorkers(ctx context.Context, client *mongo.Client, filter bson.D) (int64, error) {
+	coll := WorkerCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	return coll.CountDocuments(mongoCtx, filter)
+}
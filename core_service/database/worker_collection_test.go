@@ -0,0 +1,46 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWorkerLive(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		name   string
+		worker Worker
+		live   bool
+	}{
+		{
+			name:   "recent heartbeat",
+			worker: Worker{HeartbeatDate: primitive.NewDateTimeFromTime(now.Add(-WORKER_DEAD_AFTER / 2))},
+			live:   true,
+		},
+		{
+			name:   "missed heartbeats",
+			worker: Worker{HeartbeatDate: primitive.NewDateTimeFromTime(now.Add(-2 * WORKER_DEAD_AFTER))},
+			live:   false,
+		},
+		{
+			name: "stopped",
+			worker: Worker{
+				HeartbeatDate: primitive.NewDateTimeFromTime(now),
+				StoppedDate:   primitive.NewDateTimeFromTime(now),
+			},
+			live: false,
+		},
+	}
+	for _, testCase := range testCases {
+		if live := testCase.worker.Live(now); live != testCase.live {
+			t.Fatalf("%s: expected live to be %v", testCase.name, testCase.live)
+		}
+	}
+
+	if _, err := WorkerStateFilter("sleeping", now); err != ERROR_UNKNOWN_WORKER_STATE {
+		t.Fatalf("expected an unknown worker state error but found %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	WORKFLOW_STATUS_RUNNING   = "running"
+	WORKFLOW_STATUS_PASSED    = "passed"
+	WORKFLOW_STATUS_FAILED    = "failed"
+	WORKFLOW_STATUS_CANCELLED = "cancelled"
+)
+
+// Workflow groups the events of a single run, for example one daily
+// index run and every map event it fans out to. Events join a workflow
+// through their workflow id. Once none of its events are left to run
+// the workflow passes, or fails if any of them died, and a passed
+// workflow publishes its follow up events. Cancelling any of its events
+// cancels the workflow.
+type Workflow struct {
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
+	Name           string             `bson:"name" json:"name"`
+	RunKey         string             `bson:"run_key" json:"runKey"`
+	RootEventId    primitive.ObjectID `bson:"root_event_id" json:"rootEventId"`
+	Status         string             `bson:"status" json:"status"`
+	CreatedDate    primitive.DateTime `bson:"created_date" json:"createdDate"`
+	CompletedDate  primitive.DateTime `bson:"completed_date" json:"completedDate"`
+	FollowUpEvents []Event            `bson:"follow_up_events" json:"followUpEvents"`
+}
+
+// WorkflowProgress counts the events of a workflow by their state.
+type WorkflowProgress struct {
+	Pending   int64 `json:"pending"`
+	Running   int64 `json:"running"`
+	Passed    int64 `json:"passed"`
+	Failed    int64 `json:"failed"`
+	Cancelled int64 `json:"cancelled"`
+}
+
+func (obj *WorkflowProgress) Done() bool {
+	return obj.Pending == 0 && obj.Running == 0
+}
+
+// WorkflowQuery selects workflows by id, name, run key or status. Empty
+// fields are ignored.
+type WorkflowQuery struct {
+	WorkflowId string `json:"workflowId"`
+	Name       string `json:"name"`
+	RunKey     string `json:"runKey"`
+	Status     string `json:"status"`
+}
+
+func (obj *WorkflowQuery) Filter() (bson.D, error) {
+	filter := bson.D{}
+	if obj.WorkflowId != "" {
+		workflowId, err := primitive.ObjectIDFromHex(obj.WorkflowId)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.E{"_id", workflowId})
+	}
+	if obj.Name != "" {
+		filter = append(filter, bson.E{"name", obj.Name})
+	}
+	if obj.RunKey != "" {
+		filter = append(filter, bson.E{"run_key", obj.RunKey})
+	}
+	if obj.Status != "" {
+		filter = append(filter, bson.E{"status", obj.Status})
+	}
+	return filter, nil
+}
+
+func WorkflowCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(DatabaseName()).Collection("workflow")
+}
+
+func CreateWorkflowIndexes(ctx context.Context, client *mongo.Client) error {
+	coll := WorkflowCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	runIndex := mongo.IndexModel{
+		Keys:    bson.D{{"name", 1}, {"run_key", 1}},
+		Options: options.Index().SetName("name_run_key"),
+	}
+	_, err := coll.Indexes().CreateMany(mongoCtx, []mongo.IndexModel{runIndex})
+	return err
+}
+
+// StartWorkflow creates a workflow with the event as its root and the
+// events to publish once the run passed. A saved root event is updated
+// to point at the workflow so every child it publishes joins the run.
+func StartWorkflow(ctx context.Context, client *mongo.Client, workflow *Workflow, rootEvent *Event, followUpEvents ...Event) error {
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	if workflow.ID == primitive.NilObjectID {
+		workflow.ID = primitive.NewObjectID()
+	}
+	workflow.RootEventId = rootEvent.ID
+	workflow.FollowUpEvents = append(workflow.FollowUpEvents, followUpEvents...)
+	workflow.Status = WORKFLOW_STATUS_RUNNING
+	workflow.CreatedDate = primitive.NewDateTimeFromTime(time.Now())
+	if _, err := WorkflowCollection(client).InsertOne(mongoCtx, workflow); err != nil {
+		return err
+	}
+
+	rootEvent.WorkflowId = workflow.ID
+	if rootEvent.ID == primitive.NilObjectID {
+		return nil
+	}
+	_, err := EventCollection(client).UpdateOne(
+		mongoCtx,
+		bson.D{{"_id", rootEvent.ID}},
+		bson.D{{"$set", bson.D{{"workflow_id", workflow.ID}}}},
+	)
+	return err
+}
+
+func FindWorkflow(ctx context.Context, client *mongo.Client, filter bson.D) (*Workflow, error) {
+	coll := WorkflowCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	// the most recent run when several match
+	opts := options.FindOne().SetSort(bson.D{{"created_date", -1}})
+
+	var workflow Workflow
+	err := coll.FindOne(mongoCtx, filter, opts).Decode(&workflow)
+	if err != nil {
+		return nil, err
+	}
+	return &workflow, nil
+}
+
+func FindWorkflows(ctx context.Context, client *mongo.Client, filter bson.D, opts *options.FindOptions) (*[]Workflow, error) {
+	coll := WorkflowCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	workflows := make([]Workflow, 0, 10)
+	cursor, err := coll.Find(mongoCtx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(mongoCtx, &workflows); err != nil {
+		return nil, err
+	}
+
+	return &workflows, nil
+}
+
+func CountWorkflows(ctx context.Context, client *mongo.Client, filter bson.D) (int64, error) {
+	coll := WorkflowCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer mongoCancel()
+
+	return coll.CountDocuments(mongoCtx, filter)
+}
+
+func FindWorkflowProgress(ctx context.Context, client *mongo.Client, workflowId primitive.ObjectID) (*WorkflowProgress, error) {
+	var progress WorkflowProgress
+	var err error
+
+	progress.Pending, err = CountEvents(ctx, client, bson.D{
+		{"workflow_id", workflowId}, {"passed", false}, {"failed", false}, {"started", false},
+		{"cancelled", bson.D{{"$ne", true}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	progress.Running, err = CountEvents(ctx, client, bson.D{
+		{"workflow_id", workflowId}, {"passed", false}, {"failed", false}, {"started", true},
+		{"cancelled", bson.D{{"$ne", true}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	progress.Passed, err = CountEvents(ctx, client, bson.D{
+		{"workflow_id", workflowId}, {"passed", true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	progress.Failed, err = CountDeadEvents(ctx, client, bson.D{{"event.workflow_id", workflowId}})
+	if err != nil {
+		return nil, err
+	}
+	progress.Cancelled, err = CountEvents(ctx, client, bson.D{
+		{"workflow_id", workflowId}, {"passed", false}, {"cancelled", true},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &progress, nil
+}
+
+// CompleteWorkflow moves a running workflow to its final status. Only
+// one caller succeeds, it returns false if the workflow was no longer
+// running.
+func CompleteWorkflow(ctx context.Context, client *mongo.Client, workflow *Workflow, status string) (bool, error) {
+	coll := WorkflowCollection(client)
+	mongoCtx, mongoCancel := context.WithTimeout(ctx, 15*time.Second)
+	defer mongoCancel()
+
+	completedDate := primitive.NewDateTimeFromTime(time.Now())
+	filter := bson.D{{"_id", workflow.ID}, {"status", WORKFLOW_STATUS_RUNNING}}
+	update := bson.D{{"$set", bson.D{
+		{"status", status},
+		{"completed_date", completedDate},
+	}}}
+	result, err := coll.UpdateOne(mongoCtx, filter, update)
+	if err != nil {
+		return false, err
+	} else if result.ModifiedCount == 0 {
+		return false, nil
+	}
+
+	workflow.Status = status
+	workflow.CompletedDate = completedDate
+	return true, nil
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWorkflowQueryFilter(t *testing.T) {
+	workflowId := primitive.NewObjectID()
+
+	query := WorkflowQuery{WorkflowId: workflowId.Hex(), Name: "IndexRun", RunKey: "2023-09-05", Status: WORKFLOW_STATUS_FAILED}
+	filter, err := query.Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFilter := bson.D{
+		{"_id", workflowId},
+		{"name", "IndexRun"},
+		{"run_key", "2023-09-05"},
+		{"status", WORKFLOW_STATUS_FAILED},
+	}
+	if len(filter) != len(expectedFilter) {
+		t.Fatal(filter)
+	}
+	for i := range expectedFilter {
+		if filter[i] != expectedFilter[i] {
+			t.Fatalf("expected %v but found %v", expectedFilter[i], filter[i])
+		}
+	}
+
+	query = WorkflowQuery{}
+	if filter, err := query.Filter(); err != nil || len(filter) != 0 {
+		t.Fatalf("expected an empty filter but found %v, %v", filter, err)
+	}
+
+	query = WorkflowQuery{WorkflowId: "not-an-id"}
+	if _, err := query.Filter(); err == nil {
+		t.Fatal("expected an invalid workflow id error")
+	}
+}
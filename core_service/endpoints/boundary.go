@@ -167,15 +167,16 @@ func postBoundary(w http.ResponseWriter, r *http.Request) {
 	// publish an event to build the map
 	event := db.Event{
 		EventType: "BuildBoundaryMapTask",
-		MaxAttemps: 1,
 		Priority: 5,
+		UserId: user.ID,
+		DedupKey: db.BuildBoundaryMapDedupKey(boundaryObj.MgrsCodes[0], boundaryObj.ID.Hex()),
 		Data: map[string]string{
 			"mgrsCode": boundaryObj.MgrsCodes[0],
 			"boundaryId": boundaryObj.ID.Hex(),
 		},
 	}
 	err = db.SaveEvent(ctx, dbClient, &event)
-	if err != nil {
+	if err != nil && err != db.ERROR_DUPLICATE_EVENT {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
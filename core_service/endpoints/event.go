@@ -0,0 +1,442 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	db "core_service/database"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DEFAULT_EVENT_PAGE_SIZE = 50
+	MAX_EVENT_PAGE_SIZE     = 500
+	// the largest page whose skip fits in an int64 at any page size
+	MAX_EVENT_PAGE = math.MaxInt64 / MAX_EVENT_PAGE_SIZE
+)
+
+type EventsResponse struct {
+	Events   []db.Event `json:"events"`
+	Total    int64      `json:"total"`
+	Page     int64      `json:"page"`
+	PageSize int64      `json:"pageSize"`
+}
+
+type DeadEventsResponse struct {
+	DeadEvents []db.DeadEvent `json:"deadEvents"`
+	Total      int64          `json:"total"`
+	Page       int64          `json:"page"`
+	PageSize   int64          `json:"pageSize"`
+}
+
+type EventTypeCounts struct {
+	EventType string           `json:"eventType"`
+	Counts    map[string]int64 `json:"counts"`
+}
+
+type EventCountsResponse struct {
+	EventTypes []EventTypeCounts `json:"eventTypes"`
+}
+
+type CancelEventsResponseBody struct {
+	Cancelled int64 `json:"cancelled"`
+}
+
+// parsePage reads the zero based page and page size query parameters.
+func parsePage(r *http.Request) (int64, int64, error) {
+	page := int64(0)
+	pageSize := int64(DEFAULT_EVENT_PAGE_SIZE)
+
+	var err error
+	if value := r.URL.Query().Get("page"); value != "" {
+		if page, err = strconv.ParseInt(value, 10, 64); err != nil || page < 0 || page > MAX_EVENT_PAGE {
+			return 0, 0, errors.New("invalid page")
+		}
+	}
+	if value := r.URL.Query().Get("pageSize"); value != "" {
+		if pageSize, err = strconv.ParseInt(value, 10, 64); err != nil || pageSize <= 0 || pageSize > MAX_EVENT_PAGE_SIZE {
+			return 0, 0, errors.New("invalid page size")
+		}
+	}
+	return page, pageSize, nil
+}
+
+func eventIdFromPath(r *http.Request) (primitive.ObjectID, error) {
+	vars := mux.Vars(r)
+	eventId, hasEventId := vars["eventId"]
+	if !hasEventId {
+		return primitive.NilObjectID, errors.New("missing event id")
+	}
+	return primitive.ObjectIDFromHex(eventId)
+}
+
+func writeJson(w http.ResponseWriter, obj interface{}) {
+	responseData, err := json.Marshal(obj)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(responseData)
+}
+
+// getEvents lists events, newest first, filtered by the eventId,
+// eventType, mgrsCode, workflowId and state query parameters.
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page, pageSize, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	query := db.EventQuery{
+		EventId:    r.URL.Query().Get("eventId"),
+		EventType:  r.URL.Query().Get("eventType"),
+		MgrsCode:   r.URL.Query().Get("mgrsCode"),
+		WorkflowId: r.URL.Query().Get("workflowId"),
+		State:      r.URL.Query().Get("state"),
+	}
+	filter, err := query.Filter()
+	if err == db.ERROR_EMPTY_EVENT_QUERY {
+		filter = bson.D{}
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	total, err := db.CountEvents(ctx, dbClient, filter)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{"_id", -1}}).SetSkip(page * pageSize).SetLimit(pageSize)
+	events, err := db.FindEvents(ctx, dbClient, filter, opts)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, EventsResponse{Events: *events, Total: total, Page: page, PageSize: pageSize})
+}
+
+// getEventCounts counts the events of each type by state, dead events
+// are counted from the dead event collection.
+func getEventCounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	eventTypes, err := db.FindEventTypes(ctx, dbClient)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := EventCountsResponse{EventTypes: make([]EventTypeCounts, 0, len(eventTypes))}
+	for _, eventType := range eventTypes {
+		counts := make(map[string]int64)
+		for _, state := range db.EventStates {
+			query := db.EventQuery{EventType: eventType, State: state}
+			filter, err := query.Filter()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if counts[state], err = db.CountEvents(ctx, dbClient, filter); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if counts["dead"], err = db.CountDeadEvents(ctx, dbClient, bson.D{{"event.event_type", eventType}}); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response.EventTypes = append(response.EventTypes, EventTypeCounts{EventType: eventType, Counts: counts})
+	}
+
+	writeJson(w, response)
+}
+
+// getEvent returns a single event with its error history.
+func getEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+
+	eventId, err := eventIdFromPath(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events, err := db.FindEvents(ctx, dbClient, bson.D{{"_id", eventId}}, options.Find())
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if len(*events) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJson(w, (*events)[0])
+}
+
+// postRequeueEvent runs a finished, cancelled or dead event again.
+func postRequeueEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+
+	eventId, err := eventIdFromPath(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	event, err := db.RequeueEvent(ctx, dbClient, eventId)
+	if err == mongo.ErrNoDocuments {
+		// failed events live in the dead event collection
+		event, err = db.RequeueDeadEvent(ctx, dbClient, eventId)
+	}
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == db.ERROR_EVENT_RUNNING {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err.Error())
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, event)
+}
+
+// postCancelEvent cancels a single queued or running event.
+func postCancelEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+
+	eventId, err := eventIdFromPath(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	cancelledCount, err := db.CancelEvents(ctx, dbClient, bson.D{{"_id", eventId}})
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, CancelEventsResponseBody{Cancelled: cancelledCount})
+}
+
+// postCancelEvents cancels the events matching the id, event type, mgrs
+// code or state in the request body.
+func postCancelEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	defer r.Body.Close()
+	bodyData, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var query db.EventQuery
+	if err := json.Unmarshal(bodyData, &query); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	filter, err := query.Filter()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	cancelledCount, err := db.CancelEvents(ctx, dbClient, filter)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, CancelEventsResponseBody{Cancelled: cancelledCount})
+}
+
+// getDeadEvents lists dead events, most recent first, filtered by the
+// eventType, mgrsCode and workflowId query parameters.
+func getDeadEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page, pageSize, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	query := db.EventQuery{
+		EventType:  r.URL.Query().Get("eventType"),
+		MgrsCode:   r.URL.Query().Get("mgrsCode"),
+		WorkflowId: r.URL.Query().Get("workflowId"),
+	}
+	filter, err := query.DeadFilter()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	total, err := db.CountDeadEvents(ctx, dbClient, filter)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{"dead_date", -1}}).SetSkip(page * pageSize).SetLimit(pageSize)
+	deadEvents, err := db.FindDeadEvents(ctx, dbClient, filter, opts)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, DeadEventsResponse{DeadEvents: *deadEvents, Total: total, Page: page, PageSize: pageSize})
+}
+
+// deleteDeadEvent discards a dead event for good, dead events which
+// should run again are requeued instead.
+func deleteDeadEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+
+	eventId, err := eventIdFromPath(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = db.DiscardDeadEvent(ctx, dbClient, eventId)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
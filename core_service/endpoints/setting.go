@@ -0,0 +1,276 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	db "core_service/database"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type SettingsResponse struct {
+	Settings []db.Setting `json:"settings"`
+	Total    int64        `json:"total"`
+	Page     int64        `json:"page"`
+	PageSize int64        `json:"pageSize"`
+}
+
+func settingVersionFromPath(r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	version, hasVersion := vars["version"]
+	if !hasVersion {
+		return 0, errors.New("missing setting version")
+	}
+	return strconv.Atoi(version)
+}
+
+// saveSetting saves the setting as the next version and writes it out.
+// A version in the request must match the current version so changes
+// made in the meantime aren't overwritten.
+func saveSetting(ctx context.Context, w http.ResponseWriter, r *http.Request, currentSetting *db.Setting, setting *db.Setting) {
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if setting.Version != 0 && (currentSetting == nil || setting.Version != currentSetting.Version) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, db.ERROR_SETTING_VERSION_CONFLICT.Error())
+		return
+	}
+
+	user, err := db.JWTTokenUser(ctx, dbClient, r.Header["Token"][0])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setting.CreatedBy = user.Name
+
+	err = db.SaveSetting(ctx, dbClient, setting)
+	if errors.Is(err, db.ERROR_INVALID_SETTING) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	} else if err == db.ERROR_SETTING_VERSION_CONFLICT {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err.Error())
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, setting)
+}
+
+func getPostPatchSetting(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		getSetting(w, r)
+	} else if r.Method == "POST" || r.Method == "PATCH" {
+		postPatchSetting(w, r)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getSetting returns the current setting.
+func getSetting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setting, err := db.FindCurrentSetting(ctx, dbClient)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, setting)
+}
+
+// postPatchSetting saves a new version of the setting. A POST replaces
+// the whole setting while a PATCH only changes the fields in the body.
+func postPatchSetting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PATCH" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	defer r.Body.Close()
+	bodyData, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	currentSetting, err := db.FindCurrentSetting(ctx, dbClient)
+	if err == mongo.ErrNoDocuments {
+		currentSetting = nil
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var setting db.Setting
+	if r.Method == "PATCH" {
+		if currentSetting == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// the version has to be sent again to be checked
+		setting = *currentSetting
+		setting.Version = 0
+	}
+	if err := json.Unmarshal(bodyData, &setting); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	saveSetting(ctx, w, r, currentSetting, &setting)
+}
+
+// getSettingHistory lists the versions of the setting, newest first.
+func getSettingHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page, pageSize, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	total, err := db.CountSettings(ctx, dbClient, bson.D{})
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	settings, err := db.FindSettingHistory(ctx, dbClient, page, pageSize)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, SettingsResponse{Settings: *settings, Total: total, Page: page, PageSize: pageSize})
+}
+
+// getSettingVersion returns a single version of the setting.
+func getSettingVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+
+	version, err := settingVersionFromPath(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setting, err := db.FindSettingVersion(ctx, dbClient, version)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, setting)
+}
+
+// postRestoreSetting saves an earlier version as the next version.
+func postRestoreSetting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+
+	version, err := settingVersionFromPath(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setting, err := db.FindSettingVersion(ctx, dbClient, version)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// restoring never conflicts, the version is replaced when saved
+	setting.Version = 0
+	saveSetting(ctx, w, r, nil, setting)
+}
@@ -11,12 +11,15 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	db "core_service/database"
 )
 
 var UI_BUILD_PATH string
 
+const SERVER_SHUTDOWN_TIMEOUT = 30 * time.Second
+
 func init() {
 	if strings.HasSuffix(os.Args[0], ".test") {
 		UI_BUILD_PATH = ""
@@ -40,6 +43,23 @@ func SetupEndpoints(ctx context.Context, port int) *http.Server {
 	r.HandleFunc("/api/signin", authUser).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/refreshToken", IsAuthorized(refreshUserToken)).Methods("POST", "OPTIONS")
 
+	// admin routes
+	r.HandleFunc("/api/admin/event", IsAdmin(getEvents)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/admin/event/counts", IsAdmin(getEventCounts)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/admin/event/cancel", IsAdmin(postCancelEvents)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/admin/event/{eventId}", IsAdmin(getEvent)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/admin/event/{eventId}/requeue", IsAdmin(postRequeueEvent)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/admin/event/{eventId}/cancel", IsAdmin(postCancelEvent)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/admin/deadEvent", IsAdmin(getDeadEvents)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/admin/deadEvent/{eventId}", IsAdmin(deleteDeadEvent)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/admin/worker", IsAdmin(getWorkers)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/admin/workflow", IsAdmin(getWorkflows)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/admin/workflow/{workflowId}", IsAdmin(getWorkflow)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/admin/setting", IsAdmin(getPostPatchSetting)).Methods("GET", "POST", "PATCH", "OPTIONS")
+	r.HandleFunc("/api/admin/setting/history", IsAdmin(getSettingHistory)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/admin/setting/{version:[0-9]+}", IsAdmin(getSettingVersion)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/admin/setting/{version:[0-9]+}/restore", IsAdmin(postRestoreSetting)).Methods("POST", "OPTIONS")
+
 	// ui routes
 	// the react app is a single page app with a router so we need
 	// to serve the index.html file for all routes prefixed with /r/
@@ -68,13 +88,24 @@ func SetupEndpoints(ctx context.Context, port int) *http.Server {
 	return server
 }
 
-func StartServer(server *http.Server) {
+// StartServer serves requests until the context is done, then shuts the
+// server down, giving the open requests up to SERVER_SHUTDOWN_TIMEOUT
+// to finish.
+func StartServer(ctx context.Context, server *http.Server) error {
+	shutdownDone := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		log.Println("- shutting down the server")
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), SERVER_SHUTDOWN_TIMEOUT)
+		defer shutdownCancel()
+		shutdownDone <- server.Shutdown(shutdownCtx)
+	}()
+
 	err := server.ListenAndServe()
-	if errors.Is(err, http.ErrServerClosed) {
-		log.Fatal("server one closed")
-	} else if err != nil {
-		log.Fatalf("error listening for server: %s", err)
+	if !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error listening for server: %w", err)
 	}
+	return <-shutdownDone
 }
 
 func alive(w http.ResponseWriter, r *http.Request) {
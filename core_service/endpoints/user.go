@@ -222,3 +222,24 @@ func IsAuthorized(handler http.HandlerFunc) http.HandlerFunc {
 		return
 	}
 }
+
+
+// IsAdmin only lets enabled admin users through to the handler.
+func IsAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return IsAuthorized(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		dbClient, err := db.DefaultDatabaseClient(ctx)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if user, err := db.JWTTokenUser(ctx, dbClient, r.Header["Token"][0]); err == nil && user.Admin {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusForbidden)
+	})
+}
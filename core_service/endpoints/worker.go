@@ -0,0 +1,81 @@
+package endpoints
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type WorkerStatus struct {
+	db.Worker
+	Live bool `json:"live"`
+}
+
+type WorkersResponse struct {
+	Workers  []WorkerStatus `json:"workers"`
+	Total    int64          `json:"total"`
+	Page     int64          `json:"page"`
+	PageSize int64          `json:"pageSize"`
+}
+
+// getWorkers lists the registered workers, most recent heartbeat first,
+// optionally filtered to the live or dead ones by the state query
+// parameter.
+func getWorkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page, pageSize, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	now := time.Now()
+	filter := bson.D{}
+	if state := r.URL.Query().Get("state"); state != "" {
+		if filter, err = db.WorkerStateFilter(state, now); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	total, err := db.CountWorkers(ctx, dbClient, filter)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{"heartbeat_date", -1}}).SetSkip(page * pageSize).SetLimit(pageSize)
+	workers, err := db.FindWorkers(ctx, dbClient, filter, opts)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	workerStatuses := make([]WorkerStatus, 0, len(*workers))
+	for _, worker := range *workers {
+		workerStatuses = append(workerStatuses, WorkerStatus{Worker: worker, Live: worker.Live(now)})
+	}
+	writeJson(w, WorkersResponse{Workers: workerStatuses, Total: total, Page: page, PageSize: pageSize})
+}
@@ -0,0 +1,133 @@
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	db "core_service/database"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type WorkflowsResponse struct {
+	Workflows []db.Workflow `json:"workflows"`
+	Total     int64         `json:"total"`
+	Page      int64         `json:"page"`
+	PageSize  int64         `json:"pageSize"`
+}
+
+type WorkflowResponse struct {
+	Workflow db.Workflow         `json:"workflow"`
+	Progress db.WorkflowProgress `json:"progress"`
+}
+
+// getWorkflows lists workflows, most recent first, filtered by the name,
+// runKey and status query parameters.
+func getWorkflows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page, pageSize, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	query := db.WorkflowQuery{
+		Name:   r.URL.Query().Get("name"),
+		RunKey: r.URL.Query().Get("runKey"),
+		Status: r.URL.Query().Get("status"),
+	}
+	filter, err := query.Filter()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	total, err := db.CountWorkflows(ctx, dbClient, filter)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{"created_date", -1}}).SetSkip(page * pageSize).SetLimit(pageSize)
+	workflows, err := db.FindWorkflows(ctx, dbClient, filter, opts)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, WorkflowsResponse{Workflows: *workflows, Total: total, Page: page, PageSize: pageSize})
+}
+
+// getWorkflow returns a workflow with the count of its events in each
+// state, the failed ones are in the dead event collection.
+func getWorkflow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+
+	workflowId, err := workflowIdFromPath(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	workflow, err := db.FindWorkflow(ctx, dbClient, bson.D{{"_id", workflowId}})
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	progress, err := db.FindWorkflowProgress(ctx, dbClient, workflowId)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, WorkflowResponse{Workflow: *workflow, Progress: *progress})
+}
+
+func workflowIdFromPath(r *http.Request) (primitive.ObjectID, error) {
+	vars := mux.Vars(r)
+	workflowId, hasWorkflowId := vars["workflowId"]
+	if !hasWorkflowId {
+		return primitive.NilObjectID, errors.New("missing workflow id")
+	}
+	return primitive.ObjectIDFromHex(workflowId)
+}
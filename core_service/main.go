@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"flag"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"log"
     "context"
 
@@ -14,6 +18,9 @@ import (
 
 const PORT = 7000
 
+// how long the database client gets to close its connections on exit
+const DISCONNECT_TIMEOUT = 15 * time.Second
+
 func main() {
 	log.Println("- Initializing core geo service")
 
@@ -30,14 +37,51 @@ func main() {
 
     workerCmd := flag.NewFlagSet("worker", flag.ExitOnError)
     workerName := workerCmd.String("name", "", "name")
+    workerConcurrency := workerCmd.Int("concurrency", 4, "number of events processed at the same time")
+    workerDispatch := workerCmd.String("dispatch", worker.DISPATCH_POLL, "how idle workers learn about new events, poll or changeStream")
+
+    cancelCmd := flag.NewFlagSet("cancel", flag.ExitOnError)
+    cancelEventId := cancelCmd.String("id", "", "id of the event to cancel")
+    cancelEventType := cancelCmd.String("type", "", "cancel all events of this type")
+    cancelMgrsCode := cancelCmd.String("mgrs", "", "cancel all events for this mgrs code")
+    cancelWorkflowId := cancelCmd.String("workflow", "", "cancel all events of this workflow id")
+
+    settingCmd := flag.NewFlagSet("setting", flag.ExitOnError)
+    settingFile := settingCmd.String("file", "", "json file with the setting to save as the next version")
+    settingRestore := settingCmd.Int("restore", 0, "save this earlier version as the next version")
+    settingHistory := settingCmd.Bool("history", false, "list every version of the setting")
+
+    workflowCmd := flag.NewFlagSet("workflow", flag.ExitOnError)
+    workflowId := workflowCmd.String("id", "", "id of the workflow")
+    workflowName := workflowCmd.String("name", worker.INDEX_RUN_WORKFLOW, "name of the workflow, the latest run is shown without a run key")
+    workflowRunKey := workflowCmd.String("run", "", "run key of the workflow, like 2023-09-05T00-00Z for an index run")
+
+    backfillCmd := flag.NewFlagSet("backfill", flag.ExitOnError)
+    backfillStartDate := backfillCmd.String("start", "", "first scene date to index, like 2023-01-01")
+    backfillEndDate := backfillCmd.String("end", "", "last scene date to index, like 2023-06-30")
+    backfillMgrsCodes := backfillCmd.String("mgrs", "", "comma separated mgrs codes to index, like 15TUL,15TVL")
+
+    stacCmd := flag.NewFlagSet("stac", flag.ExitOnError)
+    stacStartDate := stacCmd.String("start", "", "first scene date to index, like 2023-01-01")
+    stacEndDate := stacCmd.String("end", "", "last scene date to index, like 2023-06-30")
+    stacBbox := stacCmd.String("bbox", "", "min lon, min lat, max lon and max lat to search, like -94,44,-92,46")
+    stacMaxCloudCover := stacCmd.String("cloud", "", "skip scenes with more cloud cover, a percentage")
 
     if len(os.Args) < 2 {
         log.Fatal("expected a subcommand")
     }
 
-    // configure all models
-    ctx := context.Background()
+    // stop gracefully on SIGINT or SIGTERM, a second signal kills the
+    // process right away
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    go func() {
+        <-ctx.Done()
+        log.Println("- shutdown requested")
+        stop()
+    }()
 
+    // configure all models
     if err := database.Configure(ctx); err != nil {
         log.Fatal("failed to configure database")
     } 
@@ -49,17 +93,166 @@ func main() {
         apiCmd.Parse(os.Args[2:])
         log.Println("- starting an api by name", *apiName)
 
-		server := endpoints.SetupEndpoints(ctx, PORT)
-        endpoints.StartServer(server)
+		// requests are not cancelled by the shutdown signal, the server
+		// lets them finish
+		server := endpoints.SetupEndpoints(context.Background(), PORT)
+        if err := endpoints.StartServer(ctx, server); err != nil {
+            log.Println(err)
+        }
 
     case "worker":
         workerCmd.Parse(os.Args[2:])
         fmt.Println("- starting a worker by name", *workerName)
 
-        worker.WorkerClient(ctx)
-        
+        worker.WorkerClient(ctx, *workerName, *workerConcurrency, *workerDispatch)
+        log.Println("- worker stopped")
+
+    case "cancel":
+        cancelCmd.Parse(os.Args[2:])
+
+        dbClient, err := database.DefaultDatabaseClient(ctx)
+        if err != nil {
+            log.Fatal(err)
+        }
+        query := database.EventQuery{EventId: *cancelEventId, EventType: *cancelEventType, MgrsCode: *cancelMgrsCode, WorkflowId: *cancelWorkflowId}
+        cancelledCount, err := worker.CancelEvents(ctx, worker.NewMongoQueue(dbClient), &query)
+        if err != nil {
+            log.Fatal(err)
+        }
+        fmt.Println("- cancelled events:", cancelledCount)
+
+    case "setting":
+        settingCmd.Parse(os.Args[2:])
+
+        dbClient, err := database.DefaultDatabaseClient(ctx)
+        if err != nil {
+            log.Fatal(err)
+        }
+
+        // prints the current setting unless a flag says otherwise
+        var output interface{}
+        if *settingFile != "" {
+            settingData, err := os.ReadFile(*settingFile)
+            if err != nil {
+                log.Fatal(err)
+            }
+            setting := database.Setting{CreatedBy: "cli"}
+            if err := json.Unmarshal(settingData, &setting); err != nil {
+                log.Fatal(err)
+            }
+            if err := database.SaveSetting(ctx, dbClient, &setting); err != nil {
+                log.Fatal(err)
+            }
+            output = setting
+        } else if *settingRestore != 0 {
+            output, err = database.RestoreSetting(ctx, dbClient, *settingRestore, "cli")
+        } else if *settingHistory {
+            output, err = database.FindSettingHistory(ctx, dbClient, 0, 0)
+        } else {
+            output, err = database.FindCurrentSetting(ctx, dbClient)
+        }
+        if err != nil {
+            log.Fatal(err)
+        }
+
+        outputData, err := json.MarshalIndent(output, "", "  ")
+        if err != nil {
+            log.Fatal(err)
+        }
+        fmt.Println(string(outputData))
+
+    case "workflow":
+        workflowCmd.Parse(os.Args[2:])
+
+        dbClient, err := database.DefaultDatabaseClient(ctx)
+        if err != nil {
+            log.Fatal(err)
+        }
+        // an id picks the workflow, otherwise the latest run of the name
+        query := database.WorkflowQuery{WorkflowId: *workflowId}
+        if *workflowId == "" {
+            query = database.WorkflowQuery{Name: *workflowName, RunKey: *workflowRunKey}
+        }
+        filter, err := query.Filter()
+        if err != nil {
+            log.Fatal(err)
+        }
+        workflow, err := database.FindWorkflow(ctx, dbClient, filter)
+        if err != nil {
+            log.Fatal(err)
+        }
+        progress, err := database.FindWorkflowProgress(ctx, dbClient, workflow.ID)
+        if err != nil {
+            log.Fatal(err)
+        }
+
+        outputData, err := json.MarshalIndent(endpoints.WorkflowResponse{Workflow: *workflow, Progress: *progress}, "", "  ")
+        if err != nil {
+            log.Fatal(err)
+        }
+        fmt.Println(string(outputData))
+
+    case "backfill":
+        backfillCmd.Parse(os.Args[2:])
+
+        dbClient, err := database.DefaultDatabaseClient(ctx)
+        if err != nil {
+            log.Fatal(err)
+        }
+        request, err := worker.ParseBackfillRequest(map[string]string{
+            "startDate": *backfillStartDate,
+            "endDate": *backfillEndDate,
+            "mgrsCodes": *backfillMgrsCodes,
+        })
+        if err != nil {
+            log.Fatal(err)
+        }
+        event := database.Event{
+            EventType: "BackfillIndexTask",
+            Priority: 5,
+            DedupKey: fmt.Sprintf("BackfillIndexTask/%s", request.Key()),
+            Data: request.Data(),
+        }
+        if err := database.SaveEvent(ctx, dbClient, &event); err != nil {
+            log.Fatal(err)
+        }
+        fmt.Println("- published backfill event:", event.ID.Hex(), "chunks:", len(request.Chunks()))
+
+    case "stac":
+        stacCmd.Parse(os.Args[2:])
+
+        dbClient, err := database.DefaultDatabaseClient(ctx)
+        if err != nil {
+            log.Fatal(err)
+        }
+        request, err := worker.ParseStacIndexRequest(map[string]string{
+            "startDate": *stacStartDate,
+            "endDate": *stacEndDate,
+            "bbox": *stacBbox,
+            "maxCloudCover": *stacMaxCloudCover,
+        })
+        if err != nil {
+            log.Fatal(err)
+        }
+        event := database.Event{
+            EventType: "StacIndexTask",
+            Priority: 5,
+            DedupKey: fmt.Sprintf("StacIndexTask/%s", request.Key()),
+            Data: request.Data(),
+        }
+        if err := database.SaveEvent(ctx, dbClient, &event); err != nil {
+            log.Fatal(err)
+        }
+        fmt.Println("- published stac index event:", event.ID.Hex())
+
     default:
-        log.Fatal("expected a subcommand like api or worker")
+        log.Fatal("expected a subcommand like api, worker, cancel, setting, workflow, backfill or stac")
+    }
+
+    disconnectCtx, disconnectCancel := context.WithTimeout(context.Background(), DISCONNECT_TIMEOUT)
+    defer disconnectCancel()
+    if err := database.Shutdown(disconnectCtx); err != nil {
+        log.Println(err)
     }
 }
 
@@ -195,6 +195,58 @@ def build_ndvi_maps_for_boundaries(data_dir: str, band_prefix: str, boundary_pre
                     raster_meta_file.write(json.dumps(raster_meta).encode("utf-8"))
 
 
+# scene classification labels without a usable ndvi value: no data, defective,
+# cloud shadows and medium and high probability clouds
+SCL_CLOUD_LABELS = [8, 9]
+SCL_INVALID_LABELS = [0, 1, 3, 8, 9]
+
+
+def compute_boundary_scene_stats(data_dir: str, band_prefix: str, boundary_prefix: str):
+    """
+    compute the percent of each boundary in the data directory covered by clouds
+    and by valid pixels in the scene classification layer. only the layer is needed
+    so the scene selection can compare scenes without downloading their bands.
+    """
+    if not os.path.isdir(data_dir):
+        raise Exception(f"not a valid data directory: {data_dir}")
+
+    bandSCL_path = os.path.join(data_dir, f"{band_prefix}SCL.tif")
+    if not os.path.isfile(bandSCL_path):
+        raise Exception(f"missing scene classification layer")
+
+    with rasterio.open(bandSCL_path) as bandSCL:
+        utm_crs = bandSCL.meta['crs']
+
+    for boundary_file_name in find_boundary_file_names(data_dir, boundary_prefix):
+        boundary_id = parse_boundary_id(boundary_file_name, boundary_prefix)
+        boundary_shape_utm = build_boundary_shape(
+            boundary_path=os.path.join(data_dir, boundary_file_name),
+            utm_projection=utm_crs,
+        )
+
+        # used 99 to represent data outside the boundary, a boundary
+        # outside the layer has no valid pixels
+        try:
+            with rasterio.open(bandSCL_path) as bandSCL:
+                bandSCL_data, _ = mask(bandSCL, [boundary_shape_utm], crop=True, nodata=99)
+            boundary_data = bandSCL_data[bandSCL_data != 99]
+        except ValueError:
+            boundary_data = np.array([])
+
+        cloud_percent = 0.0
+        valid_percent = 0.0
+        if boundary_data.size > 0:
+            cloud_percent = float(np.isin(boundary_data, SCL_CLOUD_LABELS).sum()) / float(boundary_data.size) * 100.0
+            valid_percent = float((~np.isin(boundary_data, SCL_INVALID_LABELS)).sum()) / float(boundary_data.size) * 100.0
+
+        scene_stat_path = os.path.join(data_dir, f"scene_stat_{boundary_id}.json")
+        with open(scene_stat_path, "wb") as scene_stat_file:
+            scene_stat_file.write(json.dumps({
+                "cloudPercent": round(cloud_percent, 8),
+                "validPercent": round(valid_percent, 8),
+            }).encode("utf-8"))
+
+
 def reproject_scl_layer_to_10_meter(scl_layer_path: str) -> str:
 
     if not scl_layer_path.endswith(".tif"):
@@ -248,6 +300,10 @@ if __name__ == "__main__":
         "boundary_prefix", metavar="BOUNDARY_PREFIX", type=str, nargs="?",
         help="the prefix of the boundary geojson files",
     )
+    parser.add_argument(
+        "--stats", action="store_true",
+        help="only compute the scene classification stats of the boundaries",
+    )
     args = parser.parse_args()
 
     if not args.data_dir or not args.band_prefix or not args.boundary_prefix:
@@ -255,13 +311,23 @@ if __name__ == "__main__":
         exit()
 
     try:
-        build_ndvi_maps_for_boundaries(
-            data_dir=args.data_dir,
-            band_prefix=args.band_prefix,
-            boundary_prefix=args.boundary_prefix,
-        )
+        if args.stats:
+            compute_boundary_scene_stats(
+                data_dir=args.data_dir,
+                band_prefix=args.band_prefix,
+                boundary_prefix=args.boundary_prefix,
+            )
+        else:
+            build_ndvi_maps_for_boundaries(
+                data_dir=args.data_dir,
+                band_prefix=args.band_prefix,
+                boundary_prefix=args.boundary_prefix,
+            )
     except Exception as err:
         print("had an error")
         print(err)
 
-    print("maps computed and written to the data directory")
+    if args.stats:
+        print("scene stats computed and written to the data directory")
+    else:
+        print("maps computed and written to the data directory")
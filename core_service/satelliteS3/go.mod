@@ -1,3 +1,5 @@
 module satelliteS3
 
+replace core_service/database => ../database
+
 go 1.18
\ No newline at end of file
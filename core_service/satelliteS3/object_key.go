@@ -0,0 +1,204 @@
+package satelliteS3
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ERROR_KEY_LAYOUT         = errors.New("Key is not laid out as zone/band/square/year/month/scene/file")
+	ERROR_UNKNOWN_SCENE_ID   = errors.New("Scene id has an unknown format")
+	ERROR_UNKNOWN_SATELLITE  = errors.New("Scene is from an unknown satellite")
+	ERROR_INVALID_SCENE_DATE = errors.New("Scene has an invalid sensing date")
+	ERROR_SCENE_MISMATCH     = errors.New("Scene id does not match the key's tile or month")
+)
+
+// the satellites of the sentinel 2 constellation
+var SENTINEL_2_SATELLITES = map[string]bool{"S2A": true, "S2B": true, "S2C": true, "S2D": true}
+
+// products of processing baseline 05.00 and later belong to the
+// reprocessed collection 1
+const COLLECTION_1_PROCESSING_BASELINE = "05.00"
+
+var (
+	processingLevelExpression    = regexp.MustCompile(`^L[12][A-C]$`)
+	processingBaselineExpression = regexp.MustCompile(`^N(\d{2})(\d{2})$`)
+	tileExpression               = regexp.MustCompile(`^T?0?([1-9]|[1-5]\d|60)([C-HJ-NP-X][A-HJ-NP-Z][A-HJ-NP-V])$`)
+)
+
+// ObjectKeyError is returned for keys which can't be parsed, Err is one
+// of the ERROR_ values of this file.
+type ObjectKeyError struct {
+	Key string
+	Err error
+}
+
+func (m *ObjectKeyError) Error() string {
+	return fmt.Sprintf("Object key '%s': %s", m.Key, m.Err)
+}
+
+func (m *ObjectKeyError) Unwrap() error {
+	return m.Err
+}
+
+// SceneKey is a parsed key of a sentinel 2 cog file, like
+// sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif
+type SceneKey struct {
+	Key string
+	// the segments before the zone, like sentinel-s2-l2a-cogs
+	Prefix string
+	// the zone and latitude band, like 39P
+	UtmZone string
+	// the zone without a leading zero and the square, like 39PUL
+	MgrsCode        string
+	SceneId         string
+	FileName        string
+	Satellite       string
+	ProcessingLevel string
+	// the date of the scene, with the time when the scene id has it
+	SensingDate time.Time
+	// the sequence of legacy scene ids, zero for other ids
+	Sequence int
+	// like 05.10, only known for product ids
+	ProcessingBaseline string
+	// 1 for reprocessed collection 1 products, 0 otherwise
+	Collection int
+}
+
+// ParseSceneKey parses the key of a file in a scene's directory. The
+// scene directory can be named with
+//   - a legacy scene id: S2A_39PUL_20190914_0_L2A
+//   - a collection 1 scene id: S2B_T10TFR_20231223T190950_L2A
+//   - a product id: S2A_MSIL2A_20190914T063511_N0213_R134_T39PUL_20190914T092253
+//
+// Keys which can't be parsed return an *ObjectKeyError.
+func ParseSceneKey(key string) (*SceneKey, error) {
+	keyItems := strings.Split(key, "/")
+	if len(keyItems) < 8 {
+		return nil, &ObjectKeyError{Key: key, Err: ERROR_KEY_LAYOUT}
+	}
+	// newer layouts have a deeper prefix, the scene directories always
+	// end the key the same way
+	pathItems := keyItems[len(keyItems)-7:]
+	zone, band, square, year, month := pathItems[0], pathItems[1], pathItems[2], pathItems[3], pathItems[4]
+
+	tileItems := tileExpression.FindStringSubmatch(zone + band + square)
+	pathYear, yearErr := strconv.Atoi(year)
+	pathMonth, monthErr := strconv.Atoi(month)
+	if tileItems == nil || len(band) != 1 || len(square) != 2 || yearErr != nil || monthErr != nil || pathItems[6] == "" {
+		return nil, &ObjectKeyError{Key: key, Err: ERROR_KEY_LAYOUT}
+	}
+
+	sceneKey := SceneKey{
+		Key:      key,
+		Prefix:   strings.Join(keyItems[:len(keyItems)-7], "/"),
+		UtmZone:  tileItems[1] + band,
+		MgrsCode: tileItems[1] + tileItems[2],
+		SceneId:  pathItems[5],
+		FileName: pathItems[6],
+	}
+	sceneTile, err := sceneKey.parseSceneId()
+	if err != nil {
+		return nil, &ObjectKeyError{Key: key, Err: err}
+	}
+
+	if !SENTINEL_2_SATELLITES[sceneKey.Satellite] {
+		return nil, &ObjectKeyError{Key: key, Err: ERROR_UNKNOWN_SATELLITE}
+	}
+	if sceneTileItems := tileExpression.FindStringSubmatch(sceneTile); sceneTileItems == nil || sceneTileItems[1]+sceneTileItems[2] != sceneKey.MgrsCode {
+		return nil, &ObjectKeyError{Key: key, Err: ERROR_SCENE_MISMATCH}
+	}
+	if sceneKey.SensingDate.Year() != pathYear || int(sceneKey.SensingDate.Month()) != pathMonth {
+		return nil, &ObjectKeyError{Key: key, Err: ERROR_SCENE_MISMATCH}
+	}
+	return &sceneKey, nil
+}
+
+// parseSceneId fills in the fields held by the scene id and returns the
+// tile written in it.
+func (obj *SceneKey) parseSceneId() (string, error) {
+	idItems := strings.Split(obj.SceneId, "_")
+	obj.Satellite = idItems[0]
+
+	var sceneTile, sensingDate, sensingDateFormat string
+	switch {
+	case len(idItems) == 5:
+		sequence, err := strconv.Atoi(idItems[3])
+		if err != nil || sequence < 0 {
+			return "", ERROR_UNKNOWN_SCENE_ID
+		}
+		sceneTile, sensingDate, sensingDateFormat = idItems[1], idItems[2], "20060102"
+		obj.Sequence = sequence
+		obj.ProcessingLevel = idItems[4]
+	case len(idItems) == 4 && strings.HasPrefix(idItems[1], "T"):
+		sceneTile, sensingDate, sensingDateFormat = idItems[1], idItems[2], "20060102T150405"
+		obj.ProcessingLevel = idItems[3]
+		obj.Collection = 1
+	case len(idItems) == 7 && strings.HasPrefix(idItems[1], "MSI"):
+		baselineItems := processingBaselineExpression.FindStringSubmatch(idItems[3])
+		if baselineItems == nil || !strings.HasPrefix(idItems[4], "R") {
+			return "", ERROR_UNKNOWN_SCENE_ID
+		}
+		sceneTile, sensingDate, sensingDateFormat = idItems[5], idItems[2], "20060102T150405"
+		obj.ProcessingLevel = strings.TrimPrefix(idItems[1], "MSI")
+		obj.ProcessingBaseline = baselineItems[1] + "." + baselineItems[2]
+		if obj.ProcessingBaseline >= COLLECTION_1_PROCESSING_BASELINE {
+			obj.Collection = 1
+		}
+	default:
+		return "", ERROR_UNKNOWN_SCENE_ID
+	}
+
+	if !processingLevelExpression.MatchString(obj.ProcessingLevel) {
+		return "", ERROR_UNKNOWN_SCENE_ID
+	}
+	date, err := time.Parse(sensingDateFormat, sensingDate)
+	if err != nil {
+		return "", ERROR_INVALID_SCENE_DATE
+	}
+	obj.SensingDate = date
+	return sceneTile, nil
+}
+
+// SourceSatellite is the satellite and processing level, like S2A-L2A.
+func (obj *SceneKey) SourceSatellite() string {
+	return fmt.Sprintf("%s-%s", obj.Satellite, obj.ProcessingLevel)
+}
+
+// Date is the day the scene was sensed.
+func (obj *SceneKey) Date() time.Time {
+	return time.Date(obj.SensingDate.Year(), obj.SensingDate.Month(), obj.SensingDate.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Scene is the scene of the key, without any of its files.
+func (obj *SceneKey) Scene() Scene {
+	return Scene{
+		Date:            obj.Date(),
+		MgrsCode:        obj.MgrsCode,
+		SourceSatellite: obj.SourceSatellite(),
+	}
+}
+
+// SceneFile is the file of the key in its scene.
+func (obj *SceneKey) SceneFile(size int) SceneFile {
+	fileUse := "satBand"
+	if obj.IsMetadata() {
+		fileUse = "jsonMeta"
+	}
+	return SceneFile{
+		FileUse:    fileUse,
+		Band:       obj.FileName,
+		Version:    obj.Sequence,
+		Size:       size,
+		ObjectPath: obj.Key,
+	}
+}
+
+// IsMetadata reports if the file is the scene's json metadata.
+func (obj *SceneKey) IsMetadata() bool {
+	return obj.FileName == obj.SceneId+".json"
+}
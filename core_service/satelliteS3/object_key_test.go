@@ -0,0 +1,165 @@
+package satelliteS3
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseSceneKey(t *testing.T) {
+	testCases := []struct {
+		key      string
+		expected SceneKey
+	}{
+		{
+			key: "sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif",
+			expected: SceneKey{
+				Prefix:          "sentinel-s2-l2a-cogs",
+				UtmZone:         "39P",
+				MgrsCode:        "39PUL",
+				SceneId:         "S2A_39PUL_20190914_0_L2A",
+				FileName:        "B04.tif",
+				Satellite:       "S2A",
+				ProcessingLevel: "L2A",
+				SensingDate:     time.Date(2019, time.Month(9), 14, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			key: "sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/S2A_39PUL_20190914_0_L2A.json",
+			expected: SceneKey{
+				Prefix:          "sentinel-s2-l2a-cogs",
+				UtmZone:         "39P",
+				MgrsCode:        "39PUL",
+				SceneId:         "S2A_39PUL_20190914_0_L2A",
+				FileName:        "S2A_39PUL_20190914_0_L2A.json",
+				Satellite:       "S2A",
+				ProcessingLevel: "L2A",
+				SensingDate:     time.Date(2019, time.Month(9), 14, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			// scenes processed again get the next sequence
+			key: "sentinel-s2-l2a-cogs/4/Q/FJ/2021/7/S2B_4QFJ_20210703_1_L2A/B08.tif",
+			expected: SceneKey{
+				Prefix:          "sentinel-s2-l2a-cogs",
+				UtmZone:         "4Q",
+				MgrsCode:        "4QFJ",
+				SceneId:         "S2B_4QFJ_20210703_1_L2A",
+				FileName:        "B08.tif",
+				Satellite:       "S2B",
+				ProcessingLevel: "L2A",
+				SensingDate:     time.Date(2021, time.Month(7), 3, 0, 0, 0, 0, time.UTC),
+				Sequence:        1,
+			},
+		},
+		{
+			key: "sentinel-s2-l2a-cogs/15/T/UL/2025/3/S2C_15TUL_20250317_0_L2A/B04.tif",
+			expected: SceneKey{
+				Prefix:          "sentinel-s2-l2a-cogs",
+				UtmZone:         "15T",
+				MgrsCode:        "15TUL",
+				SceneId:         "S2C_15TUL_20250317_0_L2A",
+				FileName:        "B04.tif",
+				Satellite:       "S2C",
+				ProcessingLevel: "L2A",
+				SensingDate:     time.Date(2025, time.Month(3), 17, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			key: "sentinel-2-c1-l2a/10/T/FR/2023/12/S2B_T10TFR_20231223T190950_L2A/B04.tif",
+			expected: SceneKey{
+				Prefix:          "sentinel-2-c1-l2a",
+				UtmZone:         "10T",
+				MgrsCode:        "10TFR",
+				SceneId:         "S2B_T10TFR_20231223T190950_L2A",
+				FileName:        "B04.tif",
+				Satellite:       "S2B",
+				ProcessingLevel: "L2A",
+				SensingDate:     time.Date(2023, time.Month(12), 23, 19, 9, 50, 0, time.UTC),
+				Collection:      1,
+			},
+		},
+		{
+			key: "sentinel-2-c1-l2a/10/T/FR/2023/12/S2B_MSIL2A_20231223T190759_N0510_R056_T10TFR_20240624T193421/B04.tif",
+			expected: SceneKey{
+				Prefix:             "sentinel-2-c1-l2a",
+				UtmZone:            "10T",
+				MgrsCode:           "10TFR",
+				SceneId:            "S2B_MSIL2A_20231223T190759_N0510_R056_T10TFR_20240624T193421",
+				FileName:           "B04.tif",
+				Satellite:          "S2B",
+				ProcessingLevel:    "L2A",
+				SensingDate:        time.Date(2023, time.Month(12), 23, 19, 7, 59, 0, time.UTC),
+				ProcessingBaseline: "05.10",
+				Collection:         1,
+			},
+		},
+		{
+			key: "products/39/P/UL/2019/9/S2A_MSIL2A_20190914T063511_N0213_R134_T39PUL_20190914T092253/B04.tif",
+			expected: SceneKey{
+				Prefix:             "products",
+				UtmZone:            "39P",
+				MgrsCode:           "39PUL",
+				SceneId:            "S2A_MSIL2A_20190914T063511_N0213_R134_T39PUL_20190914T092253",
+				FileName:           "B04.tif",
+				Satellite:          "S2A",
+				ProcessingLevel:    "L2A",
+				SensingDate:        time.Date(2019, time.Month(9), 14, 6, 35, 11, 0, time.UTC),
+				ProcessingBaseline: "02.13",
+			},
+		},
+		{
+			// padded zones and deeper prefixes are read the same way
+			key: "mirror/sentinel-s2-l2a-cogs/04/Q/FJ/2021/07/S2B_04QFJ_20210703_0_L2A/B04.tif",
+			expected: SceneKey{
+				Prefix:          "mirror/sentinel-s2-l2a-cogs",
+				UtmZone:         "4Q",
+				MgrsCode:        "4QFJ",
+				SceneId:         "S2B_04QFJ_20210703_0_L2A",
+				FileName:        "B04.tif",
+				Satellite:       "S2B",
+				ProcessingLevel: "L2A",
+				SensingDate:     time.Date(2021, time.Month(7), 3, 0, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		sceneKey, err := ParseSceneKey(testCase.key)
+		if err != nil {
+			t.Errorf("unable to parse %s: %v", testCase.key, err)
+			continue
+		}
+		testCase.expected.Key = testCase.key
+		if *sceneKey != testCase.expected {
+			t.Errorf("expected %+v but found %+v", testCase.expected, *sceneKey)
+		}
+	}
+}
+
+func TestParseSceneKeyErrors(t *testing.T) {
+	testCases := []struct {
+		key string
+		err error
+	}{
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A", ERROR_KEY_LAYOUT},
+		{"sentinel-s2-l2a-cogs/39/PU/L/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif", ERROR_KEY_LAYOUT},
+		{"sentinel-s2-l2a-cogs/61/P/UL/2019/9/S2A_61PUL_20190914_0_L2A/B04.tif", ERROR_KEY_LAYOUT},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_L2A_extra_parts/B04.tif", ERROR_UNKNOWN_SCENE_ID},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_x_L2A/B04.tif", ERROR_UNKNOWN_SCENE_ID},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L3A/B04.tif", ERROR_UNKNOWN_SCENE_ID},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S1A_39PUL_20190914_0_L2A/B04.tif", ERROR_UNKNOWN_SATELLITE},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190931_0_L2A/B04.tif", ERROR_INVALID_SCENE_DATE},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PTL_20190914_0_L2A/B04.tif", ERROR_SCENE_MISMATCH},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/10/S2A_39PUL_20190914_0_L2A/B04.tif", ERROR_SCENE_MISMATCH},
+	}
+	for _, testCase := range testCases {
+		_, err := ParseSceneKey(testCase.key)
+		if !errors.Is(err, testCase.err) {
+			t.Errorf("expected %s to fail with %v but found %v", testCase.key, testCase.err, err)
+		}
+		var keyErr *ObjectKeyError
+		if !errors.As(err, &keyErr) || keyErr.Key != testCase.key {
+			t.Errorf("expected an object key error for %s but found %v", testCase.key, err)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"strings"
 	"context"
+	"time"
 
 	db "core_service/database"
 
@@ -79,20 +80,27 @@ func S3Session(ctx context.Context, sourceBucket string) (*s3.Client, error) {
 }
 
 func GetObject(ctx context.Context, localPath, objectPath, sourceBucket string) error {
+	_, err := DownloadObject(ctx, localPath, objectPath, sourceBucket)
+	return err
+}
+
+// DownloadObject is GetObject which also returns the number of bytes
+// downloaded.
+func DownloadObject(ctx context.Context, localPath, objectPath, sourceBucket string) (int64, error) {
 	log.Printf("GET %s %s\n", sourceBucket, objectPath)
 
 	if sourceBucket != SATELLITE_S3_IMAGE_BUCKET && sourceBucket != SATELLITE_S3_INVENTORY_BUCKET {
-		return &UnknownBucketError{bucketName: sourceBucket}
+		return 0, &UnknownBucketError{bucketName: sourceBucket}
 	}
 
 	s3Session, err := S3Session(ctx, sourceBucket)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	file, fileErr := os.Create(localPath)
 	if fileErr != nil {
-		return fileErr
+		return 0, fileErr
 	}
 	defer file.Close()
 
@@ -106,10 +114,51 @@ func GetObject(ctx context.Context, localPath, objectPath, sourceBucket string)
 	})
 	if err != nil {
 		log.Printf("Unable to download: %v\n", err)
-		return err
+		return numBytes, err
 	}
 
 	log.Println("Downloaded", file.Name(), numBytes / 1_000_000, "MB")
-	return nil
+	return numBytes, nil
+}
+
+// ObjectSummary is an object found by ListObjects.
+type ObjectSummary struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
 }
 
+// ListObjects returns every object in the bucket whose key starts with
+// the prefix, following the pages of the listing.
+func ListObjects(ctx context.Context, prefix, sourceBucket string) ([]ObjectSummary, error) {
+	log.Printf("LIST %s %s\n", sourceBucket, prefix)
+
+	if sourceBucket != SATELLITE_S3_IMAGE_BUCKET && sourceBucket != SATELLITE_S3_INVENTORY_BUCKET {
+		return nil, &UnknownBucketError{bucketName: sourceBucket}
+	}
+
+	s3Session, err := S3Session(ctx, sourceBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]ObjectSummary, 0)
+	paginator := s3.NewListObjectsV2Paginator(s3Session, &s3.ListObjectsV2Input{
+		Bucket: aws.String(sourceBucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectSummary{
+				Key:          aws.ToString(object.Key),
+				Size:         object.Size,
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
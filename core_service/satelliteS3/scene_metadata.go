@@ -0,0 +1,91 @@
+package satelliteS3
+
+import (
+	"strings"
+	"time"
+)
+
+// Scene groups the files of one scene, the worker stores it as a tile.
+type Scene struct {
+	// the day the scene was sensed
+	Date            time.Time
+	MgrsCode        string
+	SourceSatellite string
+	// the scene's polygon, the type is empty when it isn't known
+	Geometry SceneGeometry
+	Files    []SceneFile
+	SceneMetadata
+}
+
+// SceneGeometry is a GeoJSON polygon.
+type SceneGeometry struct {
+	Coordinates [][][]float64 `json:"coordinates"`
+	Type        string        `json:"type"`
+}
+
+type SceneFile struct {
+	// satBand or jsonMeta
+	FileUse    string
+	Band       string
+	Version    int
+	Size       int
+	ObjectPath string
+}
+
+// SceneMetadata describes the whole scene rather than one of its files.
+type SceneMetadata struct {
+	// percentages of the scene
+	CloudCover   *float64
+	DataCoverage *float64
+	// in degrees
+	SunElevation       *float64
+	SunAzimuth         *float64
+	ProcessingBaseline string
+	ProductId          string
+}
+
+// SceneProperties are the scene level properties of a STAC item. The json
+// metadata next to each scene's files is the item of the older catalog,
+// so both are read the same way. Older items have the sentinel: fields
+// and newer ones the s2: and view: fields.
+type SceneProperties struct {
+	CloudCover         *float64 `json:"eo:cloud_cover"`
+	DataCoverage       *float64 `json:"sentinel:data_coverage"`
+	NodataPercentage   *float64 `json:"s2:nodata_pixel_percentage"`
+	SunElevation       *float64 `json:"view:sun_elevation"`
+	SunAzimuth         *float64 `json:"view:sun_azimuth"`
+	ProcessingBaseline string   `json:"s2:processing_baseline"`
+	SentinelProductId  string   `json:"sentinel:product_id"`
+	ProductUri         string   `json:"s2:product_uri"`
+}
+
+// SceneMetadata is the scene metadata from the properties, the
+// processing baseline is read from the product id when the properties
+// don't have it.
+func (obj *SceneProperties) SceneMetadata() SceneMetadata {
+	sceneMetadata := SceneMetadata{
+		CloudCover:         obj.CloudCover,
+		DataCoverage:       obj.DataCoverage,
+		SunElevation:       obj.SunElevation,
+		SunAzimuth:         obj.SunAzimuth,
+		ProcessingBaseline: obj.ProcessingBaseline,
+		ProductId:          obj.SentinelProductId,
+	}
+	if sceneMetadata.DataCoverage == nil && obj.NodataPercentage != nil {
+		dataCoverage := 100 - *obj.NodataPercentage
+		sceneMetadata.DataCoverage = &dataCoverage
+	}
+	if sceneMetadata.ProductId == "" {
+		sceneMetadata.ProductId = strings.TrimSuffix(obj.ProductUri, ".SAFE")
+	}
+	if sceneMetadata.ProcessingBaseline == "" {
+		// product ids are like S2A_MSIL2A_20190914T063511_N0213_R134_T39PUL_20190914T092253
+		idItems := strings.Split(sceneMetadata.ProductId, "_")
+		if len(idItems) == 7 {
+			if baselineItems := processingBaselineExpression.FindStringSubmatch(idItems[3]); baselineItems != nil {
+				sceneMetadata.ProcessingBaseline = baselineItems[1] + "." + baselineItems[2]
+			}
+		}
+	}
+	return sceneMetadata
+}
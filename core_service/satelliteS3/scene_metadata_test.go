@@ -0,0 +1,63 @@
+package satelliteS3
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSceneMetadata(t *testing.T) {
+	testCases := []struct {
+		properties         string
+		cloudCover         float64
+		dataCoverage       float64
+		sunElevation       float64
+		processingBaseline string
+		productId          string
+	}{
+		{
+			properties:         `{"eo:cloud_cover": 3.12, "sentinel:data_coverage": 87.41, "sentinel:product_id": "S2A_MSIL2A_20190914T063511_N0213_R134_T39PUL_20190914T092253"}`,
+			cloudCover:         3.12,
+			dataCoverage:       87.41,
+			processingBaseline: "02.13",
+			productId:          "S2A_MSIL2A_20190914T063511_N0213_R134_T39PUL_20190914T092253",
+		},
+		{
+			properties:         `{"eo:cloud_cover": 0, "s2:nodata_pixel_percentage": 35.5, "view:sun_elevation": 19.8, "s2:processing_baseline": "05.10", "s2:product_uri": "S2B_MSIL2A_20231223T190759_N0510_R056_T10TFR_20231223T213227.SAFE"}`,
+			cloudCover:         0,
+			dataCoverage:       64.5,
+			sunElevation:       19.8,
+			processingBaseline: "05.10",
+			productId:          "S2B_MSIL2A_20231223T190759_N0510_R056_T10TFR_20231223T213227",
+		},
+	}
+	for _, testCase := range testCases {
+		var properties SceneProperties
+		if err := json.Unmarshal([]byte(testCase.properties), &properties); err != nil {
+			t.Fatal(err)
+		}
+		sceneMetadata := properties.SceneMetadata()
+		if sceneMetadata.CloudCover == nil || *sceneMetadata.CloudCover != testCase.cloudCover {
+			t.Errorf("expected the cloud cover %f of %s", testCase.cloudCover, testCase.properties)
+		}
+		if sceneMetadata.DataCoverage == nil || *sceneMetadata.DataCoverage != testCase.dataCoverage {
+			t.Errorf("expected the data coverage %f of %s", testCase.dataCoverage, testCase.properties)
+		}
+		if testCase.sunElevation == 0 && sceneMetadata.SunElevation != nil {
+			t.Errorf("expected no sun elevation for %s", testCase.properties)
+		} else if testCase.sunElevation != 0 && (sceneMetadata.SunElevation == nil || *sceneMetadata.SunElevation != testCase.sunElevation) {
+			t.Errorf("expected the sun elevation %f of %s", testCase.sunElevation, testCase.properties)
+		}
+		if sceneMetadata.ProcessingBaseline != testCase.processingBaseline || sceneMetadata.ProductId != testCase.productId {
+			t.Errorf("expected the product %s at baseline %s but found %+v", testCase.productId, testCase.processingBaseline, sceneMetadata)
+		}
+	}
+
+	// missing values stay unknown
+	var properties SceneProperties
+	if err := json.Unmarshal([]byte(`{}`), &properties); err != nil {
+		t.Fatal(err)
+	}
+	if sceneMetadata := properties.SceneMetadata(); sceneMetadata.CloudCover != nil || sceneMetadata.DataCoverage != nil || sceneMetadata.ProcessingBaseline != "" {
+		t.Errorf("expected no scene metadata but found %+v", sceneMetadata)
+	}
+}
@@ -0,0 +1,279 @@
+package satelliteS3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ERROR_STAC_RESPONSE       = errors.New("STAC search returned an error")
+	ERROR_STAC_TOO_MANY_PAGES = errors.New("STAC search returned too many pages")
+	ERROR_STAC_ASSET_LOCATION = errors.New("STAC asset is not in the image bucket")
+)
+
+var (
+	// the STAC api searched by the stac index, overridden with the
+	// STAC_SEARCH_URL environment variable
+	STAC_SEARCH_URL = "https://earth-search.aws.element84.com/v1"
+	// the collection of the sentinel 2 cogs in the image bucket
+	STAC_COLLECTION = "sentinel-2-l2a"
+)
+
+const (
+	STAC_PAGE_SIZE = 100
+	// a search of a year over a few squares is well under a hundred
+	// pages, more likely means the next links loop
+	STAC_MAX_PAGES = 1000
+	STAC_TIMEOUT   = 60 * time.Second
+)
+
+func init() {
+	if stacSearchUrl := os.Getenv("STAC_SEARCH_URL"); stacSearchUrl != "" {
+		STAC_SEARCH_URL = stacSearchUrl
+	}
+}
+
+// StacSearch is the body of a STAC item search, both dates are included.
+type StacSearch struct {
+	Bbox      [4]float64
+	StartDate time.Time
+	EndDate   time.Time
+	// scenes with more cloud cover are left out, unless it is nil
+	MaxCloudCover *float64
+}
+
+func (obj *StacSearch) body() map[string]interface{} {
+	endDate := obj.EndDate.AddDate(0, 0, 1).Add(-time.Second)
+	body := map[string]interface{}{
+		"collections": []string{STAC_COLLECTION},
+		"bbox":        obj.Bbox[:],
+		"datetime":    fmt.Sprintf("%s/%s", obj.StartDate.UTC().Format(time.RFC3339), endDate.UTC().Format(time.RFC3339)),
+		"limit":       STAC_PAGE_SIZE,
+	}
+	if obj.MaxCloudCover != nil {
+		body["query"] = map[string]interface{}{
+			"eo:cloud_cover": map[string]float64{"lte": *obj.MaxCloudCover},
+		}
+	}
+	return body
+}
+
+type StacAsset struct {
+	Href  string `json:"href"`
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	// only given by some catalogs
+	FileSize int `json:"file:size"`
+}
+
+type StacItemProperties struct {
+	Datetime time.Time `json:"datetime"`
+	SceneProperties
+}
+
+type StacItem struct {
+	Id         string               `json:"id"`
+	Collection string               `json:"collection"`
+	Bbox       []float64            `json:"bbox"`
+	Geometry   json.RawMessage      `json:"geometry"`
+	Properties StacItemProperties   `json:"properties"`
+	Assets     map[string]StacAsset `json:"assets"`
+}
+
+type StacLink struct {
+	Rel    string                 `json:"rel"`
+	Href   string                 `json:"href"`
+	Method string                 `json:"method"`
+	Body   map[string]interface{} `json:"body"`
+	// the body is merged into the previous request's body
+	Merge bool `json:"merge"`
+}
+
+type StacItemCollection struct {
+	Type     string     `json:"type"`
+	Features []StacItem `json:"features"`
+	Links    []StacLink `json:"links"`
+}
+
+func (obj *StacItemCollection) nextLink() *StacLink {
+	for i := range obj.Links {
+		if obj.Links[i].Rel == "next" {
+			return &obj.Links[i]
+		}
+	}
+	return nil
+}
+
+// StacClient searches the items of a STAC api.
+type StacClient struct {
+	Url        string
+	HttpClient *http.Client
+}
+
+func NewStacClient(stacUrl string) *StacClient {
+	return &StacClient{
+		Url:        strings.TrimSuffix(stacUrl, "/"),
+		HttpClient: &http.Client{Timeout: STAC_TIMEOUT},
+	}
+}
+
+// Search posts the search and hands each page of items to handlePage,
+// following the next links until the last page.
+func (obj *StacClient) Search(ctx context.Context, search StacSearch, handlePage func([]StacItem) error) error {
+	method, href, body := http.MethodPost, obj.Url+"/search", search.body()
+	for page := 0; ; page++ {
+		if page == STAC_MAX_PAGES {
+			return ERROR_STAC_TOO_MANY_PAGES
+		}
+
+		itemCollection, err := obj.requestPage(ctx, method, href, body)
+		if err != nil {
+			return err
+		}
+		if err := handlePage(itemCollection.Features); err != nil {
+			return err
+		}
+
+		next := itemCollection.nextLink()
+		if next == nil || len(itemCollection.Features) == 0 {
+			return nil
+		}
+		method, href = http.MethodGet, next.Href
+		if next.Method != "" {
+			method = strings.ToUpper(next.Method)
+		}
+		if next.Merge {
+			for key, value := range next.Body {
+				body[key] = value
+			}
+		} else {
+			body = next.Body
+		}
+	}
+}
+
+func (obj *StacClient) requestPage(ctx context.Context, method, href string, body map[string]interface{}) (*StacItemCollection, error) {
+	var requestBody io.Reader
+	if method == http.MethodPost {
+		bodyData, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		requestBody = bytes.NewReader(bodyData)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, href, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/geo+json")
+	if requestBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := obj.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	responseData, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s %s", ERROR_STAC_RESPONSE, response.Status, strings.TrimSpace(string(responseData)))
+	}
+
+	var itemCollection StacItemCollection
+	if err := json.Unmarshal(responseData, &itemCollection); err != nil {
+		return nil, err
+	}
+	return &itemCollection, nil
+}
+
+// assetObjectKey reads the object key out of an asset href in the bucket,
+// like s3://sentinel-cogs/<key> or
+// https://sentinel-cogs.s3.us-west-2.amazonaws.com/<key>.
+func assetObjectKey(href, bucket string) (string, error) {
+	assetUrl, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ERROR_STAC_ASSET_LOCATION, href)
+	}
+	objectPath := strings.TrimPrefix(assetUrl.Path, "/")
+	switch {
+	case assetUrl.Scheme == "s3" && assetUrl.Host == bucket:
+		return objectPath, nil
+	case (assetUrl.Scheme == "https" || assetUrl.Scheme == "http") && strings.HasPrefix(assetUrl.Host, bucket+"."):
+		return objectPath, nil
+	case (assetUrl.Scheme == "https" || assetUrl.Scheme == "http") && strings.HasPrefix(objectPath, bucket+"/"):
+		return strings.TrimPrefix(objectPath, bucket+"/"), nil
+	}
+	return "", fmt.Errorf("%w: %s", ERROR_STAC_ASSET_LOCATION, href)
+}
+
+// Scene builds the scene of the item with a file for each asset named in
+// tileFiles and for the scene's json metadata. The scene gets the item's
+// metadata and its geometry when it is a polygon. Assets outside of the bucket can't be
+// read by the map builds, so they fail the item.
+func (obj *StacItem) Scene(bucket string, tileFiles map[string]bool) (*Scene, error) {
+	assetNames := make([]string, 0, len(obj.Assets))
+	for assetName := range obj.Assets {
+		assetNames = append(assetNames, assetName)
+	}
+	sort.Strings(assetNames)
+
+	var scene *Scene
+	var sceneId string
+	for _, assetName := range assetNames {
+		asset := obj.Assets[assetName]
+		fileName := path.Base(asset.Href)
+		if !tileFiles[fileName] && path.Ext(fileName) != ".json" {
+			continue
+		}
+
+		objectPath, err := assetObjectKey(asset.Href, bucket)
+		if err != nil {
+			return nil, err
+		}
+		sceneKey, err := ParseSceneKey(objectPath)
+		if err != nil {
+			return nil, err
+		}
+		if !tileFiles[sceneKey.FileName] && !sceneKey.IsMetadata() {
+			continue
+		}
+
+		if scene == nil {
+			keyScene := sceneKey.Scene()
+			scene, sceneId = &keyScene, sceneKey.SceneId
+		} else if sceneKey.SceneId != sceneId {
+			return nil, &ObjectKeyError{Key: objectPath, Err: ERROR_SCENE_MISMATCH}
+		}
+
+		scene.Files = append(scene.Files, sceneKey.SceneFile(asset.FileSize))
+	}
+	if scene == nil {
+		return nil, nil
+	}
+	scene.SceneMetadata = obj.Properties.SceneMetadata()
+
+	// items crossing the antimeridian are multi polygons, their tiles get
+	// the geometry of the json metadata instead
+	var geometry SceneGeometry
+	if err := json.Unmarshal(obj.Geometry, &geometry); err == nil && geometry.Type == "Polygon" {
+		scene.Geometry = geometry
+	}
+	return scene, nil
+}
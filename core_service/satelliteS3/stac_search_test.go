@@ -0,0 +1,187 @@
+package satelliteS3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stacStub serves the canned search pages, the page 1 next link points
+// back at the stub.
+func stacStub(t *testing.T, requestBodies *[]map[string]interface{}) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/search" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*requestBodies = append(*requestBodies, body)
+
+		pageFile := "example_data/stac-search-page-1.json"
+		if body["next"] == "page-2" {
+			pageFile = "example_data/stac-search-page-2.json"
+		}
+		pageData, err := os.ReadFile(pageFile)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/geo+json")
+		w.Write([]byte(strings.ReplaceAll(string(pageData), "STAC_URL", server.URL)))
+	}))
+	return server
+}
+
+func stacStubItems(t *testing.T) []StacItem {
+	items := make([]StacItem, 0)
+	for _, pageFile := range []string{"example_data/stac-search-page-1.json", "example_data/stac-search-page-2.json"} {
+		pageData, err := os.ReadFile(pageFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var itemCollection StacItemCollection
+		if err := json.Unmarshal(pageData, &itemCollection); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, itemCollection.Features...)
+	}
+	return items
+}
+
+func TestStacSearch(t *testing.T) {
+	requestBodies := make([]map[string]interface{}, 0)
+	server := stacStub(t, &requestBodies)
+	defer server.Close()
+
+	maxCloudCover := 20.0
+	search := StacSearch{
+		Bbox:          [4]float64{-94, 44, -92, 46},
+		StartDate:     time.Date(2023, time.Month(1), 1, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2023, time.Month(12), 31, 0, 0, 0, 0, time.UTC),
+		MaxCloudCover: &maxCloudCover,
+	}
+	itemIds := make([]string, 0)
+	err := NewStacClient(server.URL+"/").Search(context.Background(), search, func(items []StacItem) error {
+		for _, item := range items {
+			itemIds = append(itemIds, item.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedIds := []string{"S2B_10TFR_20231223_0_L2A", "S2A_39PUL_20190914_0_L2A", "S2A_1CCV_20230105_0_L2A", "S2C_15TUL_20250317_0_L2A"}
+	if !reflect.DeepEqual(itemIds, expectedIds) {
+		t.Errorf("expected the items %v but found %v", expectedIds, itemIds)
+	}
+	if len(requestBodies) != 2 {
+		t.Fatalf("expected 2 search requests but found %d", len(requestBodies))
+	}
+	if datetime := requestBodies[0]["datetime"]; datetime != "2023-01-01T00:00:00Z/2023-12-31T23:59:59Z" {
+		t.Errorf("unexpected datetime %v", datetime)
+	}
+	if query, _ := json.Marshal(requestBodies[0]["query"]); string(query) != `{"eo:cloud_cover":{"lte":20}}` {
+		t.Errorf("unexpected query %s", query)
+	}
+	// the next link is merged into the search
+	if !reflect.DeepEqual(requestBodies[1]["bbox"], []interface{}{-94.0, 44.0, -92.0, 46.0}) || requestBodies[1]["next"] != "page-2" {
+		t.Errorf("expected the second request to page the same search but found %v", requestBodies[1])
+	}
+
+	// errors of the api fail the search
+	stopErr := errors.New("stop")
+	err = NewStacClient(server.URL+"/missing").Search(context.Background(), search, func(items []StacItem) error {
+		return nil
+	})
+	if !errors.Is(err, ERROR_STAC_RESPONSE) {
+		t.Errorf("expected a response error but found %v", err)
+	}
+	err = NewStacClient(server.URL).Search(context.Background(), search, func(items []StacItem) error {
+		return stopErr
+	})
+	if err != stopErr {
+		t.Errorf("expected the page error but found %v", err)
+	}
+}
+
+func TestStacItemScene(t *testing.T) {
+	items := stacStubItems(t)
+	tileFiles := map[string]bool{"B04.tif": true}
+
+	scene, err := items[0].Scene("sentinel-cogs", tileFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scene.MgrsCode != "10TFR" || scene.SourceSatellite != "S2B-L2A" || !scene.Date.Equal(time.Date(2023, time.Month(12), 23, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected scene %v", scene)
+	}
+	if scene.Geometry.Type != "Polygon" || len(scene.Geometry.Coordinates[0]) != 5 {
+		t.Errorf("expected the item's polygon but found %v", scene.Geometry)
+	}
+	if scene.CloudCover == nil || *scene.CloudCover != 12.4 || scene.SunAzimuth == nil || *scene.SunAzimuth != 163.2 || scene.ProcessingBaseline != "05.10" {
+		t.Errorf("expected the item's scene metadata but found %+v", scene.SceneMetadata)
+	}
+	// the tileinfo json is not the scene's metadata
+	if len(scene.Files) != 1 || scene.Files[0].Band != "B04.tif" || scene.Files[0].Size != 218437112 || scene.Files[0].FileUse != "satBand" {
+		t.Errorf("expected only the B04 file but found %v", scene.Files)
+	}
+
+	scene, err = items[1].Scene("sentinel-cogs", tileFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPaths := []string{
+		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif",
+		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/S2A_39PUL_20190914_0_L2A.json",
+	}
+	if len(scene.Files) != 2 || scene.Files[0].ObjectPath != expectedPaths[0] || scene.Files[1].ObjectPath != expectedPaths[1] || scene.Files[1].FileUse != "jsonMeta" {
+		t.Errorf("expected the files %v but found %v", expectedPaths, scene.Files)
+	}
+
+	// multi polygons are left for the json metadata
+	scene, err = items[2].Scene("sentinel-cogs", tileFiles)
+	if err != nil {
+		t.Fatal(err)
+	} else if scene.MgrsCode != "1CCV" || scene.Geometry.Type != "" || len(scene.Files) != 1 {
+		t.Errorf("expected a scene without a geometry but found %v", scene)
+	}
+
+	if _, err := items[3].Scene("sentinel-cogs", tileFiles); !errors.Is(err, ERROR_STAC_ASSET_LOCATION) {
+		t.Errorf("expected an asset location error but found %v", err)
+	}
+	if scene, err := items[0].Scene("sentinel-cogs", map[string]bool{"B12.tif": true}); err != nil || scene != nil {
+		t.Errorf("expected no scene without any files but found %v, %v", scene, err)
+	}
+}
+
+func TestAssetObjectKey(t *testing.T) {
+	objectPath := "sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif"
+	hrefs := []string{
+		"s3://sentinel-cogs/" + objectPath,
+		"https://sentinel-cogs.s3.us-west-2.amazonaws.com/" + objectPath,
+		"https://s3.us-west-2.amazonaws.com/sentinel-cogs/" + objectPath,
+	}
+	for _, href := range hrefs {
+		if key, err := assetObjectKey(href, "sentinel-cogs"); err != nil || key != objectPath {
+			t.Errorf("expected %s to be the key of %s but found %s, %v", objectPath, href, key, err)
+		}
+	}
+
+	if _, err := assetObjectKey("s3://other-bucket/"+objectPath, "sentinel-cogs"); !errors.Is(err, ERROR_STAC_ASSET_LOCATION) {
+		t.Errorf("expected an asset location error but found %v", err)
+	}
+}
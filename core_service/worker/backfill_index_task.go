@@ -0,0 +1,281 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	db "core_service/database"
+	satData "core_service/satelliteS3"
+)
+
+const (
+	BACKFILL_WORKFLOW    = "Backfill"
+	BACKFILL_DATE_FORMAT = "2006-01-02"
+	// the most chunks a single backfill publishes, a square indexed for
+	// ten years is 120 chunks
+	BACKFILL_MAX_CHUNKS = 10000
+	// chunks run behind the daily index run and the map builds
+	BACKFILL_CHUNK_PRIORITY = 3
+	// the root of the scene keys in the image bucket
+	SATELLITE_DATA_PREFIX = "sentinel-s2-l2a-cogs"
+)
+
+var (
+	ERROR_INVALID_BACKFILL = errors.New("Invalid backfill request")
+	ERROR_TOO_MANY_CHUNKS  = errors.New("Backfill request has too many chunks")
+)
+
+// an mgrs 100km square split into its zone, latitude band and square id
+var mgrsCodeExpression = regexp.MustCompile(`^0?([1-9]|[1-5][0-9]|60)([C-HJ-NP-X])([A-HJ-NP-Z][A-HJ-NP-V])$`)
+
+// BackfillRequest is the date range and mgrs squares a backfill indexes,
+// both dates are included.
+type BackfillRequest struct {
+	StartDate time.Time
+	EndDate   time.Time
+	MgrsCodes []string
+}
+
+// BackfillChunk is the part of a backfill for one square in one month.
+// It is indexed by a single BackfillIndexChunkTask event.
+type BackfillChunk struct {
+	MgrsCode  string
+	StartDate time.Time
+	EndDate   time.Time
+}
+
+// ParseBackfillRequest reads the startDate, endDate and comma separated
+// mgrsCodes of a backfill event. The codes are written the way the
+// satellite data object paths write them, like 15TUL or 4QFJ.
+func ParseBackfillRequest(data map[string]string) (*BackfillRequest, error) {
+	startDate, err := time.Parse(BACKFILL_DATE_FORMAT, data["startDate"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid start date %q", ERROR_INVALID_BACKFILL, data["startDate"])
+	}
+	endDate, err := time.Parse(BACKFILL_DATE_FORMAT, data["endDate"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid end date %q", ERROR_INVALID_BACKFILL, data["endDate"])
+	} else if endDate.Before(startDate) {
+		return nil, fmt.Errorf("%w: end date is before the start date", ERROR_INVALID_BACKFILL)
+	}
+
+	request := BackfillRequest{StartDate: startDate, EndDate: endDate}
+	mgrsCodes := make(map[string]bool)
+	for _, mgrsCode := range strings.Split(data["mgrsCodes"], ",") {
+		mgrsCode = strings.ToUpper(strings.TrimSpace(mgrsCode))
+		if mgrsCode == "" {
+			continue
+		}
+		codeItems := mgrsCodeExpression.FindStringSubmatch(mgrsCode)
+		if codeItems == nil {
+			return nil, fmt.Errorf("%w: invalid mgrs code %q", ERROR_INVALID_BACKFILL, mgrsCode)
+		}
+		mgrsCode = codeItems[1] + codeItems[2] + codeItems[3]
+		if !mgrsCodes[mgrsCode] {
+			mgrsCodes[mgrsCode] = true
+			request.MgrsCodes = append(request.MgrsCodes, mgrsCode)
+		}
+	}
+	if len(request.MgrsCodes) == 0 {
+		return nil, fmt.Errorf("%w: no mgrs codes", ERROR_INVALID_BACKFILL)
+	}
+	return &request, nil
+}
+
+// Data is the event data the request was parsed from.
+func (obj *BackfillRequest) Data() map[string]string {
+	return map[string]string{
+		"startDate": obj.StartDate.Format(BACKFILL_DATE_FORMAT),
+		"endDate":   obj.EndDate.Format(BACKFILL_DATE_FORMAT),
+		"mgrsCodes": strings.Join(obj.MgrsCodes, ","),
+	}
+}
+
+// Key identifies the backfill, like 2023-01-01/2023-06-30/15TUL,15TVL.
+func (obj *BackfillRequest) Key() string {
+	data := obj.Data()
+	return fmt.Sprintf("%s/%s/%s", data["startDate"], data["endDate"], data["mgrsCodes"])
+}
+
+// Chunks splits the request into a chunk for every square and month.
+func (obj *BackfillRequest) Chunks() []BackfillChunk {
+	chunks := make([]BackfillChunk, 0)
+	for _, mgrsCode := range obj.MgrsCodes {
+		monthStart := time.Date(obj.StartDate.Year(), obj.StartDate.Month(), 1, 0, 0, 0, 0, time.UTC)
+		for !monthStart.After(obj.EndDate) {
+			nextMonthStart := monthStart.AddDate(0, 1, 0)
+			chunk := BackfillChunk{MgrsCode: mgrsCode, StartDate: monthStart, EndDate: nextMonthStart.AddDate(0, 0, -1)}
+			if chunk.StartDate.Before(obj.StartDate) {
+				chunk.StartDate = obj.StartDate
+			}
+			if chunk.EndDate.After(obj.EndDate) {
+				chunk.EndDate = obj.EndDate
+			}
+			chunks = append(chunks, chunk)
+			monthStart = nextMonthStart
+		}
+	}
+	return chunks
+}
+
+func (obj BackfillChunk) Key() string {
+	return fmt.Sprintf("%s/%s/%s", obj.MgrsCode, obj.StartDate.Format(BACKFILL_DATE_FORMAT), obj.EndDate.Format(BACKFILL_DATE_FORMAT))
+}
+
+// Prefix is the key prefix of the chunk's scenes in the image bucket,
+// like sentinel-s2-l2a-cogs/15/T/UL/2023/8/.
+func (obj BackfillChunk) Prefix() string {
+	codeItems := mgrsCodeExpression.FindStringSubmatch(obj.MgrsCode)
+	return fmt.Sprintf("%s/%s/%s/%s/%d/%d/", SATELLITE_DATA_PREFIX, codeItems[1], codeItems[2], codeItems[3], obj.StartDate.Year(), obj.StartDate.Month())
+}
+
+func (obj BackfillChunk) Event(parentEvent *db.Event) db.Event {
+	request := BackfillRequest{StartDate: obj.StartDate, EndDate: obj.EndDate, MgrsCodes: []string{obj.MgrsCode}}
+	return db.NewChildEvent(parentEvent, db.Event{
+		EventType: "BackfillIndexChunkTask",
+		Priority:  BACKFILL_CHUNK_PRIORITY,
+		DedupKey:  fmt.Sprintf("BackfillIndexChunkTask/%s", obj.Key()),
+		Data:      request.Data(),
+	})
+}
+
+// IndexFilter keeps the records of the chunk's square, between its
+// dates, for the tile files of the setting.
+func (obj BackfillChunk) IndexFilter(setting *db.Setting) *IndexFilter {
+	indexFilter := IndexFilter{
+		utmZones:    map[string]bool{obj.MgrsCode[:len(obj.MgrsCode)-2]: true},
+		mgrsSquares: map[string]bool{obj.MgrsCode: true},
+		tileFiles:   make(map[string]bool),
+		// the filter only takes scenes after the start date
+		startDate: obj.StartDate.Add(-time.Nanosecond),
+		endDate:   obj.EndDate,
+	}
+	for _, fileType := range setting.TileFiles {
+		indexFilter.tileFiles[fileType] = true
+	}
+	return &indexFilter
+}
+
+// BackfillIndexTask splits a backfill of the date range for the mgrs
+// codes into a BackfillIndexChunkTask event for each square and month,
+// all in one workflow. The dedup keys let an interrupted backfill be
+// run again without queueing the same chunks twice.
+func BackfillIndexTask(ctx context.Context, event *db.Event) (*db.EventResult, error) {
+	log.Printf("BackfillIndexTask(%s)\n", event.ID.Hex())
+	result := db.NewEventResult()
+
+	request, err := ParseBackfillRequest(event.Data)
+	if err != nil {
+		return result, Permanent(err)
+	}
+	chunks := request.Chunks()
+	if len(chunks) > BACKFILL_MAX_CHUNKS {
+		return result, Permanent(fmt.Errorf("%w: %d chunks", ERROR_TOO_MANY_CHUNKS, len(chunks)))
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	if event.WorkflowId.IsZero() {
+		workflow := db.Workflow{Name: BACKFILL_WORKFLOW, RunKey: request.Key()}
+		if err := db.StartWorkflow(ctx, dbClient, &workflow, event); err != nil {
+			log.Println("failed to start the backfill workflow")
+			return result, err
+		}
+	}
+
+	events := make([]db.Event, 0, len(chunks))
+	for _, chunk := range chunks {
+		events = append(events, chunk.Event(event))
+	}
+	eventReport, err := db.BulkSaveEvents(ctx, dbClient, events, db.DEFAULT_BULK_WRITE_BATCH_SIZE)
+	result.AddCount("chunks", int64(len(chunks)))
+	result.AddCount("eventsPublished", int64(eventReport.Written))
+	result.AddCount("duplicateEvents", int64(eventReport.Duplicates))
+	if err != nil {
+		log.Println("failed to save some backfill chunk events:", err)
+		return result, err
+	}
+	return result, nil
+}
+
+// BackfillIndexChunkTask lists the scenes of each chunk in the image
+// bucket and creates the tiles and file events of the objects which
+// haven't been ingested, the same way an index run does.
+func BackfillIndexChunkTask(ctx context.Context, event *db.Event) (*db.EventResult, error) {
+	log.Printf("BackfillIndexChunkTask(%s)\n", event.ID.Hex())
+	result := db.NewEventResult()
+
+	request, err := ParseBackfillRequest(event.Data)
+	if err != nil {
+		return result, Permanent(err)
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	setting, err := db.FindCurrentSetting(ctx, dbClient)
+	if err != nil {
+		log.Println("failed to load settings")
+		return result, err
+	}
+	result.SettingVersion = setting.Version
+	batchSize := setting.IndexBatchSize
+	if batchSize < 1 {
+		batchSize = DEFAULT_INDEX_BATCH_SIZE
+	}
+
+	for _, chunk := range request.Chunks() {
+		objects, err := satData.ListObjects(ctx, chunk.Prefix(), satData.SATELLITE_S3_IMAGE_BUCKET)
+		if err != nil {
+			log.Println("failed to list the objects of the backfill chunk")
+			return result, err
+		}
+
+		// the listed objects become records like the ones in the csv
+		// index files
+		indexFilter := chunk.IndexFilter(setting)
+		inventoryFile := db.InventoryFile{Key: fmt.Sprintf("backfill/%s", chunk.Key())}
+		handleInvalid := invalidRecordCounter(inventoryFile.Key, result)
+		records := make([][]string, 0, len(objects))
+		for _, object := range objects {
+			record := []string{
+				satData.SATELLITE_S3_IMAGE_BUCKET,
+				object.Key,
+				strconv.FormatInt(object.Size, 10),
+				object.LastModified.UTC().Format(time.RFC3339),
+			}
+			if consumed, err := indexFilter.Consumes(record); err != nil {
+				handleInvalid(record, err)
+			} else if consumed {
+				records = append(records, record)
+			}
+		}
+
+		for start := 0; start < len(records); start += batchSize {
+			end := start + batchSize
+			if end > len(records) {
+				end = len(records)
+			}
+			if err := ingestIndexRecords(ctx, dbClient, event, &inventoryFile, records[start:end], nil, batchSize, result); err != nil {
+				return result, err
+			}
+		}
+		result.AddCount("chunks", 1)
+	}
+
+	if failedObjects := result.Counts["failedObjects"]; failedObjects > 0 {
+		return result, fmt.Errorf("%w: %d objects failed", ERROR_PARTIAL_INDEX, failedObjects)
+	}
+	return result, nil
+}
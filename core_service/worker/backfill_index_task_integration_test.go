@@ -0,0 +1,101 @@
+//go:build integration
+
+package worker
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	db "core_service/database"
+	satData "core_service/satelliteS3"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBackfillIndexTasks(t *testing.T) {
+	db.CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objectSession, err := satData.S3Session(ctx, satData.SATELLITE_S3_IMAGE_BUCKET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploader := manager.NewUploader(objectSession)
+
+	objectKeys := []string{
+		"sentinel-s2-l2a-cogs/15/T/UL/2023/8/S2A_15TUL_20230805_0_L2A/B04.tif",
+		"sentinel-s2-l2a-cogs/15/T/UL/2023/8/S2A_15TUL_20230805_0_L2A/B01.tif",
+		"sentinel-s2-l2a-cogs/15/T/UL/2023/8/S2B_15TUL_20230825_0_L2A/B04.tif",
+		"sentinel-s2-l2a-cogs/15/T/UL/2023/9/S2A_15TUL_20230904_0_L2A/B04.tif",
+	}
+	for _, objectKey := range objectKeys {
+		_, err = uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(satData.SATELLITE_S3_IMAGE_BUCKET),
+			Key:    aws.String(objectKey),
+			Body:   bytes.NewReader([]byte("tif")),
+		})
+		if err != nil {
+			t.Fatalf("Unable to upload: %v", err)
+		}
+	}
+
+	setting := db.Setting{
+		UtmZones:      []string{"39P"},
+		TileFiles:     []string{"B04.tif"},
+		TileStartDate: primitive.NewDateTimeFromTime(time.Date(2023, time.Month(8), 20, 0, 0, 0, 0, time.UTC)),
+	}
+	if err := db.SaveSetting(ctx, dbClient, &setting); err != nil {
+		t.Fatal(err)
+	}
+
+	// the backfill ignores the start date and zones of the setting
+	backfillEvent := db.Event{
+		EventType: "BackfillIndexTask",
+		Data:      map[string]string{"startDate": "2023-08-01", "endDate": "2023-08-31", "mgrsCodes": "15TUL"},
+	}
+	if err := db.SaveEvent(ctx, dbClient, &backfillEvent); err != nil {
+		t.Fatal(err)
+	}
+	result, err := BackfillIndexTask(ctx, &backfillEvent)
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Counts["chunks"] != 1 || result.Counts["eventsPublished"] != 1 {
+		t.Fatalf("expected one chunk event: %v", result.Counts)
+	}
+
+	var chunkEvent db.Event
+	if err := db.EventCollection(dbClient).FindOne(ctx, bson.D{{"event_type", "BackfillIndexChunkTask"}}).Decode(&chunkEvent); err != nil {
+		t.Fatal(err)
+	} else if chunkEvent.ParentId != backfillEvent.ID || chunkEvent.WorkflowId.IsZero() {
+		t.Fatalf("expected the chunk event to be part of the backfill workflow: %v", chunkEvent)
+	}
+
+	result, err = BackfillIndexChunkTask(ctx, &chunkEvent)
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Counts["newObjects"] != 2 || result.Counts["tiles"] != 2 || result.SettingVersion != setting.Version {
+		t.Fatalf("expected the two B04 files of august to be ingested: %v", result)
+	}
+
+	// running the chunk again publishes nothing new
+	result, err = BackfillIndexChunkTask(ctx, &chunkEvent)
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Counts["newObjects"] != 0 {
+		t.Fatalf("expected no new objects: %v", result.Counts)
+	}
+	mapEventCount, err := db.EventCollection(dbClient).CountDocuments(ctx, bson.D{{"event_type", "RequestMapTask"}})
+	if err != nil || mapEventCount != 2 {
+		t.Errorf("expected 2 map events but found %d", mapEventCount)
+	}
+}
@@ -0,0 +1,117 @@
+package worker
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	db "core_service/database"
+)
+
+func TestParseBackfillRequest(t *testing.T) {
+	request, err := ParseBackfillRequest(map[string]string{
+		"startDate": "2023-01-15",
+		"endDate":   "2023-03-10",
+		"mgrsCodes": "15tul, 04QFJ,15TUL",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(request.MgrsCodes, []string{"15TUL", "4QFJ"}) {
+		t.Errorf("expected the codes 15TUL and 4QFJ but found %v", request.MgrsCodes)
+	}
+	if request.Key() != "2023-01-15/2023-03-10/15TUL,4QFJ" {
+		t.Errorf("unexpected key %s", request.Key())
+	}
+
+	invalidData := []map[string]string{
+		{"startDate": "2023-01-15", "endDate": "2023-01-14", "mgrsCodes": "15TUL"},
+		{"startDate": "2023-1-15", "endDate": "2023-03-10", "mgrsCodes": "15TUL"},
+		{"startDate": "2023-01-15", "endDate": "2023-03-10", "mgrsCodes": ""},
+		{"startDate": "2023-01-15", "endDate": "2023-03-10", "mgrsCodes": "61TUL"},
+		{"startDate": "2023-01-15", "endDate": "2023-03-10", "mgrsCodes": "15TIL"},
+	}
+	for _, data := range invalidData {
+		if _, err := ParseBackfillRequest(data); !errors.Is(err, ERROR_INVALID_BACKFILL) {
+			t.Errorf("expected %v to be invalid but found %v", data, err)
+		}
+	}
+}
+
+func TestBackfillRequestChunks(t *testing.T) {
+	request, err := ParseBackfillRequest(map[string]string{
+		"startDate": "2022-12-15",
+		"endDate":   "2023-02-10",
+		"mgrsCodes": "15TUL,4QFJ",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunkKeys := make([]string, 0)
+	chunkPrefixes := make([]string, 0)
+	for _, chunk := range request.Chunks() {
+		chunkKeys = append(chunkKeys, chunk.Key())
+		chunkPrefixes = append(chunkPrefixes, chunk.Prefix())
+	}
+	expectedKeys := []string{
+		"15TUL/2022-12-15/2022-12-31",
+		"15TUL/2023-01-01/2023-01-31",
+		"15TUL/2023-02-01/2023-02-10",
+		"4QFJ/2022-12-15/2022-12-31",
+		"4QFJ/2023-01-01/2023-01-31",
+		"4QFJ/2023-02-01/2023-02-10",
+	}
+	if !reflect.DeepEqual(chunkKeys, expectedKeys) {
+		t.Errorf("expected chunks %v but found %v", expectedKeys, chunkKeys)
+	}
+	expectedPrefixes := []string{
+		"sentinel-s2-l2a-cogs/15/T/UL/2022/12/",
+		"sentinel-s2-l2a-cogs/15/T/UL/2023/1/",
+		"sentinel-s2-l2a-cogs/15/T/UL/2023/2/",
+		"sentinel-s2-l2a-cogs/4/Q/FJ/2022/12/",
+		"sentinel-s2-l2a-cogs/4/Q/FJ/2023/1/",
+		"sentinel-s2-l2a-cogs/4/Q/FJ/2023/2/",
+	}
+	if !reflect.DeepEqual(chunkPrefixes, expectedPrefixes) {
+		t.Errorf("expected prefixes %v but found %v", expectedPrefixes, chunkPrefixes)
+	}
+
+	// each chunk event parses back into just that chunk
+	chunk := request.Chunks()[2]
+	chunkEvent := chunk.Event(&db.Event{})
+	chunkRequest, err := ParseBackfillRequest(chunkEvent.Data)
+	if err != nil {
+		t.Fatal(err)
+	} else if chunks := chunkRequest.Chunks(); len(chunks) != 1 || chunks[0] != chunk {
+		t.Errorf("expected the chunk event to hold chunk %v but found %v", chunk, chunks)
+	}
+}
+
+func TestBackfillChunkIndexFilter(t *testing.T) {
+	chunk := BackfillChunk{
+		MgrsCode:  "39PUL",
+		StartDate: time.Date(2019, time.Month(9), 14, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2019, time.Month(9), 20, 0, 0, 0, 0, time.UTC),
+	}
+	indexFilter := chunk.IndexFilter(&db.Setting{TileFiles: []string{"B04.tif"}})
+
+	testCases := []struct {
+		objectPath string
+		consumed   bool
+	}{
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif", true},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2B_39PUL_20190920_0_L2A/B04.tif", true},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190913_0_L2A/B04.tif", false},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190921_0_L2A/B04.tif", false},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B08.tif", false},
+		{"sentinel-s2-l2a-cogs/39/P/TL/2019/9/S2A_39PTL_20190914_0_L2A/B04.tif", false},
+	}
+	for _, testCase := range testCases {
+		record := []string{"sentinel-cogs", testCase.objectPath, "100", "2019-09-25T00:00:00Z"}
+		if consumed, err := indexFilter.Consumes(record); err != nil || consumed != testCase.consumed {
+			t.Errorf("expected %s to be consumed %t: %v", testCase.objectPath, testCase.consumed, err)
+		}
+	}
+}
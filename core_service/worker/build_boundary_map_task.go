@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	db "core_service/database"
 	satData "core_service/satelliteS3"
@@ -37,13 +38,14 @@ func init() {
 }
 
 
-func BuildBoundaryMapTask(ctx context.Context, event *db.Event) error {
+func BuildBoundaryMapTask(ctx context.Context, event *db.Event) (*db.EventResult, error) {
 	log.Printf("BuildBoundaryMapTask(%s)", event.ID.Hex())
 	log.Println("event data:", event.Data)
+	result := db.NewEventResult()
 
 	dbClient, err := db.DefaultDatabaseClient(ctx)
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	// find all boundaries effected by the new tile
@@ -54,21 +56,36 @@ func BuildBoundaryMapTask(ctx context.Context, event *db.Event) error {
 		boundaryObjectId, err := primitive.ObjectIDFromHex(boundaryId)
 		if err != nil {
 			log.Println("malformed boundary id in event data")
-			return err
+			return result, Permanent(err)
 		}
 		boundariesFilter = append(boundariesFilter, bson.E{"_id", boundaryObjectId})
 	}
 
+	// without a setting the boundaries get the newest scenes
+	setting, err := db.FindCurrentSetting(ctx, dbClient)
+	if err == mongo.ErrNoDocuments {
+		setting = &db.Setting{}
+	} else if err != nil {
+		log.Println("failed to load settings")
+		return result, err
+	}
+	result.SettingVersion = setting.Version
+
 	// get boundaries for each tile
-	tileBoundaries, err := FindBoundariesForTile(ctx, dbClient, event.Data["mgrsCode"], boundariesFilter)
+	tileBoundaries, err := FindBoundariesForTile(ctx, dbClient, result, event.Data["mgrsCode"], boundariesFilter, setting.SceneSelection)
 	if err != nil {
 		log.Println("failed to get boundaries each for tiles")
-		return err
+		return result, err
 	}
 
 	for tileId, boundaries := range tileBoundaries {
 		log.Println("tile id:", tileId)
 
+		// stop between tiles when the event is cancelled or times out
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
 		log.Println("number of boundaries effected by the tile:", len(*boundaries))
 		if len(*boundaries) == 0 {
 			log.Println("no boundaries were effected by the tile")
@@ -79,27 +96,33 @@ func BuildBoundaryMapTask(ctx context.Context, event *db.Event) error {
 		tile, err := db.FindTile(ctx, dbClient, filter)
 		if err != nil {
 			log.Println("failed to the tile by id")
-			return err
+			return result, err
 		}
 
-		if err := SetupAndBuildNDVIMaps(ctx, dbClient, boundaries, tile); err != nil {
-			return err
+		result.AddCount("tiles", 1)
+		result.AddCount("boundaries", int64(len(*boundaries)))
+		if err := SetupAndBuildNDVIMaps(ctx, dbClient, result, boundaries, tile); err != nil {
+			return result, err
 		}
 
 	}
 
-	return nil
+	return result, nil
 }
 
 
-func FindBoundariesForTile(ctx context.Context, dbClient *mongo.Client, mgrsCode string, boundariesFilter bson.D) (map[primitive.ObjectID]*[]db.Boundary, error) {
+// FindBoundariesForTile picks the scene of each boundary from the newest
+// tiles of the mgrs square with the setting's scene selection policy, it
+// returns the boundaries by the tile their map is built from. Only tiles
+// with both map bands are candidates.
+func FindBoundariesForTile(ctx context.Context, dbClient *mongo.Client, result *db.EventResult, mgrsCode string, boundariesFilter bson.D, sceneSelection db.SceneSelection) (map[primitive.ObjectID]*[]db.Boundary, error) {
 	boundariesByTileId := make(map[primitive.ObjectID]*[]db.Boundary)
 
-	// get the 5 most recent tiles
+	// get the most recent tiles
 	filter := bson.D{{"mgrs_code", mgrsCode}}
 	opts := options.Find()
 	opts.SetSort(bson.D{{"date", -1}})
-	opts.SetLimit(10)
+	opts.SetLimit(SCENE_CANDIDATE_TILES)
 	tiles, err := db.FindTiles(ctx, dbClient, filter, opts)
 	if err != nil {
 		log.Println("failed to get the most recent tiles")
@@ -107,12 +130,24 @@ func FindBoundariesForTile(ctx context.Context, dbClient *mongo.Client, mgrsCode
 	}
 
 	log.Println("number of tiles:", len(*tiles))
-	if len(*tiles) == 0 {
-		log.Println("no tiles were found")
+	candidateTiles := make([]db.Tile, 0, len(*tiles))
+	for _, tile := range *tiles {
+		band04ObjectPath, band08ObjectPath, _ := tileMapBands(&tile)
+		if band04ObjectPath != "" && band08ObjectPath != "" {
+			candidateTiles = append(candidateTiles, tile)
+		}
+	}
+	if len(candidateTiles) == 0 {
+		log.Println("no tiles with bands 4 and 8 were found")
 		return boundariesByTileId, nil
 	}
 
-	for _, tile := range *tiles {
+	// the candidate tiles of each boundary stay sorted newest first
+	boundariesById := make(map[primitive.ObjectID]db.Boundary)
+	tilesByBoundaryId := make(map[primitive.ObjectID][]*db.Tile)
+	intersectingBoundaries := make(map[primitive.ObjectID][]db.Boundary)
+	for i := range candidateTiles {
+		tile := &candidateTiles[i]
 		filters := boundariesFilter
 		filters = append(filters, bson.E{"geometry", bson.D{{"$geoIntersects", bson.D{{"$geometry", tile.Geometry}}}}})
 		ops := options.Find()
@@ -122,59 +157,53 @@ func FindBoundariesForTile(ctx context.Context, dbClient *mongo.Client, mgrsCode
 			return nil, err
 		}
 
-		boundariesNotAlreadyClaimed := make([]db.Boundary, 0, len(*boundaries) / 2)
+		intersectingBoundaries[tile.ID] = *boundaries
 		for _, boundary := range *boundaries {
+			boundariesById[boundary.ID] = boundary
+			tilesByBoundaryId[boundary.ID] = append(tilesByBoundaryId[boundary.ID], tile)
+		}
+	}
 
-			boundaryClaimed := false
-			for _, tileBoundaries := range boundariesByTileId {
-				
-				for _, tileBoundary := range *tileBoundaries {
-
-					if tileBoundary.ID == boundary.ID {
-						boundaryClaimed = true
-					}
-
-				}
-
-			}
+	// the newest policy doesn't need the boundaries' scl stats
+	statsByKey := make(map[string]db.BoundarySceneStat)
+	if sceneSelection.Policy != "" && sceneSelection.Policy != db.SCENE_POLICY_NEWEST {
+		statsByKey, err = LoadBoundarySceneStats(ctx, dbClient, result, candidateTiles, intersectingBoundaries)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			if !boundaryClaimed {
-				boundariesNotAlreadyClaimed = append(boundariesNotAlreadyClaimed, boundary)
+	for boundaryId, boundaryTiles := range tilesByBoundaryId {
+		candidates := make([]SceneCandidate, 0, len(boundaryTiles))
+		for _, tile := range boundaryTiles {
+			_, _, bandSCLObjectPath := tileMapBands(tile)
+			var stat *db.BoundarySceneStat
+			if savedStat, exists := statsByKey[boundarySceneStatKey(boundaryId, bandSCLObjectPath)]; exists && bandSCLObjectPath != "" {
+				stat = &savedStat
 			}
-
+			candidates = append(candidates, NewSceneCandidate(tile, stat))
 		}
-		boundariesByTileId[tile.ID] = &boundariesNotAlreadyClaimed
 
+		selected := SelectScene(sceneSelection, candidates, time.Now())
+		if selected == nil {
+			continue
+		}
+		tileBoundaries, exists := boundariesByTileId[selected.Tile.ID]
+		if !exists {
+			tileBoundaries = &[]db.Boundary{}
+			boundariesByTileId[selected.Tile.ID] = tileBoundaries
+		}
+		*tileBoundaries = append(*tileBoundaries, boundariesById[boundaryId])
 	}
 
 	return boundariesByTileId, nil
 }
 
 
-func SetupAndBuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, boundaries *[]db.Boundary, tile *db.Tile) error {
+func SetupAndBuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, result *db.EventResult, boundaries *[]db.Boundary, tile *db.Tile) error {
 	log.Println("SetupAndBuildNDVIMaps()")
 
-	latestVersion := 0
-	for _, file := range tile.Files {
-		if file.Version > latestVersion {
-			latestVersion = file.Version
-		}
-	}
-
-	band04ObjectPath := ""
-	band08ObjectPath := ""
-	bandSCLObjectPath := ""
-	for _, file := range tile.Files {
-		if file.Version == latestVersion {
-			if file.Band == "B04.tif" {
-				band04ObjectPath = file.ObjectPath
-			} else if file.Band == "B08.tif" {
-				band08ObjectPath = file.ObjectPath
-			} else if file.Band == "SCL.tif" {
-				bandSCLObjectPath = file.ObjectPath
-			}
-		}
-	}
+	band04ObjectPath, band08ObjectPath, bandSCLObjectPath := tileMapBands(tile)
 	if band04ObjectPath == "" || band08ObjectPath == "" {
 		return errors.New("tile did not have files for bands 4 and 8")
 	}
@@ -194,11 +223,14 @@ func SetupAndBuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, boundari
 	band08Path := filepath.Join(dataDir, "satData_band08.tif")
 
 	
-	if err := satData.GetObject(ctx, band04Path, band04ObjectPath, satData.SATELLITE_S3_IMAGE_BUCKET); err != nil {
+	if err := downloadObject(ctx, result, band04Path, band04ObjectPath, satData.SATELLITE_S3_IMAGE_BUCKET); err != nil {
 		log.Println("failed to get satellite data file band 04")
 		return err
 	}
-	if err := satData.GetObject(ctx, band08Path, band08ObjectPath, satData.SATELLITE_S3_IMAGE_BUCKET); err != nil {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := downloadObject(ctx, result, band08Path, band08ObjectPath, satData.SATELLITE_S3_IMAGE_BUCKET); err != nil {
 		log.Println("failed to get satellite data file band 08")
 		return err
 	}
@@ -206,15 +238,18 @@ func SetupAndBuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, boundari
 	// optionally load the sceen classification layer
 	if bandSCLObjectPath != "" {
 		bandSCLPath := filepath.Join(dataDir, "satData_bandSCL.tif")
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-		if err := satData.GetObject(ctx, bandSCLPath, bandSCLObjectPath, satData.SATELLITE_S3_IMAGE_BUCKET); err != nil {
+		if err := downloadObject(ctx, result, bandSCLPath, bandSCLObjectPath, satData.SATELLITE_S3_IMAGE_BUCKET); err != nil {
 			log.Println("failed to get satellite data file band SCL")
 			return err
 		}
 
 	}
 
-	if err := BuildNDVIMaps(ctx, dbClient, boundaries, tile, dataDir); err != nil {
+	if err := BuildNDVIMaps(ctx, dbClient, result, boundaries, tile, dataDir); err != nil {
 		log.Println("failed to build the ndvi maps")
 		return err
 	}
@@ -222,7 +257,7 @@ func SetupAndBuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, boundari
 	return nil
 }
 
-func BuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, boundaries *[]db.Boundary, tile *db.Tile, dataDir string) error {
+func BuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, result *db.EventResult, boundaries *[]db.Boundary, tile *db.Tile, dataDir string) error {
 	log.Println("BuildNDVIMaps()")
 
 	boundaryPrefix := "boundary_geometry_"
@@ -239,7 +274,7 @@ func BuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, boundaries *[]db
 	WriteBoundaryFiles(boundaries, dataDir, boundaryPrefix)
 
 	// call the python program to generate the rasters
-	if err := CallPythonProgram(dataDir, bandPrefix, boundaryPrefix); err != nil {
+	if err := CallPythonProgram(ctx, dataDir, bandPrefix, boundaryPrefix); err != nil {
 		log.Println(err)
 		return err
 	}
@@ -251,7 +286,7 @@ func BuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, boundaries *[]db
 		return err
 	}
 
-	if err := SaveBoundaryRasters(ctx, dbClient, dataDir, rasters, rasterImageFiles); err != nil {
+	if err := SaveBoundaryRasters(ctx, dbClient, result, dataDir, rasters, rasterImageFiles); err != nil {
 		log.Println(err)
 		return err
 	}
@@ -260,13 +295,16 @@ func BuildNDVIMaps(ctx context.Context, dbClient *mongo.Client, boundaries *[]db
 }
 
 
-func SaveBoundaryRasters(ctx context.Context, dbClient *mongo.Client, dataDir string, rasters *[]db.Raster, rasterImageFiles map[string]string) error {
+func SaveBoundaryRasters(ctx context.Context, dbClient *mongo.Client, result *db.EventResult, dataDir string, rasters *[]db.Raster, rasterImageFiles map[string]string) error {
 	log.Println("SaveBoundaryRasters()")
 
 	// iterate over each raster
 	// storing the raster image to s3 before storing the object
 	// to the database
 	for _, raster := range *rasters {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if rasterImagePath, exists := rasterImageFiles[raster.BoundaryId.Hex()]; exists {
 			fullRasterImagePath := filepath.Join(dataDir, rasterImagePath)
 			if err := raster.StoreRasterImage(ctx, fullRasterImagePath); err != nil {
@@ -283,6 +321,7 @@ func SaveBoundaryRasters(ctx context.Context, dbClient *mongo.Client, dataDir st
 				log.Println(err)
 				continue
 			}
+			result.RasterIds = append(result.RasterIds, raster.ID)
 		}
 
 	}
@@ -382,10 +421,14 @@ func BuildBoundaryRasters(boundaries *[]db.Boundary, tile *db.Tile, dataDir, ras
 	return &rasters, rasterImageFiles, nil
 }
 
-func CallPythonProgram(dataDir, bandPrefix, boundaryPrefix string) error {
+// CallPythonProgram runs the ndvi script, the flags like --stats follow
+// the data directory and prefixes.
+func CallPythonProgram(ctx context.Context, dataDir, bandPrefix, boundaryPrefix string, flags ...string) error {
 	log.Println("CallPythonProgram()")
 
-	output, err := exec.Command(PROJECT_PYTHON_PATH, NDVI_SCRIPT, dataDir, bandPrefix, boundaryPrefix).Output()
+	// the program is killed if the event is cancelled
+	args := append([]string{NDVI_SCRIPT, dataDir, bandPrefix, boundaryPrefix}, flags...)
+	output, err := exec.CommandContext(ctx, PROJECT_PYTHON_PATH, args...).Output()
 	log.Println(string(output))
     if err != nil {
         return err
@@ -1,3 +1,5 @@
+//go:build integration
+
 package worker
 
 import (
@@ -190,7 +192,7 @@ func TestBuildBoundaryMapTask(t *testing.T) {
 		},
 	}
 
-	if err := BuildBoundaryMapTask(ctx, &event); err != nil {
+	if _, err := BuildBoundaryMapTask(ctx, &event); err != nil {
 		t.Fatal(err)
 	}
 
@@ -386,7 +388,7 @@ func TestPerformanceOfMapGeneration(t *testing.T) {
 		},
 	}
 
-	if err := BuildBoundaryMapTask(ctx, &event); err != nil {
+	if _, err := BuildBoundaryMapTask(ctx, &event); err != nil {
 		t.Fatal(err)
 	}
 
@@ -0,0 +1,37 @@
+package worker
+
+import (
+	"context"
+	"log"
+
+	db "core_service/database"
+)
+
+// CleanupRastersTask deletes the rasters, and their images, of
+// boundaries which have been deleted.
+func CleanupRastersTask(ctx context.Context, event *db.Event) (*db.EventResult, error) {
+	log.Printf("CleanupRastersTask(%s)\n", event.ID.Hex())
+	result := db.NewEventResult()
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	boundaryIds, err := db.FindOrphanedRasterBoundaryIds(ctx, dbClient)
+	if err != nil {
+		log.Println("failed to find orphaned rasters")
+		return result, err
+	}
+
+	log.Printf("deleting rasters for %d deleted boundaries\n", len(boundaryIds))
+	for _, boundaryId := range boundaryIds {
+		if err := db.DeleteExistingBoundaryRastersByType(ctx, dbClient, boundaryId, ""); err != nil {
+			log.Println("failed to delete rasters for boundary", boundaryId.Hex())
+			return result, err
+		}
+		result.AddCount("boundariesCleaned", 1)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,309 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MemoryQueue is a Queue held in process memory. It follows the rules of
+// the MongoQueue for claiming, leases, dedup keys and dead letters but
+// knows nothing about workflows.
+type MemoryQueue struct {
+	mutex      sync.Mutex
+	events     []db.Event
+	deadEvents []db.DeadEvent
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{}
+}
+
+// Events returns a copy of the events in the queue.
+func (queue *MemoryQueue) Events() []db.Event {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return append([]db.Event{}, queue.events...)
+}
+
+// DeadEvents returns a copy of the dead lettered events.
+func (queue *MemoryQueue) DeadEvents() []db.DeadEvent {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return append([]db.DeadEvent{}, queue.deadEvents...)
+}
+
+// the index of the event or -1, the caller must hold the queue lock
+func (queue *MemoryQueue) indexOf(eventId primitive.ObjectID) int {
+	for i := range queue.events {
+		if queue.events[i].ID == eventId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (queue *MemoryQueue) Publish(ctx context.Context, event *db.Event) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	event.UpdatedDate = primitive.NewDateTimeFromTime(time.Now())
+	if event.ID != primitive.NilObjectID {
+		if i := queue.indexOf(event.ID); i >= 0 {
+			// cancellation is only ever set through Cancel
+			event.Cancelled = queue.events[i].Cancelled
+			event.CancelledDate = queue.events[i].CancelledDate
+			queue.events[i] = *event
+		}
+		return nil
+	}
+
+	if event.DedupKey != "" {
+		for _, queuedEvent := range queue.events {
+			if queuedEvent.DedupKey == event.DedupKey && memoryEventPendingFirstAttempt(&queuedEvent) {
+				return db.ERROR_DUPLICATE_EVENT
+			}
+		}
+	}
+	event.ID = primitive.NewObjectID()
+	queue.events = append(queue.events, *event)
+	return nil
+}
+
+func memoryEventPendingFirstAttempt(event *db.Event) bool {
+	return !event.Started && event.Attempts == 0 && !event.Passed && !event.Failed
+}
+
+func (queue *MemoryQueue) Claim(ctx context.Context, opts *db.NextEventOptions) (*db.Event, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	excludedEventTypes := make(map[string]bool)
+	leaseOwner := ""
+	leaseDuration := db.DEFAULT_EVENT_LEASE_DURATION
+	if opts != nil {
+		for _, eventType := range opts.ExcludedEventTypes {
+			excludedEventTypes[eventType] = true
+		}
+		if opts.LeaseDuration != 0 {
+			leaseDuration = opts.LeaseDuration
+		}
+		leaseOwner = opts.LeaseOwner
+	}
+
+	now := time.Now()
+	runningUserEvents := make(map[primitive.ObjectID]int)
+	for _, event := range queue.events {
+		if event.Started && !event.Passed && !event.Failed && !event.Cancelled && !event.UserId.IsZero() {
+			runningUserEvents[event.UserId] += 1
+		}
+	}
+
+	nextIndex := -1
+	nextPriority := 0
+	for i, event := range queue.events {
+		runnable := !event.Started && !event.Passed && !event.Failed && !event.Cancelled &&
+			(event.MaxAttemps <= 0 || event.Attempts < event.MaxAttemps) &&
+			now.After(event.StartAfterDate.Time()) &&
+			!excludedEventTypes[event.EventType]
+		if !runnable {
+			continue
+		}
+		priority := db.EventSchedulingPriority(&queue.events[i], now, runningUserEvents)
+		if nextIndex < 0 || priority > nextPriority ||
+			(priority == nextPriority && bytes.Compare(event.ID[:], queue.events[nextIndex].ID[:]) < 0) {
+			nextIndex = i
+			nextPriority = priority
+		}
+	}
+	if nextIndex < 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	event := &queue.events[nextIndex]
+	event.UpdatedDate = primitive.NewDateTimeFromTime(now)
+	event.StartedDate = primitive.NewDateTimeFromTime(now)
+	event.Started = true
+	event.LeaseOwner = leaseOwner
+	if leaseOwner != "" {
+		event.WorkerId = leaseOwner
+	}
+	event.LeaseExpiresDate = primitive.NewDateTimeFromTime(now.Add(leaseDuration))
+
+	claimedEvent := *event
+	return &claimedEvent, nil
+}
+
+func (queue *MemoryQueue) RenewLease(ctx context.Context, event *db.Event, leaseDuration time.Duration) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	i := queue.indexOf(event.ID)
+	if i < 0 || !queue.events[i].Started || queue.events[i].LeaseOwner != event.LeaseOwner {
+		return db.ERROR_EVENT_LEASE_LOST
+	}
+
+	leaseExpiresDate := primitive.NewDateTimeFromTime(time.Now().Add(leaseDuration))
+	queue.events[i].LeaseExpiresDate = leaseExpiresDate
+	event.LeaseExpiresDate = leaseExpiresDate
+	if queue.events[i].Cancelled {
+		return db.ERROR_EVENT_CANCELLED
+	}
+	return nil
+}
+
+func (queue *MemoryQueue) Complete(ctx context.Context, event *db.Event, leaseOwner string) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	i := queue.indexOf(event.ID)
+	if i < 0 || queue.events[i].LeaseOwner != leaseOwner {
+		return db.ERROR_EVENT_LEASE_LOST
+	}
+
+	event.UpdatedDate = primitive.NewDateTimeFromTime(time.Now())
+	event.Cancelled = queue.events[i].Cancelled
+	event.CancelledDate = queue.events[i].CancelledDate
+	queue.events[i] = *event
+
+	if event.Failed {
+		reason := event.LastError()
+		queue.deadLetter(i, reason)
+	}
+	return nil
+}
+
+// deadLetter moves the event at index i into the dead events, the
+// caller must hold the queue lock
+func (queue *MemoryQueue) deadLetter(i int, reason string) {
+	event := queue.events[i]
+	queue.deadEvents = append(queue.deadEvents, db.DeadEvent{
+		ID:       event.ID,
+		DeadDate: primitive.NewDateTimeFromTime(time.Now()),
+		Reason:   reason,
+		Event:    event,
+	})
+	queue.events = append(queue.events[:i], queue.events[i+1:]...)
+}
+
+func (queue *MemoryQueue) ReleaseExpiredLeases(ctx context.Context) (int64, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	now := time.Now()
+	releasedCount := int64(0)
+	for i := range queue.events {
+		event := &queue.events[i]
+		if !event.Started || event.Passed || event.Failed || !now.After(event.LeaseExpiresDate.Time()) {
+			continue
+		}
+
+		maxAttempts := eventMaxAttempts(event)
+		event.UpdatedDate = primitive.NewDateTimeFromTime(now)
+		event.Started = false
+		event.LeaseOwner = ""
+		event.Attempts += 1
+		// a cancelled event stays cancelled instead of being retried
+		event.Failed = !event.Cancelled && event.Attempts >= maxAttempts
+		event.Errors = append(event.Errors, db.EventError{
+			Date:    primitive.NewDateTimeFromTime(now),
+			Attempt: event.Attempts,
+			Class:   db.EVENT_ERROR_CLASS_LEASE_EXPIRED,
+			Message: "lease expired",
+		})
+		releasedCount += 1
+	}
+
+	for i := len(queue.events) - 1; i >= 0; i-- {
+		if queue.events[i].Failed && !queue.events[i].Started {
+			queue.deadLetter(i, "lease expired")
+		}
+	}
+	return releasedCount, nil
+}
+
+func (queue *MemoryQueue) Cancel(ctx context.Context, query *db.EventQuery) (int64, error) {
+	if _, err := query.Filter(); err != nil {
+		return 0, err
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	cancelledCount := int64(0)
+	for i := range queue.events {
+		event := &queue.events[i]
+		if event.Passed || event.Failed || event.Cancelled || !memoryEventMatchesQuery(event, query) {
+			continue
+		}
+		event.UpdatedDate = now
+		event.Cancelled = true
+		event.CancelledDate = now
+		event.DedupKey = ""
+		cancelledCount += 1
+	}
+	return cancelledCount, nil
+}
+
+func (queue *MemoryQueue) Count(ctx context.Context, query *db.EventQuery) (int64, error) {
+	if _, err := query.Filter(); err != nil && err != db.ERROR_EMPTY_EVENT_QUERY {
+		return 0, err
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	count := int64(0)
+	for i := range queue.events {
+		if memoryEventMatchesQuery(&queue.events[i], query) {
+			count += 1
+		}
+	}
+	return count, nil
+}
+
+// Watch isn't supported, workers fall back to polling the queue.
+func (queue *MemoryQueue) Watch(ctx context.Context, notify func()) error {
+	return db.ERROR_CHANGE_STREAMS_UNSUPPORTED
+}
+
+// memoryEventMatchesQuery matches the event the same way the filter of
+// a valid query does.
+func memoryEventMatchesQuery(event *db.Event, query *db.EventQuery) bool {
+	if query.EventId != "" && event.ID.Hex() != query.EventId {
+		return false
+	}
+	if query.EventType != "" && event.EventType != query.EventType {
+		return false
+	}
+	if query.MgrsCode != "" && event.Data["mgrsCode"] != query.MgrsCode {
+		return false
+	}
+	if query.WorkflowId != "" && event.WorkflowId.Hex() != query.WorkflowId {
+		return false
+	}
+
+	pending := !event.Passed && !event.Failed && !event.Cancelled
+	switch query.State {
+	case db.EVENT_STATE_PENDING:
+		return pending && !event.Started
+	case db.EVENT_STATE_RUNNING:
+		return pending && event.Started
+	case db.EVENT_STATE_PASSED:
+		return event.Passed
+	case db.EVENT_STATE_FAILED:
+		return event.Failed
+	case db.EVENT_STATE_CANCELLED:
+		return !event.Passed && event.Cancelled
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestMemoryQueueClaimOrder(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+
+	lowPriority := db.Event{EventType: "RequestMapTask", Priority: 1}
+	highPriority := db.Event{EventType: "BuildBoundaryMapTask", Priority: 4}
+	delayed := db.Event{
+		EventType:      "BuildBoundaryMapTask",
+		Priority:       10,
+		StartAfterDate: primitive.NewDateTimeFromTime(time.Now().Add(time.Hour)),
+	}
+	outOfAttempts := db.Event{EventType: "BuildBoundaryMapTask", Priority: 10, Attempts: 1, MaxAttemps: 1}
+	for _, event := range []*db.Event{&lowPriority, &highPriority, &delayed, &outOfAttempts} {
+		if err := queue.Publish(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimedEvent, err := queue.Claim(ctx, &db.NextEventOptions{ExcludedEventTypes: []string{"BuildBoundaryMapTask"}})
+	if err != nil {
+		t.Fatal(err)
+	} else if claimedEvent.ID != lowPriority.ID {
+		t.Fatal("excluded event types should be skipped")
+	}
+
+	claimedEvent, err = queue.Claim(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if claimedEvent.ID != highPriority.ID {
+		t.Fatal("expected the highest priority runnable event")
+	}
+
+	if _, err := queue.Claim(ctx, nil); err != mongo.ErrNoDocuments {
+		t.Fatalf("expected no documents but found %v", err)
+	}
+
+	if runningCount, err := queue.Count(ctx, &db.EventQuery{State: db.EVENT_STATE_RUNNING}); err != nil {
+		t.Fatal(err)
+	} else if runningCount != 2 {
+		t.Fatalf("expected 2 running events but found %d", runningCount)
+	}
+}
+
+func TestMemoryQueueDedupKey(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+
+	event1 := db.Event{EventType: "RequestCurrentIndexFilesTask", DedupKey: "RequestCurrentIndexFilesTask"}
+	if err := queue.Publish(ctx, &event1); err != nil {
+		t.Fatal(err)
+	}
+	event2 := db.Event{EventType: "RequestCurrentIndexFilesTask", DedupKey: "RequestCurrentIndexFilesTask"}
+	if err := queue.Publish(ctx, &event2); err != db.ERROR_DUPLICATE_EVENT {
+		t.Fatalf("expected a duplicate event error but found %v", err)
+	} else if event2.ID != primitive.NilObjectID {
+		t.Fatal("a refused event should not get an id")
+	}
+
+	// once the first event is claimed the key can be used again
+	if _, err := queue.Claim(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Publish(ctx, &event2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryQueueFairScheduling(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+
+	busyUser := primitive.NewObjectID()
+	otherUser := primitive.NewObjectID()
+	busyEvents := make([]db.Event, 3)
+	for i := range busyEvents {
+		busyEvents[i] = db.Event{EventType: "BuildBoundaryMapTask", Priority: 5, UserId: busyUser}
+		if err := queue.Publish(ctx, &busyEvents[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	otherEvent := db.Event{EventType: "BuildBoundaryMapTask", Priority: 5, UserId: otherUser}
+	if err := queue.Publish(ctx, &otherEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same priority is claimed oldest first
+	claimedEvent, err := queue.Claim(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if claimedEvent.ID != busyEvents[0].ID {
+		t.Fatal("expected the oldest event")
+	}
+
+	// the busy user already has an event running
+	claimedEvent, err = queue.Claim(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if claimedEvent.ID != otherEvent.ID {
+		t.Fatal("expected the event of the user without running events")
+	}
+
+	claimedEvent, err = queue.Claim(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if claimedEvent.ID != busyEvents[1].ID {
+		t.Fatal("expected the next oldest event of the busy user")
+	}
+}
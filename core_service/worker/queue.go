@@ -0,0 +1,113 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Queue is the event queue the worker claims events from and reports
+// their outcome to. MongoQueue is used in production, MemoryQueue keeps
+// everything in process so the worker can be tested without a database.
+type Queue interface {
+	// Publish adds a new event or saves an existing one, a new event
+	// whose dedup key is held by a pending event is refused with
+	// db.ERROR_DUPLICATE_EVENT.
+	Publish(ctx context.Context, event *db.Event) error
+	// Claim leases the next runnable event, mongo.ErrNoDocuments is
+	// returned when there is none.
+	Claim(ctx context.Context, opts *db.NextEventOptions) (*db.Event, error)
+	// RenewLease keeps a claimed event leased, it returns
+	// db.ERROR_EVENT_LEASE_LOST or db.ERROR_EVENT_CANCELLED when the
+	// worker should stop running it.
+	RenewLease(ctx context.Context, event *db.Event, leaseDuration time.Duration) error
+	// Complete stores the outcome of a run if leaseOwner still holds the
+	// lease. Failed events are dead lettered with their last error.
+	Complete(ctx context.Context, event *db.Event, leaseOwner string) error
+	// ReleaseExpiredLeases returns events of crashed workers to the queue
+	// and dead letters the ones out of attempts.
+	ReleaseExpiredLeases(ctx context.Context) (int64, error)
+	Cancel(ctx context.Context, query *db.EventQuery) (int64, error)
+	// Count counts the events matching the query, an empty query
+	// matches every event.
+	Count(ctx context.Context, query *db.EventQuery) (int64, error)
+	// Watch calls notify whenever an event is published until the
+	// context is done, db.ERROR_CHANGE_STREAMS_UNSUPPORTED is returned
+	// when the queue can only be polled.
+	Watch(ctx context.Context, notify func()) error
+}
+
+// MongoQueue keeps the events in the event collection.
+type MongoQueue struct {
+	dbClient *mongo.Client
+}
+
+func NewMongoQueue(dbClient *mongo.Client) *MongoQueue {
+	return &MongoQueue{dbClient: dbClient}
+}
+
+func (queue *MongoQueue) Publish(ctx context.Context, event *db.Event) error {
+	return db.SaveEvent(ctx, queue.dbClient, event)
+}
+
+func (queue *MongoQueue) Claim(ctx context.Context, opts *db.NextEventOptions) (*db.Event, error) {
+	return db.FindNextEvent(ctx, queue.dbClient, opts)
+}
+
+func (queue *MongoQueue) RenewLease(ctx context.Context, event *db.Event, leaseDuration time.Duration) error {
+	return db.RenewEventLease(ctx, queue.dbClient, event, leaseDuration)
+}
+
+func (queue *MongoQueue) Complete(ctx context.Context, event *db.Event, leaseOwner string) error {
+	if err := db.SaveLeasedEvent(ctx, queue.dbClient, event, leaseOwner); err != nil {
+		return err
+	}
+	if event.Failed {
+		reason := event.LastError()
+		if err := db.DeadLetterEvent(ctx, queue.dbClient, event, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (queue *MongoQueue) ReleaseExpiredLeases(ctx context.Context) (int64, error) {
+	releasedCount, err := db.ReleaseExpiredEventLeases(ctx, queue.dbClient, TaskMaxAttempts())
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := db.DeadLetterFailedEvents(ctx, queue.dbClient); err != nil {
+		return 0, err
+	}
+
+	// the workflows are checked here rather than on every Complete so a
+	// large run doesn't count its events again for each one that finishes
+	return releasedCount, CompleteDoneWorkflows(ctx, queue.dbClient)
+}
+
+func (queue *MongoQueue) Cancel(ctx context.Context, query *db.EventQuery) (int64, error) {
+	filter, err := query.Filter()
+	if err != nil {
+		return 0, err
+	}
+	return db.CancelEvents(ctx, queue.dbClient, filter)
+}
+
+func (queue *MongoQueue) Count(ctx context.Context, query *db.EventQuery) (int64, error) {
+	filter, err := query.Filter()
+	if err == db.ERROR_EMPTY_EVENT_QUERY {
+		filter = bson.D{}
+	} else if err != nil {
+		return 0, err
+	}
+	return db.CountEvents(ctx, queue.dbClient, filter)
+}
+
+func (queue *MongoQueue) Watch(ctx context.Context, notify func()) error {
+	return db.WatchEventInserts(ctx, queue.dbClient, notify)
+}
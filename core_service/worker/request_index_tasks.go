@@ -5,19 +5,18 @@ import (
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/alekLukanen/csv-line-filter"
 
@@ -25,6 +24,20 @@ import (
 	satData "core_service/satelliteS3"
 )
 
+// the number of index records parsed before their tiles and events are
+// written, which bounds the memory used by an index run. The settings
+// can override it with IndexBatchSize.
+const DEFAULT_INDEX_BATCH_SIZE = 1000
+
+var (
+	ERROR_PARTIAL_INDEX        = errors.New("Some objects of the index run could not be ingested")
+	ERROR_INDEX_RECORD_COLUMNS = errors.New("Index record does not have 4 columns")
+)
+
+// the invalid records logged for each csv index file or backfill chunk,
+// the rest are only counted
+const LOGGED_INVALID_RECORDS = 10
+
 type ManifestFileItem struct {
 	Key string `json:"key"`
 }
@@ -51,14 +64,15 @@ func UTCFormattedDateOptions(date string) []string {
 	}
 }
 
-func RequestCurrentIndexFilesTask(ctx context.Context, event *db.Event) error {
+func RequestCurrentIndexFilesTask(ctx context.Context, event *db.Event) (*db.EventResult, error) {
 	log.Printf("RequestCurrentIndexFilesTask(%s)\n", event.ID.Hex())
+	result := db.NewEventResult()
 
 	// request the manifest.json file from the inventory
 	// ensure we can retrieve the file
 	dir, err := os.MkdirTemp(db.TEMP_DIR, "process_current_index_file")
 	if err != nil {
-		return err
+		return result, err
 	}
 	defer os.RemoveAll(dir) // clean up
 
@@ -68,14 +82,16 @@ func RequestCurrentIndexFilesTask(ctx context.Context, event *db.Event) error {
 
 	manifestFileName := filepath.Join(dir, "manifest_file.json")
 	foundFile := false
+	foundDateKey := ""
 	for _, dateKey := range dateKeyOptions {
 		objectPath := fmt.Sprintf("sentinel-cogs/sentinel-cogs/%s/manifest.json", dateKey)
-		err = satData.GetObject(ctx, manifestFileName, objectPath, satData.SATELLITE_S3_INVENTORY_BUCKET)
+		err = downloadObject(ctx, result, manifestFileName, objectPath, satData.SATELLITE_S3_INVENTORY_BUCKET)
 		if err != nil {
 			log.Println(err)
 			continue
 		} else {
 			foundFile = true
+			foundDateKey = dateKey
 			log.Println("found manifest file: " + objectPath)
 			break
 		}
@@ -83,151 +99,304 @@ func RequestCurrentIndexFilesTask(ctx context.Context, event *db.Event) error {
 
 	if !foundFile {
 		log.Println("could not find index file")
-		return err
+		return result, err
 	}
 
 	// from the manifest json file get the first gzipped csv file with
 	// all current s3 files. Use this to request the tiled satellite data
 	manifestFile, err := ioutil.ReadFile(manifestFileName)
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	var manifestJsonData ManifestData
 	if err := json.Unmarshal(manifestFile, &manifestJsonData); err != nil {
-		return err
+		return result, err
 	}
 
 	log.Println("index file count in manifest.json: ", len(manifestJsonData.Files))
 	if len(manifestJsonData.Files) == 0 {
 		log.Println("manifest.json file doesn't contain any csv index files")
-		return err
+		return result, err
 	}
 
 	// loop over each index file in the manifest.json
 	dbClient, err := db.DefaultDatabaseClient(ctx)
 	if err != nil {
-		return err
+		return result, err
 	}
 
-	settingColl := db.SettingCollection(dbClient)
-	filters := bson.D{{}}
-	var setting db.Setting
-	err = settingColl.FindOne(ctx, filters).Decode(&setting)
+	setting, err := db.FindCurrentSetting(ctx, dbClient)
 	if err != nil {
 		log.Println("failed to load settings")
-		return err
+		return result, err
+	}
+	log.Println("setting object used: ", *setting)
+	result.SettingVersion = setting.Version
+
+	var boundaryMgrsSquares []string
+	if setting.IndexMode == db.INDEX_MODE_BOUNDARIES {
+		boundaryMgrsSquares, err = db.RebuildBoundaryMgrsSquares(ctx, dbClient)
+		if err != nil {
+			log.Println("failed to rebuild the mgrs squares of the boundaries")
+			return result, err
+		}
+	}
+	indexFilter, err := NewIndexFilter(setting, boundaryMgrsSquares)
+	if err != nil {
+		log.Println("failed to build the index filter from the settings")
+		return result, err
+	}
+	batchSize := setting.IndexBatchSize
+	if batchSize < 1 {
+		batchSize = DEFAULT_INDEX_BATCH_SIZE
+	}
+
+	// every event published from this index run is part of one workflow
+	// so the run can be tracked until the last map is built, the rasters
+	// of deleted boundaries are cleaned up once every map of the run passed
+	if event.WorkflowId.IsZero() {
+		workflow := db.Workflow{Name: INDEX_RUN_WORKFLOW, RunKey: foundDateKey}
+		if err := db.StartWorkflow(ctx, dbClient, &workflow, event, NewRasterCleanupEvent()); err != nil {
+			log.Println("failed to start the index run workflow")
+			return result, err
+		}
 	}
-	log.Println("setting object used: ", setting)
 
 
 	compressedCsvIndexFileName := filepath.Join(dir, "index.csv.gz")
 	for fileIndex, fileItem := range manifestJsonData.Files {
 		csvIndexFileKey := fileItem.Key
 
+		// inventory files are only ingested once for each setting version,
+		// a re-run of the task picks up where the last one stopped
+		ingested, err := db.InventoryFileIngested(ctx, dbClient, csvIndexFileKey, setting.Version)
+		if err != nil {
+			return result, err
+		} else if ingested {
+			log.Printf("[%d / %d]skipping ingested csv index file: %s\n", fileIndex+1, len(manifestJsonData.Files), csvIndexFileKey)
+			result.AddCount("skippedIndexFiles", 1)
+			continue
+		}
+
 		log.Printf("[%d / %d]requesting csv index file: %s\n", fileIndex+1, len(manifestJsonData.Files), csvIndexFileKey)
 		
-		if err := satData.GetObject(ctx, compressedCsvIndexFileName, csvIndexFileKey, satData.SATELLITE_S3_INVENTORY_BUCKET); err != nil {
+		if err := downloadObject(ctx, result, compressedCsvIndexFileName, csvIndexFileKey, satData.SATELLITE_S3_INVENTORY_BUCKET); err != nil {
 			log.Println("failed to request csv index file from s3")
-			return err
+			return result, err
 		}
 
 		// parse the inventory file and produce tile objects in the database
-		// these will be requested by another task set
-		tiles, err := CreateTilesFromCsvIndexFile(compressedCsvIndexFileName, &setting)
-		if err != nil {
-			log.Println("failed to create tiles")
-			return err
+		// along with the events to request their files
+		inventoryFile := db.InventoryFile{Key: csvIndexFileKey, RunKey: foundDateKey, SettingVersion: setting.Version}
+		if err := IngestCsvIndexFile(ctx, dbClient, event, &inventoryFile, compressedCsvIndexFileName, indexFilter, batchSize, result); err != nil {
+			log.Println("failed to ingest csv index file")
+			return result, err
 		}
+		result.AddCount("indexFiles", 1)
 
-		if err := UpdateOrCreateTiles(ctx, tiles, dbClient); err != nil {
-			log.Println("failed to save tiles to db")
-			return err
+		// the objects which failed aren't marked as ingested, leaving the
+		// file unmarked lets the next run retry them
+		if inventoryFile.FailedObjectCount > 0 {
+			log.Printf("%d objects of the csv index file failed to be ingested\n", inventoryFile.FailedObjectCount)
+			result.AddCount("failedIndexFiles", 1)
+			continue
 		}
-
-		// publish events to process the new tile files
-		events, err := CreateTileFileEventsFromCsvIndexFile(compressedCsvIndexFileName, &setting)
-		if err != nil {
-			log.Println("failed to create tile file events")
-			return err
+		if err := db.SaveInventoryFile(ctx, dbClient, &inventoryFile); err != nil {
+			log.Println("failed to save the inventory file")
+			return result, err
 		}
 
-		if err := PublishTileFileEvents(ctx, events, dbClient); err != nil {
-			log.Println("faild to save tiles file events to db")
-			return err
-		}
-		
 	}
-	return nil
-}
 
-func PublishTileFileEvents(ctx context.Context, events *[]db.Event, dbClient *mongo.Client) error {
-	log.Printf("creating %d events", len(*events))
-
-	for _, event := range *events {
-		if err := db.SaveEvent(ctx, dbClient, &event); err != nil {
-			return err
-		}
+	if failedObjects := result.Counts["failedObjects"]; failedObjects > 0 {
+		return result, fmt.Errorf("%w: %d objects failed", ERROR_PARTIAL_INDEX, failedObjects)
 	}
-
-	return nil
+	return result, nil
 }
 
-func CreateTileFileEventsFromCsvIndexFile(compressedCsvIndexFileName string, setting *db.Setting) (*[]db.Event, error) {
+// IngestCsvIndexFile streams the records of the gzipped csv index file
+// and writes the tiles and events of the objects no earlier run
+// ingested, one batch of records at a time. The object counts are set
+// on the inventory file.
+func IngestCsvIndexFile(ctx context.Context, dbClient *mongo.Client, parentEvent *db.Event, inventoryFile *db.InventoryFile, compressedCsvIndexFileName string, indexFilter *IndexFilter, batchSize int, result *db.EventResult) error {
 	compressedCsvFile, err := os.Open(compressedCsvIndexFileName)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer compressedCsvFile.Close()
 
-	compressedCsvIndexFileReader, err := gzip.NewReader(compressedCsvFile)
+	return ScanCsvIndexFile(compressedCsvFile, indexFilter, batchSize, func(records [][]string) error {
+		return ingestIndexRecords(ctx, dbClient, parentEvent, inventoryFile, records, nil, batchSize, result)
+	}, invalidRecordCounter(inventoryFile.Key, result))
+}
+
+// invalidRecordCounter counts the records whose keys can't be parsed and
+// logs the first few of them.
+func invalidRecordCounter(source string, result *db.EventResult) func([]string, error) {
+	invalidRecords := 0
+	return func(record []string, err error) {
+		invalidRecords++
+		if invalidRecords <= LOGGED_INVALID_RECORDS {
+			log.Printf("invalid record in %s: %s\n", source, err)
+		}
+		result.AddCount("invalidObjects", 1)
+	}
+}
+
+// ScanCsvIndexFile reads the gzipped csv index file once and hands the
+// records which pass the index filter to handleBatch, at most batchSize
+// records at a time. Records which can't be parsed are handed to
+// handleInvalid and skipped.
+func ScanCsvIndexFile(compressedCsvIndexFile io.Reader, indexFilter *IndexFilter, batchSize int, handleBatch func([][]string) error, handleInvalid func([]string, error)) error {
+	compressedCsvIndexFileReader, err := gzip.NewReader(compressedCsvIndexFile)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer compressedCsvIndexFileReader.Close()
 
-	lineFilterExpression := lineFilterRegularExpression(setting)
+	lineFilterExpression := lineFilterRegularExpression(indexFilter.zones())
 	csvLineFilterReader, err := csvLineFilter.NewCSVLineFilter(compressedCsvIndexFileReader, lineFilterExpression)
     if err != nil {
-        return nil, err
+        return err
     }
 
-	utmZones := make(map[string]bool)
-	for _, zone := range setting.UtmZones {
-		utmZones[zone] = true
-	}
-	tileFiles := make(map[string]bool)
-	for _, fileType := range setting.TileFiles {
-		tileFiles[fileType] = true
-	}
-	startDate := setting.TileStartDate.Time()
-
 	csvReader := csv.NewReader(csvLineFilterReader)
-	events := make([]db.Event, 0, 1000)
+	records := make([][]string, 0, batchSize)
 	for {
 		record, err := csvReader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if !recordIsConsumeable(record, utmZones, tileFiles, startDate) {
+		if consumed, err := indexFilter.Consumes(record); err != nil {
+			handleInvalid(record, err)
+			continue
+		} else if !consumed {
 			continue
 		}
 
-		event := parseEventFromRecord(record)
-		events = append(events, event)
+		records = append(records, record)
+		if len(records) >= batchSize {
+			if err := handleBatch(records); err != nil {
+				return err
+			}
+			records = make([][]string, 0, batchSize)
+		}
+	}
+
+	if len(records) > 0 {
+		return handleBatch(records)
+	}
+	return nil
+}
+
+// ingestIndexRecords writes the tiles and events for the records whose
+// objects haven't been ingested and then marks the objects as ingested,
+// so a failed run doesn't lose any of them. Objects whose event failed
+// to be saved are counted on the inventory file and left for the next
+// run. New tiles get the geometry and scene metadata of the tile in
+// sceneTiles under their unique key, when there is one.
+func ingestIndexRecords(ctx context.Context, dbClient *mongo.Client, parentEvent *db.Event, inventoryFile *db.InventoryFile, records [][]string, sceneTiles map[string]db.Tile, batchSize int, result *db.EventResult) error {
+	// the inventory lists every object in the bucket each day, only the
+	// objects no earlier run ingested need tiles and events
+	objectPaths := make([]string, 0, len(records))
+	for _, record := range records {
+		objectPaths = append(objectPaths, record[1])
+	}
+	newObjectPaths, err := db.FindNewObjectPaths(ctx, dbClient, objectPaths)
+	if err != nil {
+		log.Println("failed to find the new objects")
+		return err
+	}
+	tiles, events := newTilesAndEvents(records, newObjectPaths)
+	for i := range tiles {
+		if sceneTile, hasSceneTile := sceneTiles[tiles[i].UniqueKey()]; hasSceneTile {
+			tiles[i].Geometry = sceneTile.Geometry
+			tiles[i].SceneMetadata = sceneTile.SceneMetadata
+		}
+	}
+
+	// the map tasks need the tiles, so there is no point in publishing
+	// events when they couldn't be saved
+	if _, err := db.BulkUpsertTiles(ctx, dbClient, tiles, batchSize); err != nil {
+		log.Println("failed to save tiles to db")
+		return err
+	}
+
+	// the dedup key on each event lets the task be re-run after a crash
+	// without queueing the same file twice
+	for i := range events {
+		events[i] = db.NewChildEvent(parentEvent, events[i])
+	}
+	eventReport, err := db.BulkSaveEvents(ctx, dbClient, events, batchSize)
+	if err != nil {
+		log.Println("failed to save some tile file events to db:", err)
+	}
+
+	failedIndexes := eventReport.FailedIndexes()
+	ingestedObjectPaths := make([]string, 0, len(events))
+	for i, event := range events {
+		if !failedIndexes[i] {
+			ingestedObjectPaths = append(ingestedObjectPaths, event.Data["objectPath"])
+		}
+	}
+	if err := db.MarkObjectsIngested(ctx, dbClient, inventoryFile.Key, ingestedObjectPaths); err != nil {
+		log.Println("failed to mark the objects as ingested")
+		return err
+	}
+
+	inventoryFile.ObjectCount += int64(len(objectPaths))
+	inventoryFile.NewObjectCount += int64(len(newObjectPaths))
+	inventoryFile.FailedObjectCount += int64(len(eventReport.Failures))
+	result.AddCount("objects", int64(len(objectPaths)))
+	result.AddCount("newObjects", int64(len(newObjectPaths)))
+	result.AddCount("failedObjects", int64(len(eventReport.Failures)))
+	result.AddCount("tiles", int64(len(tiles)))
+	result.AddCount("eventsPublished", int64(eventReport.Written))
+	result.AddCount("duplicateEvents", int64(eventReport.Duplicates))
+	return nil
+}
+
+// newTilesAndEvents builds an event for each record of a new object path
+// and the tiles those objects belong to.
+func newTilesAndEvents(records [][]string, newObjectPaths []string) ([]db.Tile, []db.Event) {
+	newObjects := make(map[string]bool)
+	for _, objectPath := range newObjectPaths {
+		newObjects[objectPath] = true
 	}
 
-	return &events, nil
+	tileKeys := make(map[string]bool)
+	tiles := make([]db.Tile, 0)
+	events := make([]db.Event, 0, len(newObjectPaths))
+	for _, record := range records {
+		if !newObjects[record[1]] {
+			continue
+		}
+		// the records were parsed by the index filter already
+		sceneKey, err := satData.ParseSceneKey(record[1])
+		if err != nil {
+			continue
+		}
+		events = append(events, parseEventFromRecord(record))
+
+		scene := sceneKey.Scene()
+		tile := tileFromScene(&scene)
+		if !tileKeys[tile.UniqueKey()] {
+			tileKeys[tile.UniqueKey()] = true
+			tiles = append(tiles, tile)
+		}
+	}
+	return tiles, events
 }
 
 func parseEventFromRecord(record []string) db.Event {
 	return db.Event{
 		EventType: "RequestMapTask",
-		MaxAttemps: 1,
 		Priority: 5,
+		DedupKey: fmt.Sprintf("RequestMapTask/%s", record[1]),
 		Data: map[string]string{
 			"objectPath": record[1],
 			"size": record[2],
@@ -235,75 +404,77 @@ func parseEventFromRecord(record []string) db.Event {
 	}
 }
 
-func UpdateOrCreateTiles(ctx context.Context, tiles *[]db.Tile, dbClient *mongo.Client) error {
-	log.Printf("creating %d tiles", len(*tiles))
+// IndexFilter decides which records of the csv index files are
+// consumed. It is built once per index run since the mgrs squares of
+// large areas of interest take a while to compute.
+type IndexFilter struct {
+	utmZones    map[string]bool
+	mgrsSquares map[string]bool
+	tileFiles   map[string]bool
+	startDate   time.Time
+	// scenes after the end date are skipped, unless it is zero
+	endDate time.Time
+}
 
-	for _, tile := range *tiles {
-		if _, err := db.UpdateOrCreateTile(ctx, dbClient, &tile); err != nil {
-			return err
-		}
+// NewIndexFilter filters on the mgrs squares touched by the areas of
+// interest of the setting, along with the squares of the boundaries in
+// the boundaries index mode, or on its utm zones when it has neither.
+func NewIndexFilter(setting *db.Setting, boundaryMgrsSquares []string) (*IndexFilter, error) {
+	indexFilter := IndexFilter{
+		utmZones:    make(map[string]bool),
+		mgrsSquares: make(map[string]bool),
+		tileFiles:   make(map[string]bool),
+		startDate:   setting.TileStartDate.Time(),
+	}
+	for _, fileType := range setting.TileFiles {
+		indexFilter.tileFiles[fileType] = true
 	}
 
-	return nil
-}
-
-func CreateTilesFromCsvIndexFile(compressedCsvIndexFileName string, setting *db.Setting) (*[]db.Tile, error) {
-	compressedCsvFile, err := os.Open(compressedCsvIndexFileName)
-	if err != nil {
-		return nil, err
+	if len(setting.AreasOfInterest) == 0 && setting.IndexMode != db.INDEX_MODE_BOUNDARIES {
+		for _, zone := range setting.UtmZones {
+			indexFilter.utmZones[zone] = true
+		}
+		return &indexFilter, nil
 	}
-	defer compressedCsvFile.Close()
 
-	compressedCsvIndexFileReader, err := gzip.NewReader(compressedCsvFile)
+	mgrsSquares, err := setting.IndexMgrsSquares()
 	if err != nil {
 		return nil, err
 	}
-	defer compressedCsvIndexFileReader.Close()
-
-	lineFilterExpression := lineFilterRegularExpression(setting)
-	csvLineFilterReader, err := csvLineFilter.NewCSVLineFilter(compressedCsvIndexFileReader, lineFilterExpression)
-    if err != nil {
-        return nil, err
-    }
-
-	utmZones := make(map[string]bool)
-	for _, zone := range setting.UtmZones {
-		utmZones[zone] = true
+	if setting.IndexMode == db.INDEX_MODE_BOUNDARIES {
+		mgrsSquares = append(mgrsSquares, boundaryMgrsSquares...)
 	}
-	tileFiles := make(map[string]bool)
-	for _, fileType := range setting.TileFiles {
-		tileFiles[fileType] = true
+	for _, mgrsSquare := range mgrsSquares {
+		indexFilter.mgrsSquares[mgrsSquare] = true
+		// the zone is the square without its two letter id
+		indexFilter.utmZones[mgrsSquare[:len(mgrsSquare)-2]] = true
 	}
-	startDate := setting.TileStartDate.Time()
-
-	csvReader := csv.NewReader(csvLineFilterReader)
-	tileMap := make(map[string]db.Tile)
-	for {
-		record, err := csvReader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		if !recordIsConsumeable(record, utmZones, tileFiles, startDate) {
-			continue
-		}
+	log.Printf("indexing %d mgrs squares in %d utm zones\n", len(indexFilter.mgrsSquares), len(indexFilter.utmZones))
+	return &indexFilter, nil
+}
 
-		tile := parseTileFromRecord(record)
-		if _, exists := tileMap[tile.UniqueKey()]; exists == false {
-			tileMap[tile.UniqueKey()] = tile
-		}
+// zones returns the sorted utm zones the filter consumes records from.
+func (obj *IndexFilter) zones() []string {
+	zones := make([]string, 0, len(obj.utmZones))
+	for zone := range obj.utmZones {
+		zones = append(zones, zone)
 	}
+	sort.Strings(zones)
+	return zones
+}
 
-	tiles := make([]db.Tile, 0, len(tileMap))
-	for _, value := range tileMap {
-		tiles = append(tiles, value)
-	}
-	return &tiles, nil
+// Consumes reports if the filter takes the record. Records of the
+// filtered zones whose key can't be parsed return the parse error.
+func (obj *IndexFilter) Consumes(record []string) (bool, error) {
+	return recordIsConsumeable(record, obj.utmZones, obj.mgrsSquares, obj.tileFiles, obj.startDate, obj.endDate)
 }
 
-func recordIsConsumeable(record []string, validUtmZones, validFiles map[string]bool, startDate time.Time) bool {
+// recordIsConsumeable checks the record against the filter, when valid
+// mgrs squares are given the record's square must be one of them.
+func recordIsConsumeable(record []string, validUtmZones, validMgrsSquares, validFiles map[string]bool, startDate, endDate time.Time) (bool, error) {
+	if len(record) != 4 {
+		return false, ERROR_INDEX_RECORD_COLUMNS
+	}
 
 	// prefilt the records since only a few zones will be used
 	containsValidUtmZone := false
@@ -313,95 +484,48 @@ func recordIsConsumeable(record []string, validUtmZones, validFiles map[string]b
 		}
 	}
 	if !containsValidUtmZone {
-		return false
+		return false, nil
 	}
 
-	if len(record) != 4 {
-		return false
+	sceneKey, err := satData.ParseSceneKey(record[1])
+	if err != nil {
+		return false, err
 	}
-
-	keyItems := strings.Split(record[1], "/")
-	if len(keyItems) != 8 {
-		return false
+	if !validUtmZones[sceneKey.UtmZone] {
+		return false, nil
 	}
-	utmCode := fmt.Sprintf("%s%s", keyItems[1], keyItems[2])
-	if _, exists := validUtmZones[utmCode]; exists != true {
-		return false
+	if len(validMgrsSquares) > 0 && !validMgrsSquares[sceneKey.MgrsCode] {
+		return false, nil
 	}
-
-	jsonMetaData := fmt.Sprintf("%s.json", keyItems[6])
-	if _, exists := validFiles[keyItems[7]]; exists != true && keyItems[7] != jsonMetaData {
-		return false
-	}
-
-	compoundItems := strings.Split(keyItems[6], "_")
-	if len(compoundItems) != 5 {
-		return false
+	if !validFiles[sceneKey.FileName] && !sceneKey.IsMetadata() {
+		return false, nil
 	}
-	sourceSatellite := fmt.Sprintf("%s-%s", compoundItems[0], compoundItems[4])
-	if sourceSatellite != "S2A-L2A" && sourceSatellite != "S2B-L2A" {
-		return false
+	if sceneKey.ProcessingLevel != "L2A" {
+		return false, nil
 	}
 
-	dateItem := compoundItems[2]
-	year, err := strconv.Atoi(dateItem[:4])
-    if err != nil {
-        return false
-    }
-	month, err := strconv.Atoi(dateItem[4:6])
-    if err != nil {
-        return false
-    }
-	day, err := strconv.Atoi(dateItem[6:])
-    if err != nil {
-        return false
-    }
-
-	location, err := time.LoadLocation("UTC")
-	if err != nil {
-		return false
-	}
-	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, location)
+	date := sceneKey.Date()
 	if !date.After(startDate) {
-		return false
+		return false, nil
+	}
+	if !endDate.IsZero() && date.After(endDate) {
+		return false, nil
 	}
 
-	return true
-}
-
-func parseTileFromRecord(record []string) db.Tile {
-	return parseTileFromObjectPath(record[1])
-}
-func parseTileFromObjectPath(objectPath string) db.Tile {
-	keyItems := strings.Split(objectPath, "/")
-	mgrsCode := fmt.Sprintf("%s%s%s", keyItems[1], keyItems[2], keyItems[3])
-
-	compoundItems := strings.Split(keyItems[6], "_")
-	dateItem := compoundItems[2]
-	year, _ := strconv.Atoi(dateItem[:4])
-	month, _ := strconv.Atoi(dateItem[4:6])
-	day, _ := strconv.Atoi(dateItem[6:])
-	location, _ := time.LoadLocation("UTC")
-	date := primitive.NewDateTimeFromTime(time.Date(year, time.Month(month), day, 0, 0, 0, 0, location))
-	sourceSatellite := fmt.Sprintf("%s-%s", compoundItems[0], compoundItems[4])
-
-	tile := db.Tile{
-		Date: date,
-		MgrsCode: mgrsCode,
-		SourceSatellite: sourceSatellite,
-	}
-	return tile
+	return true, nil
 }
 
-func lineFilterRegularExpression(setting *db.Setting) string {
+// lineFilterRegularExpression matches the zones in the scene ids, which
+// can be written like _39P, _T39P or _04Q.
+func lineFilterRegularExpression(utmZones []string) string {
 
-	if len(setting.UtmZones) == 0 {
+	if len(utmZones) == 0 {
 		return ""
 	}
 
-	regularExpression := fmt.Sprintf("(_%s)", setting.UtmZones[0])
-	for _, zone := range setting.UtmZones[1:] {
-		regularExpression = fmt.Sprintf("%s|(_%s)", regularExpression, zone)
+	regularExpression := fmt.Sprintf("(_T?0?%s)", utmZones[0])
+	for _, zone := range utmZones[1:] {
+		regularExpression = fmt.Sprintf("%s|(_T?0?%s)", regularExpression, zone)
 	}
 
 	return regularExpression
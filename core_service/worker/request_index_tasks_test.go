@@ -1,154 +1,157 @@
 package worker
 
 import (
-	"context"
-	"fmt"
 	"os"
 	"reflect"
 	"testing"
 	"time"
 
 	db "core_service/database"
-	satData "core_service/satelliteS3"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-
-func TestRequestCurrentIndexFilesTask(t *testing.T) {
-	// upload a manifest.json file with one index.csv.gz file
-	// the process should build tiles: 39PUL, 18QZG
-	db.CleanTestDatabase()
-
-	ctx := context.Background()
-	dbClient, err := db.DefaultDatabaseClient(ctx)
+func TestScanCsvIndexFile(t *testing.T) {
+	indexFile, err := os.Open("example_data/small-index.csv.gz")
 	if err != nil {
 		t.Fatal(err)
 	}
-	objectSession, err := satData.S3Session(ctx, satData.SATELLITE_S3_INVENTORY_BUCKET)
+	defer indexFile.Close()
+
+	setting := db.Setting{
+		UtmZones:      []string{"39P", "18Q"},
+		TileFiles:     []string{"B04.tif", "B08.tif"},
+		TileStartDate: primitive.NewDateTimeFromTime(time.Date(2018, time.Month(1), 1, 0, 0, 0, 0, time.UTC)),
+	}
+	indexFilter, err := NewIndexFilter(&setting, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	uploader := manager.NewUploader(objectSession)
 
-	// upload manifest and index files
-	manifestFile, err := os.Open("example_data/small-manifest.json")
+	batchSizes := make([]int, 0)
+	objectPaths := make(map[string]bool)
+	err = ScanCsvIndexFile(indexFile, indexFilter, 3, func(records [][]string) error {
+		batchSizes = append(batchSizes, len(records))
+		for _, record := range records {
+			objectPaths[record[1]] = true
+		}
+		return nil
+	}, func(record []string, err error) {
+		t.Errorf("unexpected invalid record %v: %v", record, err)
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer manifestFile.Close()
 
-	dateKey := UTCFormattedDateOptions("")[0]
-	manifestKey := fmt.Sprintf("/sentinel-cogs/sentinel-cogs/%s/manifest.json", dateKey)
-	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(satData.SATELLITE_S3_INVENTORY_BUCKET),
-		Key:    aws.String(manifestKey),
-		Body:   manifestFile,
-	})
-	if err != nil {
-		// Print the error and exit.
-		t.Fatalf("Unable to upload: %v", err)
+	if !reflect.DeepEqual(batchSizes, []int{3, 1}) {
+		t.Fatalf("expected batches of 3 and 1 records but found %v", batchSizes)
 	}
+	expectedObjectPaths := map[string]bool{
+		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif": true,
+		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B08.tif": true,
+		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/S2A_39PUL_20190914_0_L2A.json": true,
+		"sentinel-s2-l2a-cogs/18/Q/ZG/2020/1/S2A_18QZG_20200129_0_L2A/B04.tif": true,
+	}
+	if !reflect.DeepEqual(objectPaths, expectedObjectPaths) {
+		t.Fatalf("unexpected records: %v", objectPaths)
+	}
+}
 
-	indexFile, err := os.Open("example_data/small-index.csv.gz")
+func TestIndexFilterAreasOfInterest(t *testing.T) {
+	setting := db.Setting{
+		// the area of interest replaces the utm zones
+		UtmZones:  []string{"18Q"},
+		TileFiles: []string{"B04.tif"},
+		AreasOfInterest: []db.Geometry{{Type: "Polygon", Coordinates: [][][]float64{
+			{{49.5, 9.5}, {49.55, 9.5}, {49.55, 9.55}, {49.5, 9.55}, {49.5, 9.5}},
+		}}},
+		TileStartDate: primitive.NewDateTimeFromTime(time.Date(2018, time.Month(1), 1, 0, 0, 0, 0, time.UTC)),
+	}
+	indexFilter, err := NewIndexFilter(&setting, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer indexFile.Close()
 
-	indexKey := "sentinel-cogs/sentinel-cogs/data/uuid4-here.csv.gz"
-	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(satData.SATELLITE_S3_INVENTORY_BUCKET),
-		Key:    aws.String(indexKey),
-		Body:   indexFile,
-	})
-	if err != nil {
-		// Print the error and exit.
-		t.Fatalf("Unable to upload: %v", err)
+	if expression := lineFilterRegularExpression(indexFilter.zones()); expression != "(_T?0?39P)" {
+		t.Errorf("expected the line filter to match the 39P zone but found %s", expression)
 	}
 
-	// add settings to database
-	location, err := time.LoadLocation("UTC")
-	if err != nil {
-		t.Fatal(err)
+	testCases := []struct {
+		objectPath string
+		consumed   bool
+	}{
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif", true},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B08.tif", false},
+		{"sentinel-s2-l2a-cogs/39/P/TL/2019/9/S2A_39PTL_20190914_0_L2A/B04.tif", false},
+		{"sentinel-s2-l2a-cogs/18/Q/ZG/2020/1/S2A_18QZG_20200129_0_L2A/B04.tif", false},
+	}
+	for _, testCase := range testCases {
+		record := []string{"sentinel-cogs", testCase.objectPath, "100", "2019-09-15T00:00:00.000Z"}
+		if consumed, err := indexFilter.Consumes(record); err != nil || consumed != testCase.consumed {
+			t.Errorf("expected %s to be consumed %t: %v", testCase.objectPath, testCase.consumed, err)
+		}
 	}
+}
+
+func TestIndexFilterBoundaries(t *testing.T) {
 	setting := db.Setting{
-		UtmZones: []string{"39P", "18Q"},
-		TileFiles: []string{"B04.tif", "B08.tif"},
-		TileStartDate: primitive.NewDateTimeFromTime(time.Date(2018, time.Month(1), 1, 0, 0, 0, 0, location)),
+		UtmZones:      []string{"39P"},
+		TileFiles:     []string{"B04.tif"},
+		IndexMode:     db.INDEX_MODE_BOUNDARIES,
+		TileStartDate: primitive.NewDateTimeFromTime(time.Date(2018, time.Month(1), 1, 0, 0, 0, 0, time.UTC)),
 	}
-	err = db.SaveSetting(ctx, dbClient, &setting)
+	indexFilter, err := NewIndexFilter(&setting, []string{"18QZG"})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// now ensure that the index file task creates the tiles
-	// and distributes the tile download events
-	if taskErr := RequestCurrentIndexFilesTask(ctx, &db.Event{}); taskErr != nil {
-		t.Fatal(err)
-	}
-
-	tileColl := db.TileCollection(dbClient)
-	if tileCount, err := tileColl.CountDocuments(ctx, bson.D{{}}); err != nil || tileCount != 2 {
-		t.Errorf("expected only 2 documents but found %d", tileCount)
+	testCases := []struct {
+		objectPath string
+		consumed   bool
+	}{
+		{"sentinel-s2-l2a-cogs/18/Q/ZG/2020/1/S2A_18QZG_20200129_0_L2A/B04.tif", true},
+		{"sentinel-s2-l2a-cogs/18/Q/YG/2020/1/S2A_18QYG_20200129_0_L2A/B04.tif", false},
+		{"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif", false},
 	}
-
-	var tile1 db.Tile
-	if err = tileColl.FindOne(ctx, bson.D{{"mgrs_code", "39PUL"}}).Decode(&tile1); err != nil {
-		if err == mongo.ErrNoDocuments {
-			t.Error("could not find tile in database")
-		}
-		t.Fatal("failed getting tile")
-	} else if (
-		tile1.Date != primitive.NewDateTimeFromTime(time.Date(2019, time.Month(9), 14, 0, 0, 0, 0, location)) || 
-		tile1.SourceSatellite != "S2A-L2A" || 
-		len(tile1.Files) != 0) {
-		t.Fatalf("tile1 not correct: %v", tile1)
-	}
-
-	var tile2 db.Tile
-	if err = tileColl.FindOne(ctx, bson.D{{"mgrs_code", "18QZG"}}).Decode(&tile2); err != nil {
-		if err == mongo.ErrNoDocuments {
-			t.Error("could not find tile in database")
+	for _, testCase := range testCases {
+		record := []string{"sentinel-cogs", testCase.objectPath, "100", "2020-02-01T00:00:00.000Z"}
+		if consumed, err := indexFilter.Consumes(record); err != nil || consumed != testCase.consumed {
+			t.Errorf("expected %s to be consumed %t: %v", testCase.objectPath, testCase.consumed, err)
 		}
-		t.Fatal("failed getting tile")
-	} else if (
-		tile2.Date !=  primitive.NewDateTimeFromTime(time.Date(2020, time.Month(1), 29, 0, 0, 0, 0, location)) || 
-		tile1.SourceSatellite != "S2A-L2A" || 
-		len(tile1.Files) != 0) {
-		t.Fatalf("tile1 not correct: %v", tile1)
 	}
 
-	// ensure the events were distributed
-	eventColl := db.EventCollection(dbClient)
-	if eventCount, err := eventColl.CountDocuments(ctx, bson.D{{}}); err != nil || eventCount != 4 {
-		t.Errorf("expect 4 events but found %d", eventCount)
+	// without any boundaries nothing is indexed
+	indexFilter, err = NewIndexFilter(&setting, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := []string{"sentinel-cogs", testCases[0].objectPath, "100", "2020-02-01T00:00:00.000Z"}
+	if consumed, err := indexFilter.Consumes(record); err != nil || consumed {
+		t.Errorf("expected no records to be consumed without boundaries: %v", err)
 	}
+}
 
-	var events []db.Event
-	cursor, err := eventColl.Find(ctx, bson.D{{"event_type", "RequestMapTask"}})
-	if err = cursor.All(ctx, &events); err != nil {
-		t.Fatal(err)
+func TestNewTilesAndEvents(t *testing.T) {
+	objectPaths := []string{
+		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif",
+		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B08.tif",
+		"sentinel-s2-l2a-cogs/18/Q/ZG/2020/1/S2A_18QZG_20200129_0_L2A/B04.tif",
+	}
+	records := make([][]string, 0, len(objectPaths))
+	for _, objectPath := range objectPaths {
+		records = append(records, []string{"sentinel-cogs", objectPath, "100", ""})
 	}
 
-	expectedFiles := map[string]bool{
-		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B04.tif": true,
-		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/B08.tif": true,
-		"sentinel-s2-l2a-cogs/39/P/UL/2019/9/S2A_39PUL_20190914_0_L2A/S2A_39PUL_20190914_0_L2A.json": true,
-		"sentinel-s2-l2a-cogs/18/Q/ZG/2020/1/S2A_18QZG_20200129_0_L2A/B04.tif": true,
+	tiles, events := newTilesAndEvents(records, objectPaths[:2])
+	if len(tiles) != 1 || tiles[0].MgrsCode != "39PUL" {
+		t.Fatalf("expected only the 39PUL tile but found %v", tiles)
 	}
-	actualFiles := make(map[string]bool)
-	for _, event := range events {
-		actualFiles[event.Data["objectPath"]] = true
+	if len(events) != 2 || events[0].Data["objectPath"] != objectPaths[0] || events[1].Data["objectPath"] != objectPaths[1] {
+		t.Fatalf("expected the events of the new objects but found %v", events)
 	}
-	if !reflect.DeepEqual(expectedFiles, actualFiles) {
-		t.Log(actualFiles)
-		t.Fatal("file listing in events is not correct")
+
+	if tiles, events := newTilesAndEvents(records, []string{}); len(tiles) != 0 || len(events) != 0 {
+		t.Fatal("expected no tiles or events without new objects")
 	}
 }
 
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -16,66 +15,46 @@ import (
 	satData "core_service/satelliteS3"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // to reduce bandwidth costs and improve application performance
 // simply insert the map reference into the tiles Files array on the
 // Tile. Then distribute a map event for each Boundary effected by
 // the new map file.
-func RequestMapTask(ctx context.Context, event *db.Event) error {
+func RequestMapTask(ctx context.Context, event *db.Event) (*db.EventResult, error) {
 	log.Printf("RequestMapTask(%s)\n", event.ID.Hex())
+	result := db.NewEventResult()
 
 	dbClient, err := db.DefaultDatabaseClient(ctx)
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	// construct the tile file object
 	objectPath, hasObjectPathName := event.Data["objectPath"]
 	if !hasObjectPathName || len(objectPath) == 0 {
-		return errors.New("missing file name on event")
+		return result, Permanent(errors.New("missing file name on event"))
 	}
 
 	size, hasSize := event.Data["size"]
 	if !hasSize || len(size) == 0 {
-		return errors.New("missing size on event")
+		return result, Permanent(errors.New("missing size on event"))
 	}
 	sizeValue, err := strconv.Atoi(size)
 	if err != nil {
-		return err
+		return result, Permanent(err)
 	}
 
-	keyItems := strings.Split(objectPath, "/")
-	if len(keyItems) != 8 {
-		log.Println(keyItems)
-		return errors.New("number of items not 7")
-	}
-	band := keyItems[7]
-
-	fileUse := "satBand"
-	jsonMetaDataFileName := fmt.Sprintf("%s.json", keyItems[6])
-	if keyItems[7] == jsonMetaDataFileName {
-		fileUse = "jsonMeta"
-	}
-
-	compoundItems := strings.Split(keyItems[6], "_")
-	if len(compoundItems) != 5 {
-		log.Println(compoundItems)
-		return errors.New("compound items not equal to 4")
-	}
-	version, err := strconv.Atoi(compoundItems[3])
+	sceneKey, err := satData.ParseSceneKey(objectPath)
 	if err != nil {
-		return errors.New("version was not an integer")
+		return result, Permanent(err)
 	}
 
-	tileFile := db.TileFile{
-		FileUse:    fileUse,
-		Band:       band,
-		Version:    version,
-		Size:       sizeValue,
-		ObjectPath: objectPath,
-	}
-	tileInfo := parseTileFromObjectPath(objectPath)
+	sceneFile := sceneKey.SceneFile(sizeValue)
+	tileFile := tileFileFromScene(&sceneFile)
+	scene := sceneKey.Scene()
+	tileInfo := tileFromScene(&scene)
 
 	filter := bson.D{
 		{"date", tileInfo.Date},
@@ -84,75 +63,68 @@ func RequestMapTask(ctx context.Context, event *db.Event) error {
 	}
 	tile, err := db.FindTile(ctx, dbClient, filter)
 	if err != nil {
-		return err
+		return result, err
 	} else if tile == nil {
 		log.Println("tile missing in database")
-		return nil
+		return result, nil
 	}
 
 	// store the tile file object in the database by inserting
 	// into the tile object.
 	if err := db.InsertFileIntoTile(ctx, dbClient, tile, &tileFile); err != nil {
 		log.Println("failed to insert tile file into a tile's file listing")
-		return err
+		return result, err
 	}
 
 	// if the file is a json meta file load the file and parse and save
-	// the data geometry so it can be queried later on
-	if fileUse == "jsonMeta" {
-		if err := ParseDataGeometry(ctx, tile, objectPath); err != nil {
+	// the data geometry and scene metadata so it can be queried later on
+	if sceneKey.IsMetadata() {
+		if err := ParseDataGeometry(ctx, result, tile, objectPath); err != nil {
 			log.Println("failed to parse geometry from file")
-			return err
+			return result, err
 		}
 
 		if err := db.UpdateTileAttribute(ctx, dbClient, tile, "geometry"); err != nil {
 			log.Println("failed to update tile in database")
-			return err
+			return result, err
+		}
+		if err := db.UpdateTileAttribute(ctx, dbClient, tile, "sceneMetadata"); err != nil {
+			log.Println("failed to update tile in database")
+			return result, err
 		}
 	}
 
 	// TODO : only publish if the tile has band 4 and band 8 and a boundary
-	// publish an event to build the maps for the new tile if it doesn't
-	// already exist
-	existingBuildMapEventsCount, err := db.CountEvents(
-		ctx,
-		dbClient,
-		bson.D{
-			{"data.mgrsCode", tile.MgrsCode}, 
-			{"started", false}, 
-			{"passed", false}, 
-			{"failed", false}, 
-			{"event_type", "BuildBoundaryMapTask"},
+	// publish an event to build the maps for the new tile if one isn't
+	// already waiting in the queue
+	buildMapEvent := db.NewChildEvent(event, db.Event{
+		EventType: "BuildBoundaryMapTask",
+		Priority:  4,
+		DedupKey:  db.BuildBoundaryMapDedupKey(tile.MgrsCode, ""),
+		Data: map[string]string{
+			"mgrsCode": tile.MgrsCode,
 		},
-	)
-	if err != nil {
-		log.Println("failed to query existing events")
-		return err
-	} else if existingBuildMapEventsCount == 0 {
-		log.Printf("distributing build map event for mgrs %s\n", tile.MgrsCode)
-		buildMapEvent := db.Event{
-			EventType:  "BuildBoundaryMapTask",
-			Priority:   4,
-			MaxAttemps: 1,
-			Data: map[string]string{
-				"mgrsCode": tile.MgrsCode,
-			},
-		}
-		if err := db.SaveEvent(ctx, dbClient, &buildMapEvent); err != nil {
-			log.Println("failed to publish build map event")
-			return err
-		}
-	}
-
-	return nil
+	})
+	if err := db.SaveEvent(ctx, dbClient, &buildMapEvent); err == db.ERROR_DUPLICATE_EVENT {
+		log.Printf("build map event for mgrs %s already queued\n", tile.MgrsCode)
+	} else if err != nil {
+		log.Println("failed to publish build map event")
+		return result, err
+	} else {
+		log.Printf("distributed build map event for mgrs %s\n", tile.MgrsCode)
+		result.AddCount("eventsPublished", 1)
+	}
+
+	return result, nil
 }
 
 
 type MetaData struct {
 	Geometry 	db.Geometry 	`json:"geometry"`
+	Properties 	satData.SceneProperties 	`json:"properties"`
 }
 
-func ParseDataGeometry(ctx context.Context, tile *db.Tile, objectPath string) error {
+func ParseDataGeometry(ctx context.Context, result *db.EventResult, tile *db.Tile, objectPath string) error {
 	if !strings.Contains(objectPath, ".json") {
 		return errors.New("is not a json meta file")
 	}
@@ -164,7 +136,7 @@ func ParseDataGeometry(ctx context.Context, tile *db.Tile, objectPath string) er
 	defer os.RemoveAll(dir) // clean up
 
 	jsonMeta := filepath.Join(dir, "meta.json")
-	if err := satData.GetObject(ctx, jsonMeta, objectPath, satData.SATELLITE_S3_IMAGE_BUCKET); err != nil {
+	if err := downloadObject(ctx, result, jsonMeta, objectPath, satData.SATELLITE_S3_IMAGE_BUCKET); err != nil {
 		log.Println("failed to request json meta from s3")
 		return err
 	}
@@ -179,6 +151,12 @@ func ParseDataGeometry(ctx context.Context, tile *db.Tile, objectPath string) er
 		return err
 	}
 
+	return applyMetaData(tile, jsonMetaData)
+}
+
+// applyMetaData sets the geometry and scene metadata of the tile from the
+// scene's json metadata.
+func applyMetaData(tile *db.Tile, jsonMetaData []byte) error {
 	var metaData MetaData
 	if err := json.Unmarshal(jsonMetaData, &metaData); err != nil {
 		return err
@@ -189,6 +167,47 @@ func ParseDataGeometry(ctx context.Context, tile *db.Tile, objectPath string) er
 	}
 
 	tile.Geometry = metaData.Geometry
+	sceneMetadata := metaData.Properties.SceneMetadata()
+	tile.SceneMetadata = tileSceneMetadata(&sceneMetadata)
 
 	return nil
-}
\ No newline at end of file
+}
+
+// tileFromScene is the tile storing the scene and its files.
+func tileFromScene(scene *satData.Scene) db.Tile {
+	tile := db.Tile{
+		Date:            primitive.NewDateTimeFromTime(scene.Date),
+		MgrsCode:        scene.MgrsCode,
+		SourceSatellite: scene.SourceSatellite,
+		Geometry: db.Geometry{
+			Coordinates: scene.Geometry.Coordinates,
+			Type:        scene.Geometry.Type,
+		},
+		SceneMetadata: tileSceneMetadata(&scene.SceneMetadata),
+	}
+	for i := range scene.Files {
+		tile.Files = append(tile.Files, tileFileFromScene(&scene.Files[i]))
+	}
+	return tile
+}
+
+func tileFileFromScene(sceneFile *satData.SceneFile) db.TileFile {
+	return db.TileFile{
+		FileUse:    sceneFile.FileUse,
+		Band:       sceneFile.Band,
+		Version:    sceneFile.Version,
+		Size:       sceneFile.Size,
+		ObjectPath: sceneFile.ObjectPath,
+	}
+}
+
+func tileSceneMetadata(sceneMetadata *satData.SceneMetadata) db.SceneMetadata {
+	return db.SceneMetadata{
+		CloudCover:         sceneMetadata.CloudCover,
+		DataCoverage:       sceneMetadata.DataCoverage,
+		SunElevation:       sceneMetadata.SunElevation,
+		SunAzimuth:         sceneMetadata.SunAzimuth,
+		ProcessingBaseline: sceneMetadata.ProcessingBaseline,
+		ProductId:          sceneMetadata.ProductId,
+	}
+}
@@ -0,0 +1,122 @@
+package worker
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	db "core_service/database"
+)
+
+// RetryPolicy decides if and when a failed event runs again. The delay
+// before attempt n+1 is BaseDelay * Multiplier^(n-1), capped at MaxDelay
+// and spread by +/- Jitter percent so events that failed together
+// don't all retry at the same moment.
+type RetryPolicy struct {
+	// used for events which don't set max attempts themselves
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Multiplier  float64
+	// fraction of the delay, between 0 and 1, added or removed at random
+	Jitter float64
+	// reports if an error is worth retrying, when nil every error is
+	// retried except a PermanentError
+	IsRetryable func(error) bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 1,
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    1 * time.Hour,
+	Multiplier:  2,
+	Jitter:      0.2,
+}
+
+// fills in the zero valued fields from the DefaultRetryPolicy
+func (policy RetryPolicy) withDefaults() RetryPolicy {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = DefaultRetryPolicy.Multiplier
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		policy.Jitter = DefaultRetryPolicy.Jitter
+	}
+	return policy
+}
+
+// TaskMaxAttempts is the max attempts of each task's retry policy, the
+// limit of the events which don't set their own.
+func TaskMaxAttempts() map[string]int {
+	maxAttemptsByType := make(map[string]int, len(TaskDefinitions))
+	for eventType, task := range TaskDefinitions {
+		maxAttemptsByType[eventType] = task.RetryPolicy.withDefaults().MaxAttempts
+	}
+	return maxAttemptsByType
+}
+
+// eventMaxAttempts is the number of attempts the event gets, both when
+// its task fails and when its lease expires.
+func eventMaxAttempts(event *db.Event) int {
+	if event.MaxAttemps > 0 {
+		return event.MaxAttemps
+	}
+	if task, exists := TaskDefinitions[event.EventType]; exists {
+		return task.RetryPolicy.withDefaults().MaxAttempts
+	}
+	return DefaultRetryPolicy.MaxAttempts
+}
+
+// RetryDelay is how long to wait before running the event again after
+// it has failed the given number of attempts.
+func (policy RetryPolicy) RetryDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := float64(policy.BaseDelay) * math.Pow(policy.Multiplier, float64(attempts-1))
+	if delay > float64(policy.MaxDelay) {
+		delay = float64(policy.MaxDelay)
+	}
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+func (policy RetryPolicy) Retryable(err error) bool {
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) {
+		return false
+	}
+	if policy.IsRetryable != nil {
+		return policy.IsRetryable(err)
+	}
+	return true
+}
+
+// PermanentError marks a task error which will happen again no matter
+// how many times the event is retried, like malformed event data.
+type PermanentError struct {
+	Err error
+}
+
+func (m *PermanentError) Error() string {
+	return m.Err.Error()
+}
+
+func (m *PermanentError) Unwrap() error {
+	return m.Err
+}
+
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
@@ -0,0 +1,58 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyRetryDelay(t *testing.T) {
+	policy := RetryPolicy{
+		BaseDelay:  10 * time.Second,
+		MaxDelay:   1 * time.Minute,
+		Multiplier: 2,
+	}
+
+	expectedDelays := []time.Duration{10 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 1 * time.Minute}
+	for attempts, expectedDelay := range expectedDelays {
+		if delay := policy.RetryDelay(attempts); delay != expectedDelay {
+			t.Errorf("attempt %d: expected a delay of %v but found %v", attempts, expectedDelay, delay)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := policy.RetryDelay(2); delay < 10*time.Second || delay > 30*time.Second {
+			t.Fatalf("delay %v outside of the jitter range", delay)
+		}
+	}
+}
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5}.withDefaults()
+	if policy.MaxAttempts != 5 || policy.BaseDelay != DefaultRetryPolicy.BaseDelay || policy.Multiplier != DefaultRetryPolicy.Multiplier {
+		t.Fatal(policy)
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	policy := RetryPolicy{}
+	if !policy.Retryable(errors.New("connection reset")) {
+		t.Fatal("errors should be retried by default")
+	}
+	if policy.Retryable(fmt.Errorf("wrapped: %w", Permanent(errors.New("bad data")))) {
+		t.Fatal("permanent errors should never be retried")
+	}
+
+	policy.IsRetryable = func(err error) bool {
+		return errors.Is(err, context.DeadlineExceeded)
+	}
+	if policy.Retryable(errors.New("connection reset")) {
+		t.Fatal("the policy's classification should be used")
+	}
+	if !policy.Retryable(context.DeadlineExceeded) {
+		t.Fatal("timeouts should be retried")
+	}
+}
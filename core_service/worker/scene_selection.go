@@ -0,0 +1,282 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	db "core_service/database"
+	satData "core_service/satelliteS3"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// the newest tiles of a square a boundary's scene is picked from
+const SCENE_CANDIDATE_TILES = 10
+
+// SceneCandidate is a tile a boundary's map can be built from. The cloud
+// and valid pixel percentages are of the boundary when its scene
+// classification stats are known, otherwise of the whole scene, and nil
+// when neither is known.
+type SceneCandidate struct {
+	Tile         *db.Tile
+	CloudPercent *float64
+	ValidPercent *float64
+}
+
+// SceneSelectionPolicy returns the index of the candidate the boundary's
+// map is built from, the candidates are sorted newest first.
+type SceneSelectionPolicy func(candidates []SceneCandidate) int
+
+var SceneSelectionPolicies = map[string]SceneSelectionPolicy{
+	db.SCENE_POLICY_NEWEST:           NewestScene,
+	db.SCENE_POLICY_LEAST_CLOUDY:     LeastCloudyScene,
+	db.SCENE_POLICY_MAX_VALID_PIXELS: MaxValidPixelsScene,
+}
+
+func NewestScene(candidates []SceneCandidate) int {
+	return 0
+}
+
+// LeastCloudyScene picks the candidate with the least clouds, scenes
+// without a cloud percentage are only picked when none of them have one.
+func LeastCloudyScene(candidates []SceneCandidate) int {
+	return bestScene(candidates, func(candidate SceneCandidate) *float64 {
+		if candidate.CloudPercent == nil {
+			return nil
+		}
+		clearPercent := 100 - *candidate.CloudPercent
+		return &clearPercent
+	})
+}
+
+// MaxValidPixelsScene picks the candidate with the most valid pixels,
+// scenes without a valid percentage are only picked when none of them
+// have one.
+func MaxValidPixelsScene(candidates []SceneCandidate) int {
+	return bestScene(candidates, func(candidate SceneCandidate) *float64 {
+		return candidate.ValidPercent
+	})
+}
+
+// bestScene returns the index of the candidate with the highest value,
+// the newest one wins ties.
+func bestScene(candidates []SceneCandidate, value func(SceneCandidate) *float64) int {
+	bestIndex := 0
+	var bestValue *float64
+	for i, candidate := range candidates {
+		candidateValue := value(candidate)
+		if candidateValue != nil && (bestValue == nil || *candidateValue > *bestValue) {
+			bestIndex = i
+			bestValue = candidateValue
+		}
+	}
+	return bestIndex
+}
+
+// SelectScene picks the scene of a boundary from the candidates sorted
+// newest first, it returns nil when there are no candidates. Within days
+// leaves out the candidates sensed more than that many days before now,
+// so a boundary without a recent scene gets no map.
+func SelectScene(sceneSelection db.SceneSelection, candidates []SceneCandidate, now time.Time) *SceneCandidate {
+	if sceneSelection.WithinDays > 0 {
+		oldestDate := now.AddDate(0, 0, -sceneSelection.WithinDays)
+		recentCandidates := make([]SceneCandidate, 0, len(candidates))
+		for _, candidate := range candidates {
+			if !candidate.Tile.Date.Time().Before(oldestDate) {
+				recentCandidates = append(recentCandidates, candidate)
+			}
+		}
+		candidates = recentCandidates
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	policy, exists := SceneSelectionPolicies[sceneSelection.Policy]
+	if !exists {
+		policy = NewestScene
+	}
+	return &candidates[policy(candidates)]
+}
+
+// NewSceneCandidate uses the boundary's stats when there are any and
+// the scene's metadata otherwise. Without a data coverage the scene's
+// valid pixels are the ones without clouds.
+func NewSceneCandidate(tile *db.Tile, stat *db.BoundarySceneStat) SceneCandidate {
+	candidate := SceneCandidate{Tile: tile}
+	if stat != nil {
+		cloudPercent, validPercent := stat.CloudPercent, stat.ValidPercent
+		candidate.CloudPercent = &cloudPercent
+		candidate.ValidPercent = &validPercent
+		return candidate
+	}
+
+	candidate.CloudPercent = tile.CloudCover
+	if tile.DataCoverage != nil || tile.CloudCover != nil {
+		validPercent := 100.0
+		if tile.DataCoverage != nil {
+			validPercent = *tile.DataCoverage
+		}
+		if tile.CloudCover != nil {
+			validPercent = validPercent * (100 - *tile.CloudCover) / 100
+		}
+		candidate.ValidPercent = &validPercent
+	}
+	return candidate
+}
+
+// tileMapBands returns the object paths of the latest version of the
+// bands a map is built from, the scl path is empty when the tile doesn't
+// have the layer.
+func tileMapBands(tile *db.Tile) (band04ObjectPath, band08ObjectPath, bandSCLObjectPath string) {
+	latestVersion := 0
+	for _, file := range tile.Files {
+		if file.Version > latestVersion {
+			latestVersion = file.Version
+		}
+	}
+
+	for _, file := range tile.Files {
+		if file.Version == latestVersion {
+			if file.Band == "B04.tif" {
+				band04ObjectPath = file.ObjectPath
+			} else if file.Band == "B08.tif" {
+				band08ObjectPath = file.ObjectPath
+			} else if file.Band == "SCL.tif" {
+				bandSCLObjectPath = file.ObjectPath
+			}
+		}
+	}
+	return band04ObjectPath, band08ObjectPath, bandSCLObjectPath
+}
+
+// LoadBoundarySceneStats returns the scene classification stats of the
+// boundaries in each tile by boundary and scl object path. Stats which
+// haven't been computed yet are computed from each tile's scl layer and
+// saved for the next build, a tile whose stats can't be computed is left
+// to its scene metadata.
+func LoadBoundarySceneStats(ctx context.Context, dbClient *mongo.Client, result *db.EventResult, tiles []db.Tile, boundariesByTileId map[primitive.ObjectID][]db.Boundary) (map[string]db.BoundarySceneStat, error) {
+	boundaryIds := make([]primitive.ObjectID, 0)
+	seenBoundaryIds := make(map[primitive.ObjectID]bool)
+	tileIds := make([]primitive.ObjectID, 0, len(tiles))
+	for _, tile := range tiles {
+		tileIds = append(tileIds, tile.ID)
+		for _, boundary := range boundariesByTileId[tile.ID] {
+			if !seenBoundaryIds[boundary.ID] {
+				seenBoundaryIds[boundary.ID] = true
+				boundaryIds = append(boundaryIds, boundary.ID)
+			}
+		}
+	}
+
+	statsByKey := make(map[string]db.BoundarySceneStat)
+	if len(boundaryIds) == 0 {
+		return statsByKey, nil
+	}
+	savedStats, err := db.FindBoundarySceneStats(ctx, dbClient, boundaryIds, tileIds)
+	if err != nil {
+		log.Println("failed to find the boundary scene stats")
+		return nil, err
+	}
+	for _, stat := range savedStats {
+		statsByKey[boundarySceneStatKey(stat.BoundaryId, stat.ObjectPath)] = stat
+	}
+
+	for i := range tiles {
+		tile := &tiles[i]
+		_, _, bandSCLObjectPath := tileMapBands(tile)
+		if bandSCLObjectPath == "" {
+			continue
+		}
+
+		missingBoundaries := make([]db.Boundary, 0)
+		for _, boundary := range boundariesByTileId[tile.ID] {
+			if _, exists := statsByKey[boundarySceneStatKey(boundary.ID, bandSCLObjectPath)]; !exists {
+				missingBoundaries = append(missingBoundaries, boundary)
+			}
+		}
+		if len(missingBoundaries) == 0 {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		stats, err := ComputeBoundarySceneStats(ctx, result, &missingBoundaries, tile, bandSCLObjectPath)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			log.Printf("failed to compute the scene stats of tile %s: %s", tile.ID.Hex(), err)
+			continue
+		}
+		if err := db.SaveBoundarySceneStats(ctx, dbClient, stats); err != nil {
+			log.Println("failed to save the boundary scene stats")
+			return nil, err
+		}
+		result.AddCount("sceneStats", int64(len(stats)))
+		for _, stat := range stats {
+			statsByKey[boundarySceneStatKey(stat.BoundaryId, stat.ObjectPath)] = stat
+		}
+	}
+	return statsByKey, nil
+}
+
+func boundarySceneStatKey(boundaryId primitive.ObjectID, objectPath string) string {
+	return fmt.Sprintf("%s/%s", boundaryId.Hex(), objectPath)
+}
+
+// ComputeBoundarySceneStats downloads only the tile's scl layer and has
+// the python program measure the clouds and valid pixels of each boundary.
+func ComputeBoundarySceneStats(ctx context.Context, result *db.EventResult, boundaries *[]db.Boundary, tile *db.Tile, bandSCLObjectPath string) ([]db.BoundarySceneStat, error) {
+	log.Println("ComputeBoundarySceneStats()")
+
+	boundaryPrefix := "boundary_geometry_"
+	bandPrefix := "satData_band"
+	sceneStatPrefix := "scene_stat_"
+
+	dataDir, err := os.MkdirTemp(db.TEMP_DIR, "boundary_scene_stats")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dataDir)
+
+	bandSCLPath := filepath.Join(dataDir, "satData_bandSCL.tif")
+	if err := downloadObject(ctx, result, bandSCLPath, bandSCLObjectPath, satData.SATELLITE_S3_IMAGE_BUCKET); err != nil {
+		log.Println("failed to get satellite data file band SCL")
+		return nil, err
+	}
+
+	WriteBoundaryFiles(boundaries, dataDir, boundaryPrefix)
+	if err := CallPythonProgram(ctx, dataDir, bandPrefix, boundaryPrefix, "--stats"); err != nil {
+		return nil, err
+	}
+
+	// boundaries the program failed on have no stats file
+	now := primitive.NewDateTimeFromTime(time.Now())
+	stats := make([]db.BoundarySceneStat, 0, len(*boundaries))
+	for _, boundary := range *boundaries {
+		statData, err := os.ReadFile(filepath.Join(dataDir, fmt.Sprintf("%s%s.json", sceneStatPrefix, boundary.ID.Hex())))
+		if err != nil {
+			continue
+		}
+		stat := db.BoundarySceneStat{
+			BoundaryId:  boundary.ID,
+			TileId:      tile.ID,
+			ObjectPath:  bandSCLObjectPath,
+			CreatedDate: now,
+		}
+		if err := json.Unmarshal(statData, &stat); err != nil {
+			log.Println(err)
+			continue
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
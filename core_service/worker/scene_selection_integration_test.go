@@ -0,0 +1,104 @@
+//go:build integration
+
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFindBoundariesForTileSceneSelection(t *testing.T) {
+	db.CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	geometry := db.Geometry{
+		Type: "Polygon",
+		Coordinates: [][][]float64{
+			{
+				{-98.27917493756021, 46.05129235113481},
+				{-97.58110900701091, 46.04475738929435},
+				{-97.60575860695822, 45.056757746793146},
+				{-98.61863006283437, 45.06463224445008},
+				{-98.27917493756021, 46.05129235113481},
+			},
+		},
+	}
+	mapFiles := []db.TileFile{
+		{FileUse: "satBand", Band: "B04.tif", ObjectPath: "B04.tif"},
+		{FileUse: "satBand", Band: "B08.tif", ObjectPath: "B08.tif"},
+	}
+
+	// the newest tile is cloudy and the tile without band 8 can't be used
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	tiles := []db.Tile{
+		{Date: primitive.NewDateTimeFromTime(today.AddDate(0, 0, -1)), SceneMetadata: db.SceneMetadata{CloudCover: percent(80)}, Files: mapFiles},
+		{Date: primitive.NewDateTimeFromTime(today.AddDate(0, 0, -6)), SceneMetadata: db.SceneMetadata{CloudCover: percent(0)}, Files: mapFiles[:1]},
+		{Date: primitive.NewDateTimeFromTime(today.AddDate(0, 0, -11)), SceneMetadata: db.SceneMetadata{CloudCover: percent(10)}, Files: mapFiles},
+	}
+	for i := range tiles {
+		tiles[i].MgrsCode = "14TNR"
+		tiles[i].SourceSatellite = "S2A"
+		tiles[i].Geometry = geometry
+		if _, err := db.UpdateOrCreateTile(ctx, dbClient, &tiles[i]); err != nil {
+			t.Fatal(err)
+		}
+		tile, err := db.FindTile(ctx, dbClient, bson.D{{"mgrs_code", "14TNR"}, {"date", tiles[i].Date}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiles[i].ID = tile.ID
+	}
+
+	boundary := db.Boundary{
+		Name:      "Boundary 1",
+		MgrsCodes: []string{"14TNR"},
+		Geometry: db.Geometry{
+			Type: "Polygon",
+			Coordinates: [][][]float64{
+				{
+					{-98.29377108430018, 45.51545082233693},
+					{-98.23596192672191, 45.513762969793305},
+					{-98.23475756927279, 45.55341412123062},
+					{-98.279318794906, 45.55004064352917},
+					{-98.29377108430018, 45.51545082233693},
+				},
+			},
+		},
+	}
+	if err := db.SaveBoundary(ctx, dbClient, &boundary); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		selection    db.SceneSelection
+		expectedTile primitive.ObjectID
+	}{
+		{selection: db.SceneSelection{}, expectedTile: tiles[0].ID},
+		{selection: db.SceneSelection{Policy: db.SCENE_POLICY_LEAST_CLOUDY}, expectedTile: tiles[2].ID},
+		{selection: db.SceneSelection{Policy: db.SCENE_POLICY_LEAST_CLOUDY, WithinDays: 5}, expectedTile: tiles[0].ID},
+	}
+	for _, testCase := range testCases {
+		boundariesFilter := bson.D{{"mgrs_codes", "14TNR"}}
+		tileBoundaries, err := FindBoundariesForTile(ctx, dbClient, db.NewEventResult(), "14TNR", boundariesFilter, testCase.selection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tileBoundaries) != 1 {
+			t.Fatalf("expected the boundary to be in one tile but found %d", len(tileBoundaries))
+		}
+		if boundaries, exists := tileBoundaries[testCase.expectedTile]; !exists || len(*boundaries) != 1 || (*boundaries)[0].ID != boundary.ID {
+			t.Errorf("expected %+v to pick tile %s", testCase.selection, testCase.expectedTile.Hex())
+		}
+	}
+}
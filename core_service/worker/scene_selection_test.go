@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func percent(value float64) *float64 {
+	return &value
+}
+
+func sceneTile(day int, cloudCover, dataCoverage *float64) *db.Tile {
+	return &db.Tile{
+		ID:            primitive.NewObjectID(),
+		Date:          primitive.NewDateTimeFromTime(time.Date(2023, time.Month(8), day, 0, 0, 0, 0, time.UTC)),
+		SceneMetadata: db.SceneMetadata{CloudCover: cloudCover, DataCoverage: dataCoverage},
+	}
+}
+
+func TestSceneSelectionPolicies(t *testing.T) {
+	for policy := range db.SCENE_SELECTION_POLICIES {
+		if _, exists := SceneSelectionPolicies[policy]; !exists {
+			t.Errorf("expected the %s policy to be implemented", policy)
+		}
+	}
+
+	// newest first, the boundary stats of the second tile make it the clearest
+	candidates := []SceneCandidate{
+		NewSceneCandidate(sceneTile(30, percent(40), percent(100)), nil),
+		NewSceneCandidate(sceneTile(25, percent(60), percent(100)), &db.BoundarySceneStat{CloudPercent: 0, ValidPercent: 97}),
+		NewSceneCandidate(sceneTile(20, percent(5), percent(30)), nil),
+		NewSceneCandidate(sceneTile(15, nil, nil), nil),
+	}
+	now := time.Date(2023, time.Month(9), 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		selection    db.SceneSelection
+		expectedTile *db.Tile
+	}{
+		{selection: db.SceneSelection{}, expectedTile: candidates[0].Tile},
+		{selection: db.SceneSelection{Policy: db.SCENE_POLICY_NEWEST}, expectedTile: candidates[0].Tile},
+		{selection: db.SceneSelection{Policy: db.SCENE_POLICY_LEAST_CLOUDY}, expectedTile: candidates[1].Tile},
+		{selection: db.SceneSelection{Policy: db.SCENE_POLICY_MAX_VALID_PIXELS}, expectedTile: candidates[1].Tile},
+		{selection: db.SceneSelection{Policy: db.SCENE_POLICY_LEAST_CLOUDY, WithinDays: 3}, expectedTile: candidates[0].Tile},
+		{selection: db.SceneSelection{Policy: db.SCENE_POLICY_LEAST_CLOUDY, WithinDays: 10}, expectedTile: candidates[1].Tile},
+	}
+	for _, testCase := range testCases {
+		selected := SelectScene(testCase.selection, candidates, now)
+		if selected == nil || selected.Tile != testCase.expectedTile {
+			t.Errorf("expected %+v to pick the tile of %s", testCase.selection, testCase.expectedTile.Date.Time())
+		}
+	}
+
+	// without boundary stats the scene's clouds and coverage decide
+	candidates[1] = NewSceneCandidate(candidates[1].Tile, nil)
+	if selected := SelectScene(db.SceneSelection{Policy: db.SCENE_POLICY_LEAST_CLOUDY}, candidates, now); selected.Tile != candidates[2].Tile {
+		t.Errorf("expected the least cloudy scene but found %+v", selected.Tile.SceneMetadata)
+	}
+	if selected := SelectScene(db.SceneSelection{Policy: db.SCENE_POLICY_MAX_VALID_PIXELS}, candidates, now); selected.Tile != candidates[0].Tile {
+		t.Errorf("expected the scene with the most valid pixels but found %+v", selected.Tile.SceneMetadata)
+	}
+
+	// the newest wins when nothing is known
+	unknownCandidates := []SceneCandidate{
+		NewSceneCandidate(sceneTile(30, nil, nil), nil),
+		NewSceneCandidate(sceneTile(20, nil, nil), nil),
+	}
+	if selected := SelectScene(db.SceneSelection{Policy: db.SCENE_POLICY_LEAST_CLOUDY}, unknownCandidates, now); selected.Tile != unknownCandidates[0].Tile {
+		t.Error("expected the newest scene without any metadata")
+	}
+	if selected := SelectScene(db.SceneSelection{Policy: db.SCENE_POLICY_LEAST_CLOUDY}, nil, now); selected != nil {
+		t.Error("expected no scene without candidates")
+	}
+
+	// the days are counted from now, not from the newest scene
+	if selected := SelectScene(db.SceneSelection{WithinDays: 7}, candidates, now.AddDate(0, 1, 0)); selected != nil {
+		t.Errorf("expected no scene in the last week but found the one of %s", selected.Tile.Date.Time())
+	}
+}
+
+func TestNewSceneCandidate(t *testing.T) {
+	candidate := NewSceneCandidate(sceneTile(1, percent(20), percent(50)), nil)
+	if *candidate.CloudPercent != 20 || *candidate.ValidPercent != 40 {
+		t.Errorf("expected 20%% clouds and 40%% valid pixels but found %f and %f", *candidate.CloudPercent, *candidate.ValidPercent)
+	}
+	candidate = NewSceneCandidate(sceneTile(1, percent(20), nil), nil)
+	if *candidate.ValidPercent != 80 {
+		t.Errorf("expected the pixels without clouds to be valid but found %f", *candidate.ValidPercent)
+	}
+	candidate = NewSceneCandidate(sceneTile(1, nil, nil), nil)
+	if candidate.CloudPercent != nil || candidate.ValidPercent != nil {
+		t.Errorf("expected unknown percentages but found %+v", candidate)
+	}
+}
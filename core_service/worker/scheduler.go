@@ -0,0 +1,167 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	db "core_service/database"
+
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SCHEDULER_LEADER_ROLE     = "scheduler"
+	SCHEDULER_LEADER_DURATION = 1 * time.Minute
+	SCHEDULER_TICK_INTERVAL   = 15 * time.Second
+)
+
+// JobDefinition is a job the observer runs on a schedule. The schedule
+// is a standard five field cron expression in UTC, it is only the
+// default used when the job is first stored in the job collection.
+type JobDefinition struct {
+	Schedule string
+	JobFunc  func(context.Context, *mongo.Client) error
+}
+
+var JobDefinitions = map[string]JobDefinition{
+	"IndexRefreshJob":     JobDefinition{Schedule: "0 3 * * *", JobFunc: PublishPeriodicIndexEvent},
+	"RasterCleanupJob":    JobDefinition{Schedule: "30 4 * * *", JobFunc: PublishRasterCleanupEvent},
+	"StaleLeaseReaperJob": JobDefinition{Schedule: "* * * * *", JobFunc: ReapExpiredEventLeases},
+}
+
+func NextJobRunDate(schedule string, after time.Time) (time.Time, error) {
+	cronSchedule, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid job schedule '%s': %w", schedule, err)
+	}
+	return cronSchedule.Next(after.UTC()), nil
+}
+
+// StartObserver runs the scheduled jobs until the context is done. Every
+// worker runs an observer but only the one holding the scheduler
+// leadership runs jobs, the others stand by in case it dies.
+func StartObserver(ctx context.Context, dbClient *mongo.Client, owner string) {
+	if err := SeedJobs(ctx, dbClient); err != nil {
+		log.Println("[observer] failed to seed jobs:", err)
+	}
+
+	observerTicker := time.NewTicker(SCHEDULER_TICK_INTERVAL)
+	defer observerTicker.Stop()
+
+	for {
+		isLeader, err := db.AcquireLeadership(ctx, dbClient, SCHEDULER_LEADER_ROLE, owner, SCHEDULER_LEADER_DURATION)
+		if err != nil && ctx.Err() == nil {
+			log.Println(err)
+		} else if isLeader {
+			if err := RunDueJobs(ctx, dbClient, owner); err != nil && ctx.Err() == nil {
+				log.Println(err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if isLeader {
+				if err := db.ResignLeadership(detachedContext{ctx}, dbClient, SCHEDULER_LEADER_ROLE, owner); err != nil {
+					log.Println(err)
+				}
+			}
+			return
+		case <-observerTicker.C:
+		}
+	}
+}
+
+// SeedJobs stores every job in JobDefinitions which isn't in the job
+// collection yet.
+func SeedJobs(ctx context.Context, dbClient *mongo.Client) error {
+	for jobName, jobDefinition := range JobDefinitions {
+		nextRunDate, err := NextJobRunDate(jobDefinition.Schedule, time.Now())
+		if err != nil {
+			return err
+		}
+		job := db.Job{
+			Name:        jobName,
+			Schedule:    jobDefinition.Schedule,
+			Enabled:     true,
+			NextRunDate: primitive.NewDateTimeFromTime(nextRunDate),
+		}
+		if err := db.EnsureJob(ctx, dbClient, &job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunDueJobs runs every enabled job whose next run date has passed. Each
+// run is claimed in the database first so a run is never repeated, even
+// if two workers briefly both believe they are the leader.
+func RunDueJobs(ctx context.Context, dbClient *mongo.Client, owner string) error {
+	now := time.Now()
+	filter := bson.D{
+		{"enabled", true},
+		{"next_run_date", bson.D{{"$lte", primitive.NewDateTimeFromTime(now)}}},
+	}
+	jobs, err := db.FindJobs(ctx, dbClient, filter, options.Find())
+	if err != nil {
+		return err
+	}
+
+	for _, job := range *jobs {
+		jobDefinition, exists := JobDefinitions[job.Name]
+		if !exists {
+			log.Println("[observer] job not implemented:", job.Name)
+			continue
+		}
+
+		nextRunDate, err := NextJobRunDate(job.Schedule, now)
+		if err != nil {
+			log.Println("[observer]", err)
+			continue
+		}
+
+		claimed, err := db.ClaimJobRun(ctx, dbClient, &job, nextRunDate, owner)
+		if err != nil {
+			return err
+		} else if !claimed {
+			continue
+		}
+
+		log.Printf("[observer] running job %s, next run at %s\n", job.Name, nextRunDate.Format(time.RFC3339))
+		errorData := ""
+		if err := jobDefinition.JobFunc(ctx, dbClient); err != nil {
+			log.Printf("[observer] job %s failed: %v\n", job.Name, err)
+			errorData = fmt.Sprintf("%v", err)
+		}
+		if errorData != job.LastError {
+			if err := db.RecordJobError(ctx, dbClient, &job, errorData); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// NewRasterCleanupEvent returns the event of a raster cleanup, a cleanup
+// which is already queued is not queued again.
+func NewRasterCleanupEvent() db.Event {
+	return db.Event{
+		EventType:      "CleanupRastersTask",
+		StartAfterDate: primitive.NewDateTimeFromTime(time.Now()),
+		DedupKey:       "CleanupRastersTask",
+	}
+}
+
+func PublishRasterCleanupEvent(ctx context.Context, dbClient *mongo.Client) error {
+	cleanupEvent := NewRasterCleanupEvent()
+	if err := NewMongoQueue(dbClient).Publish(ctx, &cleanupEvent); err != nil && err != db.ERROR_DUPLICATE_EVENT {
+		return err
+	}
+	return nil
+}
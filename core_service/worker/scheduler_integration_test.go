@@ -0,0 +1,100 @@
+//go:build integration
+
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestAcquireLeadership(t *testing.T) {
+	db.CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isLeader, err := db.AcquireLeadership(ctx, dbClient, "test-role", "worker-1", 50*time.Millisecond); err != nil || !isLeader {
+		t.Fatal("the first worker should become the leader")
+	}
+	if isLeader, err := db.AcquireLeadership(ctx, dbClient, "test-role", "worker-2", time.Minute); err != nil || isLeader {
+		t.Fatal("the second worker should not take over an active leader")
+	}
+	if isLeader, err := db.AcquireLeadership(ctx, dbClient, "test-role", "worker-1", 50*time.Millisecond); err != nil || !isLeader {
+		t.Fatal("the leader should be able to renew its term")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if isLeader, err := db.AcquireLeadership(ctx, dbClient, "test-role", "worker-2", time.Minute); err != nil || !isLeader {
+		t.Fatal("the second worker should take over an expired leader")
+	}
+}
+
+func TestRunDueJobs(t *testing.T) {
+	db.CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCount := 0
+	JobDefinitions["TestJob"] = JobDefinition{
+		Schedule: "0 * * * *",
+		JobFunc: func(ctx context.Context, dbClient *mongo.Client) error {
+			runCount += 1
+			return nil
+		},
+	}
+	defer delete(JobDefinitions, "TestJob")
+
+	if err := SeedJobs(ctx, dbClient); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := db.FindJobs(ctx, dbClient, bson.D{}, options.Find())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(*jobs) != len(JobDefinitions) {
+		t.Fatalf("expected %d jobs but found %d", len(JobDefinitions), len(*jobs))
+	}
+
+	// make the test job due
+	_, err = db.JobCollection(dbClient).UpdateOne(
+		ctx,
+		bson.D{{"name", "TestJob"}},
+		bson.D{{"$set", bson.D{{"next_run_date", primitive.NewDateTimeFromTime(time.Now().Add(-time.Minute))}}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunDueJobs(ctx, dbClient, "worker-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunDueJobs(ctx, dbClient, "worker-2"); err != nil {
+		t.Fatal(err)
+	}
+	if runCount != 1 {
+		t.Fatalf("expected the job to run once but it ran %d times", runCount)
+	}
+
+	jobs, err = db.FindJobs(ctx, dbClient, bson.D{{"name", "TestJob"}}, options.Find())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testJob := (*jobs)[0]
+	if testJob.LastRunOwner != "worker-1" || testJob.LastRunDate == 0 || !testJob.NextRunDate.Time().After(time.Now()) {
+		t.Fatal(testJob)
+	}
+}
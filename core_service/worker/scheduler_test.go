@@ -0,0 +1,28 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextJobRunDate(t *testing.T) {
+	after := time.Date(2026, time.Month(10), 15, 3, 10, 0, 0, time.UTC)
+
+	nextRunDate, err := NextJobRunDate("0 3 * * *", after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2026, time.Month(10), 16, 3, 0, 0, 0, time.UTC); !nextRunDate.Equal(expected) {
+		t.Fatalf("expected %v but found %v", expected, nextRunDate)
+	}
+
+	if _, err := NextJobRunDate("every day", after); err == nil {
+		t.Fatal("expected an invalid schedule error")
+	}
+
+	for jobName, jobDefinition := range JobDefinitions {
+		if _, err := NextJobRunDate(jobDefinition.Schedule, after); err != nil {
+			t.Errorf("job %s: %v", jobName, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	db "core_service/database"
+	satData "core_service/satelliteS3"
+)
+
+var ERROR_INVALID_STAC_INDEX = errors.New("Invalid stac index request")
+
+// StacIndexRequest is the search a StacIndexTask indexes, both dates are
+// included. The bbox is min longitude, min latitude, max longitude and
+// max latitude.
+type StacIndexRequest struct {
+	StartDate time.Time
+	EndDate   time.Time
+	Bbox      [4]float64
+	// scenes with more cloud cover are skipped, unless it is nil
+	MaxCloudCover *float64
+}
+
+// ParseStacIndexRequest reads the startDate, endDate, comma separated
+// bbox and optional maxCloudCover percentage of a stac index event.
+func ParseStacIndexRequest(data map[string]string) (*StacIndexRequest, error) {
+	startDate, err := time.Parse(BACKFILL_DATE_FORMAT, data["startDate"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid start date %q", ERROR_INVALID_STAC_INDEX, data["startDate"])
+	}
+	endDate, err := time.Parse(BACKFILL_DATE_FORMAT, data["endDate"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid end date %q", ERROR_INVALID_STAC_INDEX, data["endDate"])
+	} else if endDate.Before(startDate) {
+		return nil, fmt.Errorf("%w: end date is before the start date", ERROR_INVALID_STAC_INDEX)
+	}
+	request := StacIndexRequest{StartDate: startDate, EndDate: endDate}
+
+	bboxItems := strings.Split(data["bbox"], ",")
+	if len(bboxItems) != 4 {
+		return nil, fmt.Errorf("%w: the bbox needs 4 coordinates", ERROR_INVALID_STAC_INDEX)
+	}
+	for i, bboxItem := range bboxItems {
+		request.Bbox[i], err = strconv.ParseFloat(strings.TrimSpace(bboxItem), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid bbox coordinate %q", ERROR_INVALID_STAC_INDEX, bboxItem)
+		}
+	}
+	minLon, minLat, maxLon, maxLat := request.Bbox[0], request.Bbox[1], request.Bbox[2], request.Bbox[3]
+	if minLon < -180 || maxLon > 180 || minLat < -90 || maxLat > 90 || minLon > maxLon || minLat > maxLat {
+		return nil, fmt.Errorf("%w: bbox out of range, boxes crossing the antimeridian need two requests", ERROR_INVALID_STAC_INDEX)
+	}
+
+	if cloudCover := strings.TrimSpace(data["maxCloudCover"]); cloudCover != "" {
+		maxCloudCover, err := strconv.ParseFloat(cloudCover, 64)
+		if err != nil || maxCloudCover < 0 || maxCloudCover > 100 {
+			return nil, fmt.Errorf("%w: invalid max cloud cover %q", ERROR_INVALID_STAC_INDEX, cloudCover)
+		}
+		request.MaxCloudCover = &maxCloudCover
+	}
+	return &request, nil
+}
+
+// Data is the event data the request was parsed from.
+func (obj *StacIndexRequest) Data() map[string]string {
+	bboxItems := make([]string, 0, len(obj.Bbox))
+	for _, coordinate := range obj.Bbox {
+		bboxItems = append(bboxItems, strconv.FormatFloat(coordinate, 'f', -1, 64))
+	}
+	data := map[string]string{
+		"startDate": obj.StartDate.Format(BACKFILL_DATE_FORMAT),
+		"endDate":   obj.EndDate.Format(BACKFILL_DATE_FORMAT),
+		"bbox":      strings.Join(bboxItems, ","),
+	}
+	if obj.MaxCloudCover != nil {
+		data["maxCloudCover"] = strconv.FormatFloat(*obj.MaxCloudCover, 'f', -1, 64)
+	}
+	return data
+}
+
+// Key identifies the search, like 2023-01-01/2023-06-30/-94,44,-92,46/20.
+func (obj *StacIndexRequest) Key() string {
+	data := obj.Data()
+	return fmt.Sprintf("%s/%s/%s/%s", data["startDate"], data["endDate"], data["bbox"], data["maxCloudCover"])
+}
+
+func (obj *StacIndexRequest) Search() satData.StacSearch {
+	return satData.StacSearch{
+		Bbox:          obj.Bbox,
+		StartDate:     obj.StartDate,
+		EndDate:       obj.EndDate,
+		MaxCloudCover: obj.MaxCloudCover,
+	}
+}
+
+// StacIndexTask indexes the items of a STAC search instead of the csv
+// files of the inventory. Each page of items becomes the tiles, with the
+// items' geometry and scene metadata, and the RequestMapTask events of
+// the objects which haven't been ingested, the same way an index run
+// does, so the map tasks still insert the files into the tiles and queue
+// the map builds.
+func StacIndexTask(ctx context.Context, event *db.Event) (*db.EventResult, error) {
+	log.Printf("StacIndexTask(%s)\n", event.ID.Hex())
+	result := db.NewEventResult()
+
+	request, err := ParseStacIndexRequest(event.Data)
+	if err != nil {
+		return result, Permanent(err)
+	}
+
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	setting, err := db.FindCurrentSetting(ctx, dbClient)
+	if err != nil {
+		log.Println("failed to load settings")
+		return result, err
+	}
+	result.SettingVersion = setting.Version
+	batchSize := setting.IndexBatchSize
+	if batchSize < 1 {
+		batchSize = DEFAULT_INDEX_BATCH_SIZE
+	}
+	tileFiles := make(map[string]bool)
+	for _, fileType := range setting.TileFiles {
+		tileFiles[fileType] = true
+	}
+
+	inventoryFile := db.InventoryFile{Key: fmt.Sprintf("stac/%s", request.Key())}
+	handleInvalid := invalidRecordCounter(inventoryFile.Key, result)
+	stacClient := satData.NewStacClient(satData.STAC_SEARCH_URL)
+	err = stacClient.Search(ctx, request.Search(), func(items []satData.StacItem) error {
+		records := make([][]string, 0, len(items))
+		sceneTiles := make(map[string]db.Tile)
+		for _, item := range items {
+			scene, err := item.Scene(satData.SATELLITE_S3_IMAGE_BUCKET, tileFiles)
+			if err != nil {
+				handleInvalid([]string{item.Id}, err)
+				continue
+			} else if scene == nil {
+				continue
+			}
+
+			tile := tileFromScene(scene)
+			sceneTiles[tile.UniqueKey()] = tile
+			for _, tileFile := range tile.Files {
+				records = append(records, []string{
+					satData.SATELLITE_S3_IMAGE_BUCKET,
+					tileFile.ObjectPath,
+					strconv.Itoa(tileFile.Size),
+					item.Properties.Datetime.UTC().Format(time.RFC3339),
+				})
+			}
+		}
+		result.AddCount("items", int64(len(items)))
+		return ingestIndexRecords(ctx, dbClient, event, &inventoryFile, records, sceneTiles, batchSize, result)
+	})
+	if err != nil {
+		log.Println("failed to index the stac search")
+		return result, err
+	}
+
+	if failedObjects := result.Counts["failedObjects"]; failedObjects > 0 {
+		return result, fmt.Errorf("%w: %d objects failed", ERROR_PARTIAL_INDEX, failedObjects)
+	}
+	return result, nil
+}
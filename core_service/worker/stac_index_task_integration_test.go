@@ -0,0 +1,88 @@
+//go:build integration
+
+package worker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	db "core_service/database"
+	satData "core_service/satelliteS3"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStacIndexTask(t *testing.T) {
+	db.CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stub serves the canned items with asset hrefs in the test bucket
+	itemData, err := os.ReadFile("example_data/stac-items.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.ReplaceAll(string(itemData), "sentinel-cogs", satData.SATELLITE_S3_IMAGE_BUCKET)))
+	}))
+	defer server.Close()
+	stacSearchUrl := satData.STAC_SEARCH_URL
+	satData.STAC_SEARCH_URL = server.URL
+	defer func() { satData.STAC_SEARCH_URL = stacSearchUrl }()
+
+	setting := db.Setting{
+		UtmZones:      []string{"39P"},
+		TileFiles:     []string{"B04.tif"},
+		TileStartDate: primitive.NewDateTimeFromTime(time.Date(2023, time.Month(8), 20, 0, 0, 0, 0, time.UTC)),
+	}
+	if err := db.SaveSetting(ctx, dbClient, &setting); err != nil {
+		t.Fatal(err)
+	}
+
+	stacEvent := db.Event{
+		EventType: "StacIndexTask",
+		Data:      map[string]string{"startDate": "2023-08-01", "endDate": "2023-08-31", "bbox": "-94,44,-92,46"},
+	}
+	if err := db.SaveEvent(ctx, dbClient, &stacEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	// the third item's asset is in another square's scene
+	result, err := StacIndexTask(ctx, &stacEvent)
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Counts["items"] != 3 || result.Counts["newObjects"] != 2 || result.Counts["tiles"] != 2 || result.Counts["invalidObjects"] != 1 {
+		t.Fatalf("expected the two B04 files to be ingested: %v", result.Counts)
+	}
+
+	tile, err := db.FindTile(ctx, dbClient, bson.D{{"mgrs_code", "15TUL"}, {"source_satellite", "S2C-L2A"}})
+	if err != nil || tile == nil {
+		t.Fatalf("expected the S2C tile to be saved: %v", err)
+	} else if tile.Geometry.Type != "Polygon" || len(tile.Files) != 0 {
+		t.Errorf("expected the tile to have the item's geometry and no files yet: %v", tile)
+	} else if tile.CloudCover == nil || *tile.CloudCover != 11.0 {
+		t.Errorf("expected the tile to have the item's cloud cover: %+v", tile.SceneMetadata)
+	}
+
+	// running the search again publishes nothing new
+	result, err = StacIndexTask(ctx, &stacEvent)
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Counts["newObjects"] != 0 {
+		t.Fatalf("expected no new objects: %v", result.Counts)
+	}
+	mapEventCount, err := db.EventCollection(dbClient).CountDocuments(ctx, bson.D{{"event_type", "RequestMapTask"}})
+	if err != nil || mapEventCount != 2 {
+		t.Errorf("expected 2 map events but found %d", mapEventCount)
+	}
+}
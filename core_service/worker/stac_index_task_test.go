@@ -0,0 +1,45 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseStacIndexRequest(t *testing.T) {
+	request, err := ParseStacIndexRequest(map[string]string{
+		"startDate":     "2023-08-01",
+		"endDate":       "2023-08-31",
+		"bbox":          "-94.5, 44, -92, 46.25",
+		"maxCloudCover": "20",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Bbox != [4]float64{-94.5, 44, -92, 46.25} || request.MaxCloudCover == nil || *request.MaxCloudCover != 20 {
+		t.Errorf("unexpected request %v", request)
+	}
+	if request.Key() != "2023-08-01/2023-08-31/-94.5,44,-92,46.25/20" {
+		t.Errorf("unexpected key %s", request.Key())
+	}
+
+	request, err = ParseStacIndexRequest(map[string]string{"startDate": "2023-08-01", "endDate": "2023-08-31", "bbox": "-94,44,-92,46"})
+	if err != nil {
+		t.Fatal(err)
+	} else if request.MaxCloudCover != nil {
+		t.Errorf("expected no cloud cover filter but found %f", *request.MaxCloudCover)
+	}
+
+	invalidData := []map[string]string{
+		{"startDate": "2023-08-01", "endDate": "2023-07-31", "bbox": "-94,44,-92,46"},
+		{"startDate": "2023-08-01", "endDate": "2023-08-31", "bbox": "-94,44,-92"},
+		{"startDate": "2023-08-01", "endDate": "2023-08-31", "bbox": "-94,44,-92,north"},
+		{"startDate": "2023-08-01", "endDate": "2023-08-31", "bbox": "179,44,-179,46"},
+		{"startDate": "2023-08-01", "endDate": "2023-08-31", "bbox": "-94,44,-92,91"},
+		{"startDate": "2023-08-01", "endDate": "2023-08-31", "bbox": "-94,44,-92,46", "maxCloudCover": "101"},
+	}
+	for _, data := range invalidData {
+		if _, err := ParseStacIndexRequest(data); !errors.Is(err, ERROR_INVALID_STAC_INDEX) {
+			t.Errorf("expected %v to be invalid but found %v", data, err)
+		}
+	}
+}
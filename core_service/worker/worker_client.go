@@ -5,150 +5,289 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sync"
 	"time"
 
 	db "core_service/database"
+	satData "core_service/satelliteS3"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// how often a running event renews its lease and checks whether it was
+// cancelled
+const EVENT_HEARTBEAT_INTERVAL = 10 * time.Second
+
 type TaskDefinition struct {
-	TaskFunc    func(context.Context, *db.Event) error
+	// the result returned by the task is stored on the event, even when
+	// the task fails
+	TaskFunc    func(context.Context, *db.Event) (*db.EventResult, error)
 	MaxDuration time.Duration
+	// the most events of this type a single worker process will run at
+	// the same time, zero means only the pool size limits it
+	MaxConcurrency int
+	// zero valued fields fall back to the DefaultRetryPolicy
+	RetryPolicy RetryPolicy
 }
 
 var TaskDefinitions = map[string]TaskDefinition{
-	"RequestCurrentIndexFilesTask": TaskDefinition{TaskFunc: RequestCurrentIndexFilesTask, MaxDuration: 1 * time.Hour},
-	"RequestMapTask":               TaskDefinition{TaskFunc: RequestMapTask, MaxDuration: 5 * time.Minute},
-	"BuildBoundaryMapTask":         TaskDefinition{TaskFunc: BuildBoundaryMapTask, MaxDuration: 5 * time.Minute},
+	"RequestCurrentIndexFilesTask": TaskDefinition{TaskFunc: RequestCurrentIndexFilesTask, MaxDuration: 1 * time.Hour, MaxConcurrency: 1, RetryPolicy: RetryPolicy{MaxAttempts: 3, BaseDelay: 5 * time.Minute}},
+	"RequestMapTask":               TaskDefinition{TaskFunc: RequestMapTask, MaxDuration: 5 * time.Minute, MaxConcurrency: 8, RetryPolicy: RetryPolicy{MaxAttempts: 3}},
+	"BuildBoundaryMapTask":         TaskDefinition{TaskFunc: BuildBoundaryMapTask, MaxDuration: 5 * time.Minute, MaxConcurrency: 8, RetryPolicy: RetryPolicy{MaxAttempts: 3, BaseDelay: 1 * time.Minute}},
+	"CleanupRastersTask":           TaskDefinition{TaskFunc: CleanupRastersTask, MaxDuration: 30 * time.Minute, MaxConcurrency: 1, RetryPolicy: RetryPolicy{MaxAttempts: 2}},
+	"BackfillIndexTask":            TaskDefinition{TaskFunc: BackfillIndexTask, MaxDuration: 10 * time.Minute, MaxConcurrency: 1, RetryPolicy: RetryPolicy{MaxAttempts: 3}},
+	"BackfillIndexChunkTask":       TaskDefinition{TaskFunc: BackfillIndexChunkTask, MaxDuration: 15 * time.Minute, MaxConcurrency: 2, RetryPolicy: RetryPolicy{MaxAttempts: 3}},
+	"StacIndexTask":                TaskDefinition{TaskFunc: StacIndexTask, MaxDuration: 30 * time.Minute, MaxConcurrency: 1, RetryPolicy: RetryPolicy{MaxAttempts: 3}},
 	"FailableTask":                 TaskDefinition{TaskFunc: FailableTask, MaxDuration: 5 * time.Second},
 }
 
-func FailableTask(ctx context.Context, event *db.Event) error {
+// identifies this process as the owner of the events it claims
+var WorkerLeaseOwner = defaultWorkerLeaseOwner()
+
+func defaultWorkerLeaseOwner() string {
+	hostName, err := os.Hostname()
+	if err != nil {
+		hostName = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostName, os.Getpid())
+}
+
+func FailableTask(ctx context.Context, event *db.Event) (*db.EventResult, error) {
 	log.Printf("FailableTask(%s)\n", event.ID.Hex())
+	result := db.NewEventResult()
+	result.AddCount("runs", 1)
 
 	if event.Data["fail"] == "true" {
-		return errors.New("failed task!")
+		return result, errors.New("failed task!")
 	}
-	return nil
+	return result, nil
 }
 
-func WorkerClient(ctx context.Context) {
+// WorkerClient runs the worker pool until the context is done and the
+// in-flight events are drained or released. With the
+// DISPATCH_CHANGE_STREAM dispatch mode idle workers are woken as soon as
+// an event is inserted instead of waiting for their next poll. The
+// worker registers itself under the name in the worker collection.
+func WorkerClient(ctx context.Context, name string, concurrency int, dispatch string) {
 	dbClient, err := db.DefaultDatabaseClient(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// background task
-	// go StartObserver(ctx, dbClient)
+	pool := NewWorkerPool(NewMongoQueue(dbClient), concurrency)
+	switch dispatch {
+	case DISPATCH_CHANGE_STREAM:
+		go pool.dispatchEventInserts(ctx)
+	case DISPATCH_POLL:
+	default:
+		log.Fatalf("unknown dispatch mode %s\n", dispatch)
+	}
 
-	for {
-		log.Println("[worker] processing next event")
-		delay := 5 * time.Second
-		if err := ProcessNextEvent(ctx, dbClient); err != nil {
-			if err == mongo.ErrNoDocuments {
-				log.Println("[worker] no events found")
-			} else {
-				log.Println(err)
-			}
-		} else {
-			delay = 1 * time.Millisecond
-		}
+	// the observer and the heartbeat write to the database when they
+	// stop, so wait for them before returning
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		// runs the scheduled jobs while this worker is the scheduler leader
+		StartObserver(ctx, dbClient, WorkerLeaseOwner)
+	}()
+	registration := NewWorkerRegistration(name, pool.concurrency)
+	go func() {
+		defer background.Done()
+		RunWorkerHeartbeat(ctx, dbClient, &registration, pool)
+	}()
 
-		// might not be needed due to db.FindNextEvent failing when no events
-		time.Sleep(delay)
-	}
+	pool.Run(ctx)
+	background.Wait()
 }
 
-func ProcessNextEvent(ctx context.Context, dbClient *mongo.Client) error {
-	event, err := db.FindNextEvent(ctx, dbClient)
+func ProcessNextEvent(ctx context.Context, queue Queue) error {
+	opts := db.NextEventOptions{LeaseOwner: WorkerLeaseOwner}
+	event, err := queue.Claim(ctx, &opts)
 	if err != nil {
 		return err
 	}
 
+	return ProcessEvent(ctx, queue, event)
+}
+
+func ProcessEvent(ctx context.Context, queue Queue, event *db.Event) error {
 	log.Println("[worker] processing event:", event.ID.Hex(), ", type:", event.EventType)
 
 	task, exists := TaskDefinitions[event.EventType]
 	if !exists {
 		log.Println("[worker] event type not implemented")
+		event.Attempts += 1
+		event.Errors = append(event.Errors, newEventError(event, db.EVENT_ERROR_CLASS_UNKNOWN_TASK, "event type not implemented"))
 		event.Failed = true
-		if err := db.SaveEvent(ctx, dbClient, event); err != nil {
-			return err
-		}
+		return completeProcessedEvent(ctx, queue, event)
 	}
 
 	taskCtx, taskCtxCancel := context.WithTimeout(ctx, task.MaxDuration)
 	defer taskCtxCancel()
 
-	err = task.TaskFunc(taskCtx, event)
+	// keep the lease alive while the task runs, if another worker took
+	// the event over or it was cancelled there is no point in finishing
+	// it here
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	heartbeatDone := make(chan error, 1)
+	go func() {
+		heartbeatDone <- heartbeatEventLease(heartbeatCtx, queue, event, taskCtxCancel)
+	}()
+
+	result, err := task.TaskFunc(taskCtx, event)
+	stopHeartbeat()
+	heartbeatErr := <-heartbeatDone
+
+	if heartbeatErr != db.ERROR_EVENT_CANCELLED && ctx.Err() != nil {
+		// the worker is shutting down, the run doesn't count as an attempt
+		log.Println("[worker] releasing event:", event.ID.Hex())
+		event.Errors = append(event.Errors, db.EventError{
+			Date:    primitive.NewDateTimeFromTime(time.Now()),
+			Attempt: event.Attempts + 1,
+			Class:   db.EVENT_ERROR_CLASS_SHUTDOWN,
+			Message: "worker shut down before the task finished",
+		})
+		event.Started = false
+		return completeProcessedEvent(detachedContext{ctx}, queue, event)
+	}
+
 	event.Attempts += 1
-	if err != nil {
-		errorData := fmt.Sprintf("%v", err)
-		if len(errorData) > 250 {
-			errorData = errorData[:250]
-		}
-		event.Errors = append(event.Errors, errorData)
+	if result != nil {
+		result.Attempt = event.Attempts
+		event.Result = result
+	}
+	if heartbeatErr == db.ERROR_EVENT_CANCELLED {
+		log.Println("[worker] cancelled event:", event.ID.Hex())
+		event.Errors = append(event.Errors, newEventError(event, db.EVENT_ERROR_CLASS_CANCELLED, heartbeatErr.Error()))
+		event.Started = false
+		event.Cancelled = true
+	} else if err != nil {
+		event.Errors = append(event.Errors, newEventError(event, errorClass(err), err.Error()))
 		event.Started = false
-		if event.Attempts >= event.MaxAttemps {
+
+		retryPolicy := task.RetryPolicy.withDefaults()
+		event.MaxAttemps = eventMaxAttempts(event)
+		if event.Attempts < event.MaxAttemps && retryPolicy.Retryable(err) {
+			retryDelay := retryPolicy.RetryDelay(event.Attempts)
+			event.StartAfterDate = primitive.NewDateTimeFromTime(time.Now().Add(retryDelay))
+			log.Printf("[worker] retrying event %s in %v\n", event.ID.Hex(), retryDelay)
+		} else {
 			event.Failed = true
 		}
 	} else {
 		event.Passed = true
 	}
 
-	if err := db.SaveEvent(ctx, dbClient, event); err != nil {
-		return err
+	return completeProcessedEvent(ctx, queue, event)
+}
+
+func newEventError(event *db.Event, class, message string) db.EventError {
+	return db.EventError{
+		Date:    primitive.NewDateTimeFromTime(time.Now()),
+		Attempt: event.Attempts,
+		Class:   class,
+		Message: message,
 	}
+}
 
-	return nil
+// errorClass groups task errors for the error records, errors without a
+// class of their own are named by their Go type.
+func errorClass(err error) string {
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) {
+		return db.EVENT_ERROR_CLASS_PERMANENT
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		return db.EVENT_ERROR_CLASS_TIMEOUT
+	} else if errors.Is(err, context.Canceled) {
+		return db.EVENT_ERROR_CLASS_CANCELLED
+	}
+	return fmt.Sprintf("%T", err)
 }
 
-func StartObserver(ctx context.Context, dbClient *mongo.Client) {
-	indexTicker := time.NewTicker(24 * time.Hour)
+// downloadObject gets a satellite data object and counts its bytes on
+// the result of the task.
+func downloadObject(ctx context.Context, result *db.EventResult, localPath, objectPath, sourceBucket string) error {
+	numBytes, err := satData.DownloadObject(ctx, localPath, objectPath, sourceBucket)
+	result.BytesDownloaded += numBytes
+	return err
+}
+
+// completeProcessedEvent gives up the lease on the event and stores the
+// outcome of the run.
+func completeProcessedEvent(ctx context.Context, queue Queue, event *db.Event) error {
+	leaseOwner := event.LeaseOwner
+	event.LeaseOwner = ""
+	event.LeaseExpiresDate = 0
+	return queue.Complete(ctx, event, leaseOwner)
+}
+
+// heartbeatEventLease renews the lease until the context is done. It
+// cancels the task and returns the reason when the lease is lost or the
+// event is cancelled.
+func heartbeatEventLease(ctx context.Context, queue Queue, event *db.Event, cancelTask context.CancelFunc) error {
+	heartbeatTicker := time.NewTicker(EVENT_HEARTBEAT_INTERVAL)
+	defer heartbeatTicker.Stop()
 
+	leasedEvent := db.Event{ID: event.ID, LeaseOwner: event.LeaseOwner}
 	for {
 		select {
-		case <-indexTicker.C:
-			if err := PublishPeriodicIndexEvent(ctx, dbClient); err != nil {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeatTicker.C:
+			err := queue.RenewLease(ctx, &leasedEvent, db.DEFAULT_EVENT_LEASE_DURATION)
+			if err == db.ERROR_EVENT_LEASE_LOST || err == db.ERROR_EVENT_CANCELLED {
+				log.Printf("[worker] stopping event %s: %v\n", event.ID.Hex(), err)
+				cancelTask()
+				return err
+			} else if err != nil && ctx.Err() == nil {
 				log.Println(err)
 			}
 		}
 	}
+}
 
+func ReapExpiredEventLeases(ctx context.Context, dbClient *mongo.Client) error {
+	releasedCount, err := NewMongoQueue(dbClient).ReleaseExpiredLeases(ctx)
+	if err != nil {
+		return err
+	}
+	if releasedCount > 0 {
+		log.Printf("[worker] returned %d events with expired leases to the queue\n", releasedCount)
+	}
+	return nil
+}
+
+// CancelEvents cancels the events selected by the query. Queued events
+// are never picked up and running ones are stopped by their worker at
+// the next heartbeat.
+func CancelEvents(ctx context.Context, queue Queue, query *db.EventQuery) (int64, error) {
+	cancelledCount, err := queue.Cancel(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("[worker] cancelled %d events\n", cancelledCount)
+	return cancelledCount, nil
 }
 
 func PublishPeriodicIndexEvent(ctx context.Context, dbClient *mongo.Client) error {
 
-	// handle periodic load of new satellite data
-	activeIndexEventCount, err := db.CountEvents(
-		ctx,
-		dbClient,
-		bson.D{
-			{"event_type", "RequestCurrentIndexFilesTask"},
-			{"started", false},
-			{"passed", false},
-			{"failed", false},
-			{"$expr", bson.D{
-				{"$lt", bson.A{"$attempts", "$max_attempts"}},
-			}},
-		},
-	)
-	if err != nil {
+	// handle periodic load of new satellite data, the dedup key makes
+	// sure only one index event waits in the queue at a time
+	indexFileEvent := db.Event{
+		EventType:      "RequestCurrentIndexFilesTask",
+		StartAfterDate: primitive.NewDateTimeFromTime(time.Now()),
+		DedupKey:       "RequestCurrentIndexFilesTask",
+	}
+	if err := NewMongoQueue(dbClient).Publish(ctx, &indexFileEvent); err == db.ERROR_DUPLICATE_EVENT {
+		log.Println("[observer] index file event not published")
+	} else if err != nil {
 		return err
-	} else if activeIndexEventCount == 0 {
-		log.Println("[observer] publishing index file event")
-		indexFileEvent := db.Event{
-			EventType:      "RequestCurrentIndexFilesTask",
-			MaxAttemps:     1,
-			StartAfterDate: primitive.NewDateTimeFromTime(time.Now().Add(7 * 24 * time.Hour)),
-		}
-		if err := db.SaveEvent(ctx, dbClient, &indexFileEvent); err != nil {
-			return err
-		}
 	} else {
-		log.Println("[observer] index file event not published")
+		log.Println("[observer] published index file event")
 	}
 
 	return nil
@@ -0,0 +1,122 @@
+//go:build integration
+
+package worker
+
+import (
+	"context"
+	"testing"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestPublishPeriodicIndexEvent(t *testing.T) {
+	db.CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if eventCount, err := db.CountEvents(ctx, dbClient, bson.D{}); err != nil {
+		t.Fatal(err)
+	} else if eventCount != 0 {
+		t.Fatal("event collection was not empty")
+	}
+
+	if err := PublishPeriodicIndexEvent(ctx, dbClient); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := db.FindEvents(ctx, dbClient, bson.D{}, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(*events) != 1 {
+		t.Fatalf("expected 1 event but found %d", len(*events))
+	}
+
+	event1 := (*events)[0]
+	if event1.EventType != "RequestCurrentIndexFilesTask" || event1.MaxAttemps != 0 || event1.StartAfterDate == 0 {
+		t.Log("event not created as expected")
+		t.Fatal(event1)
+	}
+
+	// attempt to publish another event
+	if err := PublishPeriodicIndexEvent(ctx, dbClient); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err = db.FindEvents(ctx, dbClient, bson.D{}, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(*events) != 1 {
+		t.Fatalf("expected 1 event but found %d", len(*events))
+	}
+
+	event2 := (*events)[0]
+	if event1.ID != event2.ID {
+		t.Fatal("the orignal event was deleted and replaced")
+	}
+	if event2.EventType != "RequestCurrentIndexFilesTask" || event2.MaxAttemps != 0 || event2.StartAfterDate == 0 {
+		t.Log("event was updated unexpectedly")
+		t.Fatal(event2)
+	}
+
+}
+
+func TestRequeueDeadEvent(t *testing.T) {
+	db.CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event1 := db.Event{
+		EventType: "FailableTask",
+		MaxAttemps: 1,
+		Data: map[string]string{"fail": "true"},
+	}
+	if err = db.SaveEvent(ctx, dbClient, &event1); err != nil {
+		t.Fatal(err)
+	}
+	if err = ProcessNextEvent(ctx, NewMongoQueue(dbClient)); err != nil {
+		t.Fatal(err)
+	}
+
+	if deadCount, err := db.CountDeadEvents(ctx, dbClient, bson.D{}); err != nil {
+		t.Fatal(err)
+	} else if deadCount != 1 {
+		t.Fatalf("expected 1 dead event but found %d", deadCount)
+	}
+
+	requeuedEvent, err := db.RequeueDeadEvent(ctx, dbClient, event1.ID)
+	if err != nil {
+		t.Fatal(err)
+	} else if requeuedEvent.ID != event1.ID || requeuedEvent.Attempts != 0 || requeuedEvent.Failed || len(requeuedEvent.Errors) != 1 {
+		t.Fatal(requeuedEvent)
+	}
+
+	if deadCount, err := db.CountDeadEvents(ctx, dbClient, bson.D{}); err != nil {
+		t.Fatal(err)
+	} else if deadCount != 0 {
+		t.Fatalf("expected no dead events but found %d", deadCount)
+	}
+
+	// fails again and can then be discarded for good
+	if err = ProcessNextEvent(ctx, NewMongoQueue(dbClient)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DiscardDeadEvent(ctx, dbClient, event1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if deadCount, err := db.CountDeadEvents(ctx, dbClient, bson.D{}); err != nil {
+		t.Fatal(err)
+	} else if deadCount != 0 {
+		t.Fatalf("expected no dead events but found %d", deadCount)
+	}
+}
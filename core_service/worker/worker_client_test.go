@@ -2,156 +2,385 @@ package worker
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	db "core_service/database"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-
-func TestPublishPeriodicIndexEvent(t *testing.T) {
-	db.CleanTestDatabase()
-
+func TestProcessNextEventWithPassingEvent(t *testing.T) {
 	ctx := context.Background()
-	dbClient, err := db.DefaultDatabaseClient(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
+	queue := NewMemoryQueue()
 
-	if eventCount, err := db.CountEvents(ctx, dbClient, bson.D{}); err != nil {
+	event1 := db.Event{
+		EventType: "FailableTask",
+		MaxAttemps: 1,
+		StartAfterDate: primitive.NewDateTimeFromTime(time.Now().Add(0*time.Second)),
+		Data: map[string]string{"fail": "false"},
+	}
+	if err := queue.Publish(ctx, &event1); err != nil {
 		t.Fatal(err)
-	} else if eventCount != 0 {
-		t.Fatal("event collection was not empty")
 	}
 
-	if err := PublishPeriodicIndexEvent(ctx, dbClient); err != nil {
+	if err := ProcessNextEvent(ctx, queue); err != nil {
 		t.Fatal(err)
 	}
 
-	events, err := db.FindEvents(ctx, dbClient, bson.D{}, &options.FindOptions{})
-	if err != nil {
-		t.Fatal(err)
-	} else if len(*events) != 1 {
-		t.Fatalf("expected 1 event but found %d", len(*events))
+	event1 = queue.Events()[0]
+	if event1.Attempts != 1 || !event1.Passed || event1.Failed {
+		t.Fatal("event was not passed correctly")
+	} else if event1.Data["fail"] != "false" {
+		t.Fatal("data was changed")
+	} else if event1.LeaseOwner != "" {
+		t.Fatal("lease was not given up")
+	}
+	if event1.Result == nil || event1.Result.Attempt != 1 || event1.Result.Counts["runs"] != 1 {
+		t.Fatal("task result was not stored on the event")
 	}
 
-	event1 := (*events)[0]
-	if event1.EventType != "RequestCurrentIndexFilesTask" || event1.MaxAttemps != 1 || event1.StartAfterDate == 0 {
-		t.Log("event not created as expected")
-		t.Fatal(event1)
+	if err := ProcessNextEvent(ctx, queue); err != mongo.ErrNoDocuments {
+		t.Fatalf("expected no documents but found %v", err)
 	}
 
-	// attempt to publish another event
-	if err := PublishPeriodicIndexEvent(ctx, dbClient); err != nil {
+}
+
+func TestProcessNextEventWithFailingEvent(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+
+	event1 := db.Event{
+		EventType: "FailableTask",
+		MaxAttemps: 1,
+		StartAfterDate: primitive.NewDateTimeFromTime(time.Now().Add(0*time.Second)),
+		Data: map[string]string{"fail": "true"},
+	}
+	if err := queue.Publish(ctx, &event1); err != nil {
 		t.Fatal(err)
 	}
 
-	events, err = db.FindEvents(ctx, dbClient, bson.D{}, &options.FindOptions{})
-	if err != nil {
+	if err := ProcessNextEvent(ctx, queue); err != nil {
 		t.Fatal(err)
-	} else if len(*events) != 1 {
-		t.Fatalf("expected 1 event but found %d", len(*events))
 	}
 
-	event2 := (*events)[0]
-	if event1.ID != event2.ID {
-		t.Fatal("the orignal event was deleted and replaced")
+	// the failed event is moved to the dead events
+	if eventCount, err := queue.Count(ctx, &db.EventQuery{}); err != nil {
+		t.Fatal(err)
+	} else if eventCount != 0 {
+		t.Fatal("failed event should be removed from the queue")
 	}
-	if event2.EventType != "RequestCurrentIndexFilesTask" || event2.MaxAttemps != 1 || event2.StartAfterDate == 0 {
-		t.Log("event was updated unexpectedly")
-		t.Fatal(event2)
+
+	deadEvents := queue.DeadEvents()
+	if len(deadEvents) != 1 || deadEvents[0].ID != event1.ID {
+		t.Fatal(deadEvents)
 	}
+	deadEvent := deadEvents[0]
+	event1 = deadEvent.Event
 
-}
+	if event1.Attempts != 1 || event1.Passed || !event1.Failed {
+		t.Fatal("event was not failed correctly")
+	} else if event1.Data["fail"] != "true" {
+		t.Fatal("data was changed")
+	} else if len(event1.Errors) != 1 || event1.Errors[0].Message != "failed task!" || event1.Errors[0].Attempt != 1 {
+		t.Fatal(event1.Errors)
+	} else if deadEvent.Reason != "failed task!" {
+		t.Fatal(deadEvent.Reason)
+	}
 
+	if err := ProcessNextEvent(ctx, queue); err != mongo.ErrNoDocuments {
+		t.Fatalf("expected no documents but found %v", err)
+	}
 
-func TestProcessNextEventWithPassingEvent(t *testing.T) {
-	db.CleanTestDatabase()
+}
 
+func TestProcessEventWithUnknownEventType(t *testing.T) {
 	ctx := context.Background()
-	dbClient, err := db.DefaultDatabaseClient(ctx)
-	if err != nil {
+	queue := NewMemoryQueue()
+
+	if err := queue.Publish(ctx, &db.Event{EventType: "MissingTask"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProcessNextEvent(ctx, queue); err != nil {
 		t.Fatal(err)
 	}
 
+	deadEvents := queue.DeadEvents()
+	if len(deadEvents) != 1 || deadEvents[0].Reason != "event type not implemented" {
+		t.Fatal(deadEvents)
+	}
+}
+
+func TestReleaseExpiredEventLeases(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+
 	event1 := db.Event{
 		EventType: "FailableTask",
-		MaxAttemps: 1,
-		StartAfterDate: primitive.NewDateTimeFromTime(time.Now().Add(0*time.Second)),
+		MaxAttemps: 2,
 		Data: map[string]string{"fail": "false"},
 	}
-	err = db.SaveEvent(ctx, dbClient, &event1)
-	if err != nil {
+	if err := queue.Publish(ctx, &event1); err != nil {
 		t.Fatal(err)
 	}
 
-	if err = ProcessNextEvent(ctx, dbClient); err != nil {
+	// claim the event with a lease that runs out right away, as if
+	// the worker died while running it
+	opts := db.NextEventOptions{LeaseOwner: "crashed-worker", LeaseDuration: 1 * time.Millisecond}
+	claimedEvent, err := queue.Claim(ctx, &opts)
+	if err != nil {
 		t.Fatal(err)
+	} else if claimedEvent.ID != event1.ID || claimedEvent.LeaseOwner != "crashed-worker" || !claimedEvent.Started {
+		t.Fatal(claimedEvent)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err := queue.RenewLease(ctx, &db.Event{ID: event1.ID, LeaseOwner: "other-worker"}, time.Minute); err != db.ERROR_EVENT_LEASE_LOST {
+		t.Fatal("only the lease owner should be able to renew the lease")
 	}
 
-	if err = event1.RefreshFromDb(ctx, dbClient); err != nil {
+	releasedCount, err := queue.ReleaseExpiredLeases(ctx)
+	if err != nil {
 		t.Fatal(err)
+	} else if releasedCount != 1 {
+		t.Fatalf("expected 1 released event but found %d", releasedCount)
 	}
 
-	if event1.Attempts != 1 || !event1.Passed || event1.Failed {
-		t.Fatal("event was not passed correctly")
-	} else if event1.Data["fail"] != "false" {
-		t.Fatal("data was changed")
+	event1 = queue.Events()[0]
+	if event1.Started || event1.Failed || event1.Attempts != 1 || event1.LeaseOwner != "" {
+		t.Fatal(event1)
+	} else if len(event1.Errors) != 1 || event1.Errors[0].Class != db.EVENT_ERROR_CLASS_LEASE_EXPIRED {
+		t.Fatal(event1.Errors)
 	}
 
-	if err = ProcessNextEvent(ctx, dbClient); err == nil {
-		t.Fatal("should have returned an error")
-	} else if err != mongo.ErrNoDocuments {
-		t.Log("the error is not correct")
+	// the crashed worker can't save the event anymore
+	if err := queue.Complete(ctx, claimedEvent, "crashed-worker"); err != db.ERROR_EVENT_LEASE_LOST {
+		t.Fatal("expected the lease to be lost")
 	}
 
+	// the released event can be processed again
+	if err := ProcessNextEvent(ctx, queue); err != nil {
+		t.Fatal(err)
+	}
+	event1 = queue.Events()[0]
+	if event1.Attempts != 2 || !event1.Passed || event1.Failed {
+		t.Fatal("event was not passed correctly")
+	}
 }
 
-func TestProcessNextEventWithFailingEvent(t *testing.T) {
-	db.CleanTestDatabase()
+func TestReleaseExpiredCancelledEventLeases(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+
+	event1 := db.Event{EventType: "FailableTask", MaxAttemps: 1}
+	if err := queue.Publish(ctx, &event1); err != nil {
+		t.Fatal(err)
+	}
+	opts := db.NextEventOptions{LeaseOwner: "crashed-worker", LeaseDuration: 1 * time.Millisecond}
+	if _, err := queue.Claim(ctx, &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelled while its worker was gone
+	if _, err := queue.Cancel(ctx, &db.EventQuery{EventId: event1.ID.Hex()}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
 
+	if releasedCount, err := queue.ReleaseExpiredLeases(ctx); err != nil {
+		t.Fatal(err)
+	} else if releasedCount != 1 {
+		t.Fatalf("expected 1 released event but found %d", releasedCount)
+	}
+	if len(queue.DeadEvents()) != 0 {
+		t.Fatal("the cancelled event should not be dead lettered")
+	}
+	event1 = queue.Events()[0]
+	if event1.Started || event1.Failed || !event1.Cancelled || event1.LeaseOwner != "" {
+		t.Fatal(event1)
+	}
+	if cancelledCount, err := queue.Count(ctx, &db.EventQuery{State: db.EVENT_STATE_CANCELLED}); err != nil {
+		t.Fatal(err)
+	} else if cancelledCount != 1 {
+		t.Fatalf("expected 1 cancelled event but found %d", cancelledCount)
+	}
+}
+
+func TestReleaseExpiredEventLeasesUsesTheTaskRetryPolicy(t *testing.T) {
 	ctx := context.Background()
-	dbClient, err := db.DefaultDatabaseClient(ctx)
-	if err != nil {
+	queue := NewMemoryQueue()
+
+	// the chunks of a backfill get 3 attempts from their task's policy
+	event1 := db.Event{EventType: "BackfillIndexChunkTask"}
+	if err := queue.Publish(ctx, &event1); err != nil {
 		t.Fatal(err)
 	}
+	if maxAttempts := TaskMaxAttempts()["BackfillIndexChunkTask"]; maxAttempts != 3 || eventMaxAttempts(&event1) != 3 {
+		t.Fatalf("expected 3 attempts but found %d", maxAttempts)
+	}
+
+	opts := db.NextEventOptions{LeaseOwner: "crashed-worker", LeaseDuration: 1 * time.Millisecond}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if _, err := queue.Claim(ctx, &opts); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if _, err := queue.ReleaseExpiredLeases(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		deadEvents := queue.DeadEvents()
+		if attempt < 3 && len(deadEvents) != 0 {
+			t.Fatalf("expected the event to be retried after lost lease %d", attempt)
+		} else if attempt == 3 && len(deadEvents) != 1 {
+			t.Fatal("expected the event to be dead lettered after its third lost lease")
+		}
+	}
+}
+
+func TestProcessNextEventRetriesWithBackoff(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
 
 	event1 := db.Event{
 		EventType: "FailableTask",
-		MaxAttemps: 1,
-		StartAfterDate: primitive.NewDateTimeFromTime(time.Now().Add(0*time.Second)),
+		MaxAttemps: 3,
 		Data: map[string]string{"fail": "true"},
 	}
-	err = db.SaveEvent(ctx, dbClient, &event1)
-	if err != nil {
+	if err := queue.Publish(ctx, &event1); err != nil {
 		t.Fatal(err)
 	}
 
-	if err = ProcessNextEvent(ctx, dbClient); err != nil {
+	if err := ProcessNextEvent(ctx, queue); err != nil {
 		t.Fatal(err)
 	}
+	event1 = queue.Events()[0]
+	if event1.Attempts != 1 || event1.Started || event1.Failed || event1.Passed {
+		t.Fatal(event1)
+	} else if !event1.StartAfterDate.Time().After(time.Now()) {
+		t.Fatal("the retry should be scheduled in the future")
+	}
+
+	// the event waits for its backoff before it can be claimed again
+	if err := ProcessNextEvent(ctx, queue); err != mongo.ErrNoDocuments {
+		t.Fatal("the event should not be claimable during its backoff")
+	}
+}
+
+func TestBuildBoundaryMapTaskRetriesWithBackoff(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+
+	// the build fails the way it does when s3 is unreachable, the task's
+	// retry policy stays in place
+	buildMapTask := TaskDefinitions["BuildBoundaryMapTask"]
+	failingTask := buildMapTask
+	failingTask.TaskFunc = func(ctx context.Context, event *db.Event) (*db.EventResult, error) {
+		return db.NewEventResult(), errors.New("failed to get satellite data file band 4")
+	}
+	TaskDefinitions["BuildBoundaryMapTask"] = failingTask
+	defer func() { TaskDefinitions["BuildBoundaryMapTask"] = buildMapTask }()
 
-	if err = event1.RefreshFromDb(ctx, dbClient); err != nil {
+	// published the way the map tasks publish it, without its own max attempts
+	event1 := db.Event{EventType: "BuildBoundaryMapTask", Priority: 4, Data: map[string]string{"mgrsCode": "15TUL"}}
+	if err := queue.Publish(ctx, &event1); err != nil {
 		t.Fatal(err)
 	}
 
-	if event1.Attempts != 1 || event1.Passed || !event1.Failed {
-		t.Fatal("event was not failed correctly")
-	} else if event1.Data["fail"] != "true" {
-		t.Fatal("data was changed")
-	} else if len(event1.Errors) != 1 || event1.Errors[0] != "failed task!" {
-		t.Fatal(event1.Errors[0])
+	retryDate := time.Now().Add(buildMapTask.RetryPolicy.BaseDelay / 2)
+	if err := ProcessNextEvent(ctx, queue); err != nil {
+		t.Fatal(err)
+	}
+	event1 = queue.Events()[0]
+	if event1.Attempts != 1 || event1.Started || event1.Failed || event1.Passed {
+		t.Fatal(event1)
+	} else if event1.MaxAttemps != buildMapTask.RetryPolicy.MaxAttempts || event1.MaxAttemps < 2 {
+		t.Fatalf("expected the max attempts of the task's retry policy but found %d", event1.MaxAttemps)
+	} else if !event1.StartAfterDate.Time().After(retryDate) {
+		t.Fatalf("expected the retry after the task's base delay but found %s", event1.StartAfterDate.Time())
+	} else if len(queue.DeadEvents()) != 0 {
+		t.Fatal("the event should be retried instead of dead lettered")
+	}
+}
+
+func TestCancelEvents(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+
+	event1 := db.Event{EventType: "FailableTask", DedupKey: "cancel-me", Data: map[string]string{"mgrsCode": "15TUL"}}
+	event2 := db.Event{EventType: "FailableTask", WorkflowId: primitive.NewObjectID(), Data: map[string]string{"mgrsCode": "15TUK"}}
+	for _, event := range []*db.Event{&event1, &event2} {
+		if err := queue.Publish(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := CancelEvents(ctx, queue, &db.EventQuery{}); err != db.ERROR_EMPTY_EVENT_QUERY {
+		t.Fatal("an empty query should not cancel every event")
+	}
+
+	if cancelledCount, err := CancelEvents(ctx, queue, &db.EventQuery{MgrsCode: "15TUL"}); err != nil {
+		t.Fatal(err)
+	} else if cancelledCount != 1 {
+		t.Fatalf("expected 1 cancelled event but found %d", cancelledCount)
+	}
+	if cancelledCount, err := queue.Count(ctx, &db.EventQuery{State: db.EVENT_STATE_CANCELLED}); err != nil {
+		t.Fatal(err)
+	} else if cancelledCount != 1 {
+		t.Fatalf("expected 1 cancelled event but found %d", cancelledCount)
+	}
+	workflowQuery := db.EventQuery{WorkflowId: event2.WorkflowId.Hex(), State: db.EVENT_STATE_PENDING}
+	if pendingCount, err := queue.Count(ctx, &workflowQuery); err != nil {
+		t.Fatal(err)
+	} else if pendingCount != 1 {
+		t.Fatalf("expected 1 pending event in the workflow but found %d", pendingCount)
+	}
+
+	// only the other event is claimed
+	claimedEvent, err := queue.Claim(ctx, &db.NextEventOptions{LeaseOwner: "worker1"})
+	if err != nil {
+		t.Fatal(err)
+	} else if claimedEvent.ID != event2.ID {
+		t.Fatal(claimedEvent)
+	}
+
+	// the running event learns about the cancellation on its next renewal
+	if _, err := CancelEvents(ctx, queue, &db.EventQuery{EventId: event2.ID.Hex()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.RenewLease(ctx, claimedEvent, time.Minute); err != db.ERROR_EVENT_CANCELLED {
+		t.Fatalf("expected a cancelled error but found %v", err)
 	}
 
-	if err = ProcessNextEvent(ctx, dbClient); err == nil {
-		t.Fatal("should have returned an error")
-	} else if err != mongo.ErrNoDocuments {
-		t.Log("the error is not correct")
+	// the dedup key of the cancelled event is free again
+	if err := queue.Publish(ctx, &db.Event{EventType: "FailableTask", DedupKey: "cancel-me"}); err != nil {
+		t.Fatal(err)
 	}
+	if err := queue.Publish(ctx, &db.Event{EventType: "FailableTask", DedupKey: "cancel-me"}); err != db.ERROR_DUPLICATE_EVENT {
+		t.Fatalf("expected a duplicate event error but found %v", err)
+	}
+}
 
-}
\ No newline at end of file
+func TestErrorClass(t *testing.T) {
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-timeoutCtx.Done()
+
+	testCases := []struct {
+		err   error
+		class string
+	}{
+		{Permanent(errors.New("bad data")), db.EVENT_ERROR_CLASS_PERMANENT},
+		{fmt.Errorf("download: %w", timeoutCtx.Err()), db.EVENT_ERROR_CLASS_TIMEOUT},
+		{context.Canceled, db.EVENT_ERROR_CLASS_CANCELLED},
+		{errors.New("failed task!"), "*errors.errorString"},
+	}
+	for _, testCase := range testCases {
+		if class := errorClass(testCase.err); class != testCase.class {
+			t.Fatalf("expected class %s for %v but found %s", testCase.class, testCase.err, class)
+		}
+	}
+}
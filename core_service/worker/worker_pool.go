@@ -0,0 +1,281 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	DISPATCH_POLL          = "poll"
+	DISPATCH_CHANGE_STREAM = "changeStream"
+
+	// with change streams new events wake the workers so the queue only
+	// has to be polled for retries and delayed events
+	POLL_IDLE_DELAY           = 5 * time.Second
+	CHANGE_STREAM_IDLE_DELAY  = 30 * time.Second
+	CHANGE_STREAM_RETRY_DELAY = 30 * time.Second
+
+	// how long a stopping pool waits for in-flight events before it
+	// stops their tasks and releases them back to the queue
+	DEFAULT_DRAIN_TIMEOUT = 1 * time.Minute
+)
+
+// WorkerPool runs a fixed number of goroutines which each claim and
+// process events from the queue. A TaskDefinition can cap how many
+// events of its type run at once with MaxConcurrency, so a long running
+// index task never occupies more than its share of the pool.
+type WorkerPool struct {
+	queue       Queue
+	concurrency int
+
+	mutex   sync.Mutex
+	running map[string]int
+	// the claimed events, reported by the worker heartbeat
+	current map[primitive.ObjectID]db.WorkerEvent
+	// closed and replaced by Wake to signal idle workers, along with how
+	// long an idle worker waits before polling the queue again
+	wake      chan struct{}
+	idleDelay time.Duration
+
+	drainTimeout time.Duration
+	waitGroup    sync.WaitGroup
+}
+
+func NewWorkerPool(queue Queue, concurrency int) *WorkerPool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &WorkerPool{
+		queue:       queue,
+		concurrency: concurrency,
+		running:     make(map[string]int),
+		current:     make(map[primitive.ObjectID]db.WorkerEvent),
+		wake:        make(chan struct{}),
+		idleDelay:   POLL_IDLE_DELAY,
+
+		drainTimeout: DEFAULT_DRAIN_TIMEOUT,
+	}
+}
+
+func (pool *WorkerPool) SetDrainTimeout(drainTimeout time.Duration) {
+	pool.drainTimeout = drainTimeout
+}
+
+// Wake makes every idle worker check the queue right away.
+func (pool *WorkerPool) Wake() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	close(pool.wake)
+	pool.wake = make(chan struct{})
+}
+
+func (pool *WorkerPool) SetIdleDelay(idleDelay time.Duration) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.idleDelay = idleDelay
+}
+
+// idleState returns the current wake channel and idle delay.
+func (pool *WorkerPool) idleState() (<-chan struct{}, time.Duration) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.wake, pool.idleDelay
+}
+
+// Run starts the pool and blocks until the context is done. Once the
+// context is cancelled no new events are claimed and Run waits for the
+// events already in flight to finish. Events still running after the
+// drain timeout have their tasks stopped and are released back to the
+// queue before Run returns.
+func (pool *WorkerPool) Run(ctx context.Context) {
+	log.Printf("[worker] starting pool with %d workers\n", pool.concurrency)
+
+	// let the tasks finish even if the pool is asked to stop
+	taskCtx, stopTasks := context.WithCancel(detachedContext{ctx})
+	defer stopTasks()
+
+	for i := 0; i < pool.concurrency; i++ {
+		pool.waitGroup.Add(1)
+		go pool.runWorker(ctx, taskCtx, i)
+	}
+
+	<-ctx.Done()
+	log.Println("[worker] draining in-flight events")
+	drained := make(chan struct{})
+	go func() {
+		pool.waitGroup.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(pool.drainTimeout):
+		log.Println("[worker] drain timed out, releasing in-flight events")
+		stopTasks()
+		<-drained
+	}
+	log.Println("[worker] pool stopped")
+}
+
+func (pool *WorkerPool) runWorker(ctx, taskCtx context.Context, workerIndex int) {
+	defer pool.waitGroup.Done()
+
+	for ctx.Err() == nil {
+		// grab the wake channel before claiming so an insert made while
+		// the queue is being checked isn't missed
+		wake, delay := pool.idleState()
+		event, err := pool.claimEvent(ctx)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				log.Printf("[worker %d] no events found\n", workerIndex)
+			} else if ctx.Err() == nil {
+				log.Println(err)
+			}
+		} else {
+			if err := ProcessEvent(taskCtx, pool.queue, event); err != nil {
+				log.Println(err)
+			}
+			pool.releaseSlot(event)
+			delay = 1 * time.Millisecond
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// claimEvent claims without holding the pool lock, so the workers don't
+// wait on each other's round-trips to the queue. Two workers can both
+// claim the last free slot of a type, the one which loses the race
+// gives its event back without counting an attempt and claims again
+// with the type excluded.
+func (pool *WorkerPool) claimEvent(ctx context.Context) (*db.Event, error) {
+	for {
+		opts := db.NextEventOptions{
+			ExcludedEventTypes: pool.excludedEventTypes(),
+			LeaseOwner:         WorkerLeaseOwner,
+		}
+		event, err := pool.queue.Claim(ctx, &opts)
+		if err != nil {
+			return nil, err
+		}
+		if pool.reserveSlot(event) {
+			return event, nil
+		}
+
+		log.Printf("[worker] %s is at its max concurrency, releasing event %s\n", event.EventType, event.ID.Hex())
+		event.Started = false
+		if err := completeProcessedEvent(detachedContext{ctx}, pool.queue, event); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (pool *WorkerPool) excludedEventTypes() []string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.saturatedEventTypes()
+}
+
+// reserveSlot counts the claimed event as running unless its type is
+// already at its MaxConcurrency.
+func (pool *WorkerPool) reserveSlot(event *db.Event) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	task, exists := TaskDefinitions[event.EventType]
+	if exists && task.MaxConcurrency > 0 && pool.running[event.EventType] >= task.MaxConcurrency {
+		return false
+	}
+	pool.running[event.EventType] += 1
+	pool.current[event.ID] = db.WorkerEvent{
+		EventId:     event.ID,
+		EventType:   event.EventType,
+		StartedDate: event.StartedDate,
+	}
+	return true
+}
+
+func (pool *WorkerPool) releaseSlot(event *db.Event) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	delete(pool.current, event.ID)
+	pool.running[event.EventType] -= 1
+	if pool.running[event.EventType] <= 0 {
+		delete(pool.running, event.EventType)
+	}
+}
+
+// CurrentEvents returns the events the pool is running, oldest first.
+func (pool *WorkerPool) CurrentEvents() []db.WorkerEvent {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	currentEvents := make([]db.WorkerEvent, 0, len(pool.current))
+	for _, currentEvent := range pool.current {
+		currentEvents = append(currentEvents, currentEvent)
+	}
+	sort.Slice(currentEvents, func(i, j int) bool {
+		return currentEvents[i].StartedDate < currentEvents[j].StartedDate
+	})
+	return currentEvents
+}
+
+// event types which are running at their MaxConcurrency, the caller
+// must hold the pool lock
+func (pool *WorkerPool) saturatedEventTypes() []string {
+	eventTypes := make([]string, 0)
+	for eventType, task := range TaskDefinitions {
+		if task.MaxConcurrency > 0 && pool.running[eventType] >= task.MaxConcurrency {
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+	return eventTypes
+}
+
+// detachedContext keeps the values of its parent but is never cancelled
+// so in-flight tasks can finish while the pool drains.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// dispatchEventInserts wakes the pool whenever an event is published. If
+// the queue can't be watched the pool is left to poll, if an open watch
+// breaks it is reopened after a delay.
+func (pool *WorkerPool) dispatchEventInserts(ctx context.Context) {
+	for ctx.Err() == nil {
+		pool.SetIdleDelay(CHANGE_STREAM_IDLE_DELAY)
+		err := pool.queue.Watch(ctx, pool.Wake)
+		pool.SetIdleDelay(POLL_IDLE_DELAY)
+		if err == nil {
+			return
+		} else if err == db.ERROR_CHANGE_STREAMS_UNSUPPORTED {
+			log.Println("[worker] change streams unavailable, falling back to polling")
+			return
+		}
+		log.Println("[worker] event change stream closed, polling until it is reopened:", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(CHANGE_STREAM_RETRY_DELAY):
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package worker
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestWorkerPoolSaturatedEventTypes(t *testing.T) {
+	pool := NewWorkerPool(nil, 10)
+
+	pool.running["RequestCurrentIndexFilesTask"] = 1
+	pool.running["BuildBoundaryMapTask"] = 7
+	pool.running["FailableTask"] = 9
+
+	if saturated := pool.saturatedEventTypes(); !reflect.DeepEqual(saturated, []string{"RequestCurrentIndexFilesTask"}) {
+		t.Fatalf("expected only the index task to be saturated but found %v", saturated)
+	}
+
+	pool.running["BuildBoundaryMapTask"] += 1
+	saturated := pool.saturatedEventTypes()
+	sort.Strings(saturated)
+	if !reflect.DeepEqual(saturated, []string{"BuildBoundaryMapTask", "RequestCurrentIndexFilesTask"}) {
+		t.Fatalf("expected the map task to be saturated but found %v", saturated)
+	}
+
+	pool.releaseSlot(&db.Event{EventType: "RequestCurrentIndexFilesTask"})
+	if _, exists := pool.running["RequestCurrentIndexFilesTask"]; exists {
+		t.Fatal("released event type should be removed from the running counts")
+	}
+	if saturated := pool.saturatedEventTypes(); !reflect.DeepEqual(saturated, []string{"BuildBoundaryMapTask"}) {
+		t.Fatalf("expected only the map task to be saturated but found %v", saturated)
+	}
+}
+
+func TestWorkerPoolReleasesEventsOverMaxConcurrency(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+	pool := NewWorkerPool(queue, 4)
+
+	indexEvent := db.Event{EventType: "RequestCurrentIndexFilesTask"}
+	if err := queue.Publish(ctx, &indexEvent); err != nil {
+		t.Fatal(err)
+	}
+	// another worker takes the only index slot while this one is claiming
+	pool.queue = &racingQueue{MemoryQueue: queue, onClaim: func() {
+		if !pool.reserveSlot(&db.Event{ID: primitive.NewObjectID(), EventType: "RequestCurrentIndexFilesTask"}) {
+			t.Error("expected the other index event to take the free slot")
+		}
+	}}
+	if _, err := pool.claimEvent(ctx); err != mongo.ErrNoDocuments {
+		t.Fatalf("expected no event to be claimed but found %v", err)
+	}
+
+	releasedEvent := queue.events[queue.indexOf(indexEvent.ID)]
+	if releasedEvent.Started || releasedEvent.LeaseOwner != "" || releasedEvent.Attempts != 0 || len(releasedEvent.Errors) != 0 {
+		t.Fatalf("expected the event to be released without an attempt: %v", releasedEvent)
+	} else if pool.running["RequestCurrentIndexFilesTask"] != 1 {
+		t.Fatalf("expected only the first index event to be running but found %v", pool.running)
+	}
+
+	// a limited type isn't held back by claims of other types
+	if excluded := pool.excludedEventTypes(); !reflect.DeepEqual(excluded, []string{"RequestCurrentIndexFilesTask"}) {
+		t.Fatalf("expected only the index task to be excluded but found %v", excluded)
+	}
+	mapEvent := db.Event{EventType: "BuildBoundaryMapTask"}
+	if err := queue.Publish(ctx, &mapEvent); err != nil {
+		t.Fatal(err)
+	}
+	if claimedEvent, err := pool.claimEvent(ctx); err != nil {
+		t.Fatal(err)
+	} else if claimedEvent.ID != mapEvent.ID {
+		t.Fatalf("expected the map event to be claimed but found %v", claimedEvent)
+	}
+}
+
+// racingQueue runs onClaim once before the first claim returns.
+type racingQueue struct {
+	*MemoryQueue
+	onClaim func()
+}
+
+func (queue *racingQueue) Claim(ctx context.Context, opts *db.NextEventOptions) (*db.Event, error) {
+	event, err := queue.MemoryQueue.Claim(ctx, opts)
+	if queue.onClaim != nil {
+		queue.onClaim()
+		queue.onClaim = nil
+	}
+	return event, err
+}
+
+func TestNewWorkerPoolConcurrency(t *testing.T) {
+	if pool := NewWorkerPool(nil, 0); pool.concurrency != 1 {
+		t.Fatalf("expected a pool size of at least 1 but found %d", pool.concurrency)
+	}
+}
+
+func TestWorkerPoolWake(t *testing.T) {
+	pool := NewWorkerPool(nil, 2)
+
+	wake, delay := pool.idleState()
+	if delay != POLL_IDLE_DELAY {
+		t.Fatalf("expected the poll idle delay but found %v", delay)
+	}
+
+	pool.Wake()
+	select {
+	case <-wake:
+	default:
+		t.Fatal("wake channel was not closed")
+	}
+
+	// workers waiting after the wake get a fresh channel
+	nextWake, _ := pool.idleState()
+	select {
+	case <-nextWake:
+		t.Fatal("new wake channel should still be open")
+	default:
+	}
+
+	pool.SetIdleDelay(CHANGE_STREAM_IDLE_DELAY)
+	if _, delay := pool.idleState(); delay != CHANGE_STREAM_IDLE_DELAY {
+		t.Fatalf("expected the change stream idle delay but found %v", delay)
+	}
+}
+
+func TestWorkerPoolCurrentEvents(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+	pool := NewWorkerPool(queue, 2)
+
+	event := db.Event{EventType: "FailableTask"}
+	if err := queue.Publish(ctx, &event); err != nil {
+		t.Fatal(err)
+	}
+	claimedEvent, err := pool.claimEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if claimedEvent.WorkerId != WorkerLeaseOwner {
+		t.Fatalf("expected the event to be stamped with %s but found %s", WorkerLeaseOwner, claimedEvent.WorkerId)
+	}
+
+	currentEvents := pool.CurrentEvents()
+	if len(currentEvents) != 1 || currentEvents[0].EventId != event.ID || currentEvents[0].EventType != "FailableTask" {
+		t.Fatalf("expected the claimed event to be current but found %v", currentEvents)
+	}
+
+	pool.releaseSlot(claimedEvent)
+	if currentEvents := pool.CurrentEvents(); len(currentEvents) != 0 {
+		t.Fatalf("expected no current events but found %v", currentEvents)
+	}
+}
+
+func TestWorkerPoolReleasesEventsAfterDrainTimeout(t *testing.T) {
+	taskStarted := make(chan struct{}, 1)
+	TaskDefinitions["BlockingTask"] = TaskDefinition{
+		TaskFunc: func(ctx context.Context, event *db.Event) (*db.EventResult, error) {
+			taskStarted <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		MaxDuration: time.Minute,
+	}
+	defer delete(TaskDefinitions, "BlockingTask")
+
+	queue := NewMemoryQueue()
+	event := db.Event{EventType: "BlockingTask", MaxAttemps: 3}
+	if err := queue.Publish(context.Background(), &event); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewWorkerPool(queue, 1)
+	pool.SetDrainTimeout(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-taskStarted
+		cancel()
+	}()
+	pool.Run(ctx)
+
+	events := queue.Events()
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event but found %d", len(events))
+	}
+	releasedEvent := events[0]
+	if releasedEvent.Started || releasedEvent.Failed || releasedEvent.LeaseOwner != "" {
+		t.Fatal("event was not released back to the queue")
+	} else if releasedEvent.Attempts != 0 {
+		t.Fatalf("a released event should not use an attempt but found %d", releasedEvent.Attempts)
+	} else if len(releasedEvent.Errors) != 1 || releasedEvent.Errors[0].Class != db.EVENT_ERROR_CLASS_SHUTDOWN {
+		t.Fatalf("expected a shutdown error but found %v", releasedEvent.Errors)
+	}
+}
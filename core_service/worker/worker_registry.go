@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	db "core_service/database"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// how often a worker refreshes its registration in the worker collection
+const WORKER_HEARTBEAT_INTERVAL = 15 * time.Second
+
+// Version is the build of the worker, set when building with
+// -ldflags "-X core_service/worker.Version=..."
+var Version = "dev"
+
+// NewWorkerRegistration describes this worker process. Workers started
+// without a name are named after their host.
+func NewWorkerRegistration(name string, concurrency int) db.Worker {
+	hostName, err := os.Hostname()
+	if err != nil {
+		hostName = "unknown"
+	}
+	if name == "" {
+		name = hostName
+	}
+	return db.Worker{
+		ID:          WorkerLeaseOwner,
+		Name:        name,
+		Host:        hostName,
+		Version:     Version,
+		Concurrency: concurrency,
+	}
+}
+
+// RunWorkerHeartbeat registers the worker and keeps its heartbeat and
+// current events up to date until the context is done, when the worker
+// is marked as stopped.
+func RunWorkerHeartbeat(ctx context.Context, dbClient *mongo.Client, registration *db.Worker, pool *WorkerPool) {
+	if err := db.RegisterWorker(ctx, dbClient, registration); err != nil {
+		log.Println("[worker] failed to register worker:", err)
+	}
+
+	heartbeatTicker := time.NewTicker(WORKER_HEARTBEAT_INTERVAL)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := db.StopWorker(detachedContext{ctx}, dbClient, registration.ID); err != nil {
+				log.Println(err)
+			}
+			return
+		case <-heartbeatTicker.C:
+			if err := db.SaveWorkerHeartbeat(ctx, dbClient, registration.ID, pool.CurrentEvents()); err != nil && ctx.Err() == nil {
+				log.Println(err)
+			}
+		}
+	}
+}
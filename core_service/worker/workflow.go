@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	db "core_service/database"
+)
+
+const INDEX_RUN_WORKFLOW = "IndexRun"
+
+// CompleteWorkflowIfDone finishes the workflow once none of its events
+// are left to run. The follow up events are only published when every
+// event in the run passed.
+func CompleteWorkflowIfDone(ctx context.Context, dbClient *mongo.Client, workflowId primitive.ObjectID) error {
+	progress, err := db.FindWorkflowProgress(ctx, dbClient, workflowId)
+	if err != nil {
+		return err
+	} else if !progress.Done() {
+		return nil
+	}
+
+	workflow, err := db.FindWorkflow(ctx, dbClient, bson.D{{"_id", workflowId}})
+	if err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	status := db.WORKFLOW_STATUS_PASSED
+	if progress.Failed > 0 {
+		status = db.WORKFLOW_STATUS_FAILED
+	} else if progress.Cancelled > 0 {
+		status = db.WORKFLOW_STATUS_CANCELLED
+	}
+	completed, err := db.CompleteWorkflow(ctx, dbClient, workflow, status)
+	if err != nil || !completed {
+		return err
+	}
+	log.Printf("[worker] workflow %s %s (%s) %s, passed: %d, failed: %d, cancelled: %d\n",
+		workflow.Name, workflow.RunKey, workflow.ID.Hex(), status, progress.Passed, progress.Failed, progress.Cancelled)
+
+	if status != db.WORKFLOW_STATUS_PASSED {
+		return nil
+	}
+	for _, followUpEvent := range workflow.FollowUpEvents {
+		followUpEvent.ID = primitive.NilObjectID
+		followUpEvent.ParentId = workflow.RootEventId
+		if err := db.SaveEvent(ctx, dbClient, &followUpEvent); err == db.ERROR_DUPLICATE_EVENT {
+			log.Printf("[worker] follow up %s event already queued\n", followUpEvent.EventType)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompleteDoneWorkflows checks every running workflow, the lease reaper
+// job runs it every minute so a run completes shortly after its last
+// event passed, was dead lettered or cancelled.
+func CompleteDoneWorkflows(ctx context.Context, dbClient *mongo.Client) error {
+	workflows, err := db.FindWorkflows(ctx, dbClient, bson.D{{"status", db.WORKFLOW_STATUS_RUNNING}}, nil)
+	if err != nil {
+		return err
+	}
+	for _, workflow := range *workflows {
+		if err := CompleteWorkflowIfDone(ctx, dbClient, workflow.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+//go:build integration
+
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	db "core_service/database"
+)
+
+func startTestWorkflow(ctx context.Context, t *testing.T, failChild bool) *db.Workflow {
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootEvent := db.Event{
+		EventType:      "FailableTask",
+		MaxAttemps:     1,
+		StartAfterDate: primitive.NewDateTimeFromTime(time.Now()),
+		Data:           map[string]string{"fail": "false"},
+	}
+	if err := db.SaveEvent(ctx, dbClient, &rootEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := db.Workflow{Name: "TestRun", RunKey: "2026-10-15"}
+	followUpEvent := db.Event{EventType: "FailableTask", MaxAttemps: 1, Data: map[string]string{"fail": "false", "followUp": "true"}}
+	if err := db.StartWorkflow(ctx, dbClient, &workflow, &rootEvent, followUpEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	fail := "false"
+	if failChild {
+		fail = "true"
+	}
+	childEvent := db.NewChildEvent(&rootEvent, db.Event{
+		EventType:      "FailableTask",
+		MaxAttemps:     1,
+		StartAfterDate: primitive.NewDateTimeFromTime(time.Now()),
+		Data:           map[string]string{"fail": fail},
+	})
+	if err := db.SaveEvent(ctx, dbClient, &childEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	return &workflow
+}
+
+func TestWorkflowPublishesFollowUpEvents(t *testing.T) {
+	db.CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := startTestWorkflow(ctx, t, false)
+
+	if err := ProcessNextEvent(ctx, NewMongoQueue(dbClient)); err != nil {
+		t.Fatal(err)
+	}
+	if progress, err := db.FindWorkflowProgress(ctx, dbClient, workflow.ID); err != nil {
+		t.Fatal(err)
+	} else if progress.Passed != 1 || progress.Pending != 1 {
+		t.Fatal(progress)
+	}
+
+	if err := ProcessNextEvent(ctx, NewMongoQueue(dbClient)); err != nil {
+		t.Fatal(err)
+	}
+	// the reaper job completes the workflow
+	if err := ReapExpiredEventLeases(ctx, dbClient); err != nil {
+		t.Fatal(err)
+	}
+
+	storedWorkflow, err := db.FindWorkflow(ctx, dbClient, bson.D{{"name", "TestRun"}, {"run_key", "2026-10-15"}})
+	if err != nil {
+		t.Fatal(err)
+	} else if storedWorkflow.Status != db.WORKFLOW_STATUS_PASSED || storedWorkflow.CompletedDate == 0 {
+		t.Fatal(storedWorkflow)
+	}
+
+	if count, err := db.CountEvents(ctx, dbClient, bson.D{{"data.followUp", "true"}, {"parent_id", workflow.RootEventId}}); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Fatalf("expected 1 follow up event but found %d", count)
+	}
+}
+
+func TestWorkflowFailsWithDeadChild(t *testing.T) {
+	db.CleanTestDatabase()
+
+	ctx := context.Background()
+	dbClient, err := db.DefaultDatabaseClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := startTestWorkflow(ctx, t, true)
+
+	for i := 0; i < 2; i++ {
+		if err := ProcessNextEvent(ctx, NewMongoQueue(dbClient)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	progress, err := db.FindWorkflowProgress(ctx, dbClient, workflow.ID)
+	if err != nil {
+		t.Fatal(err)
+	} else if progress.Passed != 1 || progress.Failed != 1 || !progress.Done() {
+		t.Fatal(progress)
+	}
+	if err := ReapExpiredEventLeases(ctx, dbClient); err != nil {
+		t.Fatal(err)
+	}
+
+	storedWorkflow, err := db.FindWorkflow(ctx, dbClient, bson.D{{"_id", workflow.ID}})
+	if err != nil {
+		t.Fatal(err)
+	} else if storedWorkflow.Status != db.WORKFLOW_STATUS_FAILED {
+		t.Fatal(storedWorkflow)
+	}
+
+	if count, err := db.CountEvents(ctx, dbClient, bson.D{{"data.followUp", "true"}}); err != nil {
+		t.Fatal(err)
+	} else if count != 0 {
+		t.Fatal("follow up event published for a failed workflow")
+	}
+
+	if deadEvents, err := db.FindDeadEvents(ctx, dbClient, bson.D{{"event.workflow_id", workflow.ID}}, nil); err != nil {
+		t.Fatal(err)
+	} else if len(*deadEvents) != 1 || (*deadEvents)[0].Event.ParentId != workflow.RootEventId {
+		t.Fatal(deadEvents)
+	}
+}